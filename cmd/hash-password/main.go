@@ -4,18 +4,54 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fail2rest/v2/internal/auth"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
 	var password string
+	var apiKey, totp bool
+	var name, label, expires, roles, jails, cidrs, username, issuer string
 	flag.StringVar(&password, "password", "", "Password to hash")
+	flag.BoolVar(&apiKey, "api-key", false, "Generate a new API key instead")
+	flag.BoolVar(&totp, "totp", false, "Generate a TOTP secret and recovery codes for a user instead")
+	flag.StringVar(&username, "username", "", "TOTP: user the secret is for, shown in authenticator apps")
+	flag.StringVar(&issuer, "issuer", auth.TOTPIssuer, "TOTP: service name shown in authenticator apps")
+	flag.StringVar(&name, "name", "", "API key: name shown in the audit log")
+	flag.StringVar(&label, "label", "", "API key: human description")
+	flag.StringVar(&expires, "expires", "", "API key: expiry as a date (2025-12-31), a time (RFC 3339) or a duration (90d, 12h)")
+	flag.StringVar(&roles, "roles", "", "API key: comma-separated roles (stats, viewer, operator, admin)")
+	flag.StringVar(&jails, "jails", "", "API key: comma-separated jail patterns, e.g. nginx-*")
+	flag.StringVar(&cidrs, "allowed-cidrs", "", "API key: comma-separated source networks the key may be used from")
 	flag.Parse()
 
+	if apiKey {
+		if err := generateAPIKey(name, label, expires, splitList(roles), splitList(jails), splitList(cidrs)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating API key: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if totp {
+		if err := generateTOTP(username, issuer); err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating TOTP secret: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if password == "" {
 		fmt.Fprintf(os.Stderr, "Usage: %s -password <password>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -api-key [-name <name>] [-label <text>] [-expires <when>] [-roles <roles>] [-jails <patterns>] [-allowed-cidrs <networks>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -totp -username <username> [-issuer <name>]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Example: %s -password mySecurePassword123\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Example: %s -api-key -name monitoring -roles stats -expires 90d\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Example: %s -totp -username alice\n", os.Args[0])
 		os.Exit(1)
 	}
 
@@ -27,3 +63,132 @@ func main() {
 
 	fmt.Println(string(hashed))
 }
+
+// generateAPIKey prints a new API key and the config entry to add for it
+func generateAPIKey(name, label, expires string, roles, jails, cidrs []string) error {
+	var expiresAt *time.Time
+	if expires != "" {
+		t, err := parseExpiry(expires, time.Now())
+		if err != nil {
+			return err
+		}
+		expiresAt = &t
+	}
+	for _, role := range roles {
+		if !auth.ValidRole(role) {
+			return fmt.Errorf("invalid role %q (must be stats, viewer, operator or admin)", role)
+		}
+	}
+	for _, cidr := range cidrs {
+		if _, err := auth.ParseNetwork(cidr); err != nil {
+			return fmt.Errorf("invalid network %q", cidr)
+		}
+	}
+
+	key, id, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "API key (shown only once, give it to the client):")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintf(os.Stderr, "  %s\n", key)
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Add this entry to auth.api_keys in the config file:")
+	fmt.Fprintln(os.Stderr)
+
+	fmt.Printf("    - id: %q\n", id)
+	fmt.Printf("      hash: %q\n", hash)
+	if name != "" {
+		fmt.Printf("      name: %q\n", name)
+	}
+	if label != "" {
+		fmt.Printf("      label: %q\n", label)
+	}
+	if expiresAt != nil {
+		fmt.Printf("      expires_at: %s\n", expiresAt.UTC().Format(time.RFC3339))
+	}
+	printList("allowed_cidrs", cidrs)
+	printList("roles", roles)
+	printList("jails", jails)
+	return nil
+}
+
+// generateTOTP prints a new TOTP secret with its provisioning URI and
+// recovery codes, and the config fields to add to the user
+func generateTOTP(username, issuer string) error {
+	if username == "" {
+		return fmt.Errorf("-username is required")
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Add this account to the user's authenticator app, by the URI (usually as a QR code) or the secret:")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintf(os.Stderr, "  %s\n", auth.TOTPProvisioningURI(secret, username, issuer))
+	fmt.Fprintf(os.Stderr, "  secret: %s\n", secret)
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Recovery codes (shown only once, each works once in place of a TOTP code):")
+	fmt.Fprintln(os.Stderr)
+	for _, code := range codes {
+		fmt.Fprintf(os.Stderr, "  %s\n", code)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintf(os.Stderr, "Add these fields to user %q in auth.users in the config file:\n", username)
+	fmt.Fprintln(os.Stderr)
+
+	fmt.Printf("      totp_secret: %q\n", secret)
+	fmt.Println("      recovery_codes:")
+	for _, hash := range hashes {
+		fmt.Printf("        - %q\n", hash)
+	}
+	return nil
+}
+
+// parseExpiry parses a date, an RFC 3339 time or a duration from now, which
+// may be given in days (e.g. "90d")
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q", value)
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func printList(field string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = strconv.Quote(item)
+	}
+	fmt.Printf("      %s: [%s]\n", field, strings.Join(quoted, ", "))
+}
@@ -0,0 +1,329 @@
+// Command mock-idp is a minimal OpenID Connect identity provider for
+// developing and testing the OpenID Connect login without an external
+// service. It approves every login without asking for credentials, so it
+// must never be exposed to untrusted networks.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fail2rest/v2/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// codeTimeout is how long an authorization code can be redeemed for
+const codeTimeout = time.Minute
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	user         string
+	groups       []string
+	tokenTTL     time.Duration
+
+	kid string
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+// authorization is a login approved at /authorize, waiting to be redeemed
+// at /token
+type authorization struct {
+	redirectURI string
+	nonce       string
+	challenge   string // PKCE code challenge (S256)
+	user        string
+	groups      []string
+	expires     time.Time
+}
+
+func main() {
+	var listen, issuer, clientID, clientSecret, user, groups string
+	var tokenTTL time.Duration
+	flag.StringVar(&listen, "listen", "127.0.0.1:9000", "Address to listen on")
+	flag.StringVar(&issuer, "issuer", "", "Issuer URL (default: http://<listen>)")
+	flag.StringVar(&clientID, "client-id", "fail2rest", "Client ID of fail2rest")
+	flag.StringVar(&clientSecret, "client-secret", "", "Client secret of fail2rest; empty accepts a public client")
+	flag.StringVar(&user, "user", "alice", "User logged in, unless the login names another with ?login_hint=")
+	flag.StringVar(&groups, "groups", "fail2rest-admins", "Comma-separated groups of the user, unless the login names others with ?groups=")
+	flag.DurationVar(&tokenTTL, "token-ttl", time.Hour, "Lifetime of issued tokens")
+	flag.Parse()
+
+	if issuer == "" {
+		issuer = "http://" + listen
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+
+	p := &provider{
+		issuer:       strings.TrimRight(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		user:         user,
+		groups:       splitList(groups),
+		tokenTTL:     tokenTTL,
+		kid:          randomString(8),
+		key:          key,
+		codes:        make(map[string]authorization),
+	}
+
+	log.Printf("Mock identity provider %s listening on %s", p.issuer, listen)
+	log.Println("WARNING: every login is approved; use only for development and testing")
+	log.Fatal(http.ListenAndServe(listen, p.handler()))
+}
+
+// handler serves the provider's endpoints
+func (p *provider) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/mint", p.mint)
+	return mux
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"grant_types_supported":                 []string{"authorization_code"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	jwk, err := auth.NewJWK(p.kid, &p.key.PublicKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	jwk.Alg = "RS256"
+	writeJSON(w, http.StatusOK, auth.JWKSet{Keys: []auth.JWK{jwk}})
+}
+
+// authorize approves the login at once and redirects back with a code
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.clientID {
+		writeError(w, http.StatusBadRequest, "unauthorized_client", "unknown client_id")
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Host == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid redirect_uri")
+		return
+	}
+
+	params := url.Values{}
+	params.Set("state", q.Get("state"))
+	switch {
+	case q.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+	case q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256":
+		params.Set("error", "invalid_request")
+		params.Set("error_description", "only the S256 code challenge method is supported")
+	default:
+		login := authorization{
+			redirectURI: redirectURI.String(),
+			nonce:       q.Get("nonce"),
+			challenge:   q.Get("code_challenge"),
+			user:        p.user,
+			groups:      p.groups,
+			expires:     time.Now().Add(codeTimeout),
+		}
+		if hint := q.Get("login_hint"); hint != "" {
+			login.user = hint
+		}
+		if groups, ok := q["groups"]; ok {
+			login.groups = splitList(strings.Join(groups, ","))
+		}
+		code := randomString(16)
+		p.mu.Lock()
+		p.codes[code] = login
+		p.mu.Unlock()
+		params.Set("code", code)
+		log.Printf("Approved login of %s (groups %v)", login.user, login.groups)
+	}
+
+	query := redirectURI.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems an authorization code for an ID token and access token
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "POST required")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !p.clientAuthenticated(r) {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	login, exists := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !exists || time.Now().After(login.expires) {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != login.redirectURI {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match")
+		return
+	}
+	if login.challenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != login.challenge {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+			return
+		}
+	}
+
+	idToken, err := p.sign(login.user, login.groups, login.nonce)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken, err := p.sign(login.user, login.groups, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"id_token":     idToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(p.tokenTTL.Seconds()),
+	})
+}
+
+// mint issues an access token directly, for testing bearer tokens with
+// curl: /mint?user=bob&groups=ops,web
+func (p *provider) mint(w http.ResponseWriter, r *http.Request) {
+	user, groups := p.user, p.groups
+	if v := r.URL.Query().Get("user"); v != "" {
+		user = v
+	}
+	if v, ok := r.URL.Query()["groups"]; ok {
+		groups = splitList(strings.Join(v, ","))
+	}
+
+	accessToken, err := p.sign(user, groups, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(p.tokenTTL.Seconds()),
+	})
+}
+
+// clientAuthenticated checks the client credentials of a token request,
+// sent with HTTP basic authentication or in the form
+func (p *provider) clientAuthenticated(r *http.Request) bool {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID {
+		return false
+	}
+	return p.clientSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(p.clientSecret)) == 1
+}
+
+// sign issues a token for user; tokens with a nonce are ID tokens
+func (p *provider) sign(user string, groups []string, nonce string) (string, error) {
+	now := time.Now()
+	subject := sha256.Sum256([]byte(user))
+	claims := jwt.MapClaims{
+		"iss":                p.issuer,
+		"sub":                hex.EncodeToString(subject[:16]),
+		"aud":                p.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(p.tokenTTL).Unix(),
+		"jti":                randomString(16),
+		"preferred_username": user,
+		"groups":             groups,
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.kid
+	return token.SignedString(p.key)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate random bytes: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
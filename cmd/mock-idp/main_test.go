@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fail2rest/v2/internal/auth"
+)
+
+const testRedirectURL = "https://fail2rest.example/api/v1/auth/oidc/callback"
+
+// startProvider serves a mock identity provider for the OpenID Connect
+// client of the API
+func startProvider(t *testing.T, clientSecret string) (*provider, *httptest.Server) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &provider{
+		clientID:     "fail2rest",
+		clientSecret: clientSecret,
+		user:         "alice",
+		groups:       []string{"fail2rest-admins"},
+		tokenTTL:     time.Hour,
+		kid:          "test",
+		key:          key,
+		codes:        make(map[string]authorization),
+	}
+	server := httptest.NewServer(p.handler())
+	t.Cleanup(server.Close)
+	p.issuer = server.URL
+	return p, server
+}
+
+func newClient(server *httptest.Server, clientSecret string) *auth.OIDCProvider {
+	return auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:        server.URL,
+		ClientID:      "fail2rest",
+		ClientSecret:  clientSecret,
+		RedirectURL:   testRedirectURL,
+		Scopes:        []string{"openid", "profile", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		GroupScopes: []auth.GroupScope{
+			{Group: "fail2rest-admins", Scope: auth.Scope{Roles: []string{auth.RoleAdmin}}},
+			{Group: "web", Scope: auth.Scope{Roles: []string{auth.RoleOperator}, Jails: []string{"nginx-*"}}},
+		},
+	})
+}
+
+// login follows the authorization URL to the callback, returning its query
+func login(t *testing.T, authURL string, extra url.Values) url.Values {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	for name, values := range extra {
+		q[name] = values
+	}
+	u.RawQuery = q.Encode()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %s", resp.Status)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback.Query()
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		extra     url.Values
+		principal string
+		roles     []string
+	}{
+		{"default user", nil, "oidc:alice", []string{auth.RoleAdmin}},
+		{"login hint and groups", url.Values{"login_hint": {"bob"}, "groups": {"web"}}, "oidc:bob", []string{auth.RoleOperator}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := startProvider(t, "s3cret")
+			client := newClient(server, "s3cret")
+
+			authURL, err := client.AuthCodeURL(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			callback := login(t, authURL, tt.extra)
+			identity, err := client.Exchange(ctx, callback.Get("state"), callback.Get("code"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Principal != tt.principal || len(identity.Roles) != 1 || identity.Roles[0] != tt.roles[0] {
+				t.Errorf("identity = %+v, want %s with %v", identity, tt.principal, tt.roles)
+			}
+
+			// Codes and states are single use
+			if _, err := client.Exchange(ctx, callback.Get("state"), callback.Get("code")); !errors.Is(err, auth.ErrOIDCState) {
+				t.Errorf("reused state: error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLoginRefused(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("wrong client secret", func(t *testing.T) {
+		_, server := startProvider(t, "s3cret")
+		client := newClient(server, "wrong")
+		authURL, err := client.AuthCodeURL(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callback := login(t, authURL, nil)
+		if _, err := client.Exchange(ctx, callback.Get("state"), callback.Get("code")); err == nil {
+			t.Error("login with a wrong client secret succeeded")
+		}
+	})
+
+	t.Run("PKCE challenge of another login", func(t *testing.T) {
+		_, server := startProvider(t, "")
+		client := newClient(server, "")
+		first, err := client.AuthCodeURL(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := client.AuthCodeURL(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The code is bound to the first login's challenge but redeemed
+		// with the second login's state and verifier
+		u, _ := url.Parse(first)
+		callback := login(t, second, url.Values{"code_challenge": {u.Query().Get("code_challenge")}})
+		if _, err := client.Exchange(ctx, callback.Get("state"), callback.Get("code")); err == nil {
+			t.Error("code redeemed with the verifier of another login")
+		}
+	})
+
+	t.Run("no mapped group", func(t *testing.T) {
+		_, server := startProvider(t, "")
+		client := newClient(server, "")
+		authURL, err := client.AuthCodeURL(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		callback := login(t, authURL, url.Values{"groups": {"guests"}})
+		if _, err := client.Exchange(ctx, callback.Get("state"), callback.Get("code")); !errors.Is(err, auth.ErrOIDCNoRole) {
+			t.Errorf("error = %v, want ErrOIDCNoRole", err)
+		}
+	})
+}
+
+func TestMintedBearer(t *testing.T) {
+	_, server := startProvider(t, "")
+	client := newClient(server, "")
+
+	resp, err := http.Get(server.URL + "/mint?user=carol&groups=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var minted struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&minted); err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := client.VerifyBearer(context.Background(), minted.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Principal != "oidc:carol" || identity.TokenID == "" || len(identity.Jails) != 1 || identity.Jails[0] != "nginx-*" {
+		t.Errorf("identity = %+v", identity)
+	}
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
+	"github.com/fail2rest/v2/internal/audit"
 	"github.com/fail2rest/v2/internal/auth"
+	"github.com/fail2rest/v2/internal/bans"
 	"github.com/fail2rest/v2/internal/config"
 	"github.com/fail2rest/v2/internal/fail2ban"
 	"github.com/fail2rest/v2/internal/handlers"
@@ -28,12 +34,31 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	commandTimeout, err := cfg.GetCommandTimeout()
+	if err != nil {
+		log.Fatalf("Invalid fail2ban timeout: %v", err)
+	}
+
 	// Initialize components
-	f2bClient := fail2ban.NewClient(cfg.Fail2ban.ClientPath, cfg.Fail2ban.UseSudo)
+	var f2bClient fail2ban.Backend
+	switch cfg.Fail2ban.Backend {
+	case "socket":
+		log.Printf("Using fail2ban socket %s", cfg.Fail2ban.SocketPath)
+		f2bClient = fail2ban.NewSocketClient(cfg.Fail2ban.SocketPath, cfg.Fail2ban.ClientPath, cfg.Fail2ban.UseSudo, commandTimeout)
+	case "fake":
+		banTime, err := cfg.GetFakeBanTime()
+		if err != nil {
+			log.Fatalf("Invalid fake bantime: %v", err)
+		}
+		log.Println("WARNING: Using the in-memory fake fail2ban backend, no real bans will be applied")
+		f2bClient = fail2ban.NewFakeBackend(cfg.Fail2ban.FakeJails, banTime)
+	default:
+		f2bClient = fail2ban.NewClient(cfg.Fail2ban.ClientPath, cfg.Fail2ban.UseSudo, commandTimeout)
+	}
 
 	// Test fail2ban connection at startup
 	log.Println("Testing fail2ban connection...")
-	if _, err := f2bClient.GetStatus(); err != nil {
+	if _, err := f2bClient.GetStatus(context.Background()); err != nil {
 		log.Printf("WARNING: Failed to connect to fail2ban: %v", err)
 		log.Println("The server will start, but fail2ban operations may fail.")
 		log.Println("See README.md for permission setup instructions.")
@@ -41,31 +66,257 @@ func main() {
 		log.Println("Successfully connected to fail2ban")
 	}
 
+	fellBack, err := cfg.PrepareDataDir()
+	if err != nil {
+		log.Fatalf("Failed to prepare data directory: %v", err)
+	}
+	if fellBack {
+		log.Printf("WARNING: %s is not writable, keeping state in %s instead (set storage.data_dir to choose)", config.DefaultDataDir, cfg.Storage.DataDir)
+	}
+
+	// Expiry of bans with an explicit duration the backend cannot set itself
+	scheduler, err := bans.NewScheduler(f2bClient, filepath.Join(cfg.Storage.DataDir, "scheduled_bans.json"))
+	if err != nil {
+		log.Fatalf("Failed to load scheduled bans: %v", err)
+	}
+	historyRetention, err := cfg.GetBanHistoryRetention()
+	if err != nil {
+		log.Fatalf("Invalid ban history retention: %v", err)
+	}
+	banMetadata, err := bans.NewMetadataStore(filepath.Join(cfg.Storage.DataDir, "ban_metadata.json"), historyRetention)
+	if err != nil {
+		log.Fatalf("Failed to load ban metadata: %v", err)
+	}
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go scheduler.Run(background)
+
+	var auditLog *audit.Log
+	if cfg.Audit.Enabled {
+		auditLog, err = audit.Open(cfg.GetAuditPath())
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLog.Close()
+
+		if result, err := auditLog.Verify(); err != nil {
+			log.Printf("WARNING: Failed to verify audit log: %v", err)
+		} else if !result.Valid {
+			log.Printf("WARNING: Audit log %s is damaged at line %d: %s", cfg.GetAuditPath(), result.BrokenAt, result.Reason)
+		}
+	}
+
 	tokenExpiry, err := cfg.GetTokenExpiry()
 	if err != nil {
 		log.Fatalf("Invalid token expiry: %v", err)
 	}
 
-	// Convert config users to auth format
-	userMap := make(map[string]string)
+	// Convert config users and keys to auth format
+	userMap := make(map[string]auth.User)
 	for _, user := range cfg.Auth.Users {
 		if user.Username != "" && user.Password != "" {
-			userMap[user.Username] = user.Password
+			userMap[user.Username] = auth.User{
+				PasswordHash:  user.Password,
+				Scope:         auth.Scope{Roles: user.Roles, Jails: user.Jails},
+				TOTPSecret:    user.TOTPSecret,
+				RecoveryCodes: user.RecoveryCodes,
+			}
+		}
+	}
+
+	apiKeys := make([]auth.APIKey, 0, len(cfg.Auth.APIKeys))
+	for _, key := range cfg.Auth.APIKeys {
+		apiKey := auth.APIKey{
+			ID:           key.ID,
+			Hash:         key.Hash,
+			Key:          key.Key,
+			Name:         key.Name,
+			Label:        key.Label,
+			Scope:        auth.Scope{Roles: key.Roles, Jails: key.Jails},
+			ExpiresAt:    key.ExpiresAt,
+			AllowedCIDRs: key.AllowedCIDRs,
+		}
+		if !apiKey.Hashed() {
+			log.Printf("WARNING: API key %s is stored in plain text; replace it with a key from hash-password -api-key", apiKey.Principal())
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	// Revoked tokens are kept until they would have expired
+	revocations, err := auth.NewRevocationList(filepath.Join(cfg.Storage.DataDir, "revoked_tokens.json"), tokenExpiry)
+	if err != nil {
+		log.Fatalf("Failed to load revoked tokens: %v", err)
+	}
+
+	refreshExpiry, err := cfg.GetRefreshTokenExpiry()
+	if err != nil {
+		log.Fatalf("Invalid refresh token expiry: %v", err)
+	}
+	var refreshTokens *auth.RefreshStore
+	if refreshExpiry > 0 {
+		refreshTokens, err = auth.NewRefreshStore(filepath.Join(cfg.Storage.DataDir, "refresh_tokens.json"), refreshExpiry)
+		if err != nil {
+			log.Fatalf("Failed to load refresh tokens: %v", err)
+		}
+	}
+
+	keyUsage, err := auth.NewKeyUsage(filepath.Join(cfg.Storage.DataDir, "api_key_usage.json"))
+	if err != nil {
+		log.Fatalf("Failed to load API key usage: %v", err)
+	}
+	defer keyUsage.Flush()
+
+	// TOTP codes and recovery codes already used, which are refused
+	totpState, err := auth.NewSecondFactorState(filepath.Join(cfg.Storage.DataDir, "totp_state.json"))
+	if err != nil {
+		log.Fatalf("Failed to load TOTP state: %v", err)
+	}
+
+	// Users and keys created through the admin endpoints
+	accounts, err := auth.NewAccountStore(filepath.Join(cfg.Storage.DataDir, "accounts.json"))
+	if err != nil {
+		log.Fatalf("Failed to load accounts: %v", err)
+	}
+
+	// Accounts are locked after repeated failed logins; client IPs failing
+	// too often may also be banned by fail2ban itself
+	var lockout *auth.Lockout
+	if cfg.Auth.Lockout.MaxAttempts > 0 {
+		baseDelay, maxDelay, resetAfter, err := cfg.GetLockoutDelays()
+		if err != nil {
+			log.Fatalf("Invalid lockout delays: %v", err)
+		}
+		var banClient func(ip string)
+		if jail := cfg.Auth.Lockout.BanJail; jail != "" {
+			var proxies []*net.IPNet
+			for _, proxy := range cfg.Server.TrustedProxies {
+				network, err := auth.ParseNetwork(proxy)
+				if err != nil {
+					log.Fatalf("Invalid trusted proxy %q: %v", proxy, err)
+				}
+				proxies = append(proxies, network)
+			}
+			banClient = func(ip string) {
+				// Banning a proxy would lock out every client behind it
+				for _, proxy := range proxies {
+					if proxy.Contains(net.ParseIP(ip)) {
+						log.Printf("Not banning trusted proxy %s after repeated failed logins", ip)
+						return
+					}
+				}
+				if err := f2bClient.BanIP(context.Background(), jail, ip); err != nil {
+					log.Printf("Failed to ban %s in %s after repeated failed logins: %v", ip, jail, err)
+					return
+				}
+				log.Printf("Banned %s in %s after repeated failed logins", ip, jail)
+				banMetadata.Put(bans.Metadata{
+					Jail:      jail,
+					IP:        ip,
+					Reason:    "Repeated failed logins to the API",
+					Principal: "fail2rest",
+					BannedAt:  time.Now(),
+				})
+			}
+		}
+		lockout = auth.NewLockout(auth.LockoutPolicy{
+			MaxAttempts: cfg.Auth.Lockout.MaxAttempts,
+			BaseDelay:   baseDelay,
+			MaxDelay:    maxDelay,
+			ResetAfter:  resetAfter,
+			BanAfter:    cfg.Auth.Lockout.BanAfter,
+		}, banClient)
+	}
+
+	// Operators may also log in through an OpenID Connect identity provider
+	var oidcProvider *auth.OIDCProvider
+	if oidc := cfg.Auth.OIDC; oidc.Enabled {
+		groupScopes := make([]auth.GroupScope, 0, len(oidc.GroupMappings))
+		for _, mapping := range oidc.GroupMappings {
+			groupScopes = append(groupScopes, auth.GroupScope{
+				Group: mapping.Group,
+				Scope: auth.Scope{Roles: mapping.Roles, Jails: mapping.Jails},
+			})
+		}
+		var defaultScope *auth.Scope
+		if len(oidc.DefaultRoles) > 0 {
+			defaultScope = &auth.Scope{Roles: oidc.DefaultRoles}
+		}
+		oidcProvider = auth.NewOIDCProvider(auth.OIDCConfig{
+			Issuer:        oidc.Issuer,
+			ClientID:      oidc.ClientID,
+			ClientSecret:  oidc.ClientSecret,
+			RedirectURL:   oidc.RedirectURL,
+			Scopes:        oidc.Scopes,
+			Audience:      oidc.Audience,
+			UsernameClaim: oidc.UsernameClaim,
+			GroupsClaim:   oidc.GroupsClaim,
+			GroupScopes:   groupScopes,
+			DefaultScope:  defaultScope,
+		})
+		log.Printf("OpenID Connect login enabled with %s", oidc.Issuer)
+	}
+
+	// Callers may authenticate with TLS client certificates
+	clientCerts := make([]auth.ClientCert, 0, len(cfg.Auth.ClientCerts))
+	for _, cert := range cfg.Auth.ClientCerts {
+		clientCerts = append(clientCerts, auth.ClientCert{
+			Name:        cert.Name,
+			Subject:     cert.Subject,
+			CommonName:  cert.CommonName,
+			DNSName:     cert.DNSName,
+			URI:         cert.URI,
+			Email:       cert.Email,
+			Fingerprint: cert.Fingerprint,
+			Scope:       auth.Scope{Roles: cert.Roles, Jails: cert.Jails},
+		})
+	}
+
+	// Tokens are signed with the first signing key, if any; the others
+	// still verify tokens while they are rotated out
+	signingKeys := make([]auth.SigningKey, 0, len(cfg.Auth.SigningKeys))
+	for i, key := range cfg.Auth.SigningKeys {
+		signingKey, err := auth.LoadSigningKey(key.ID, key.Algorithm, key.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load signing key %s: %v", key.ID, err)
+		}
+		if i == 0 && !signingKey.CanSign() {
+			log.Fatalf("Signing key %s signs new tokens and must be a private key", key.ID)
 		}
+		signingKeys = append(signingKeys, signingKey)
+	}
+	if len(signingKeys) > 0 {
+		log.Printf("Signing tokens with key %s (%s)", signingKeys[0].ID, signingKeys[0].Method.Alg())
 	}
 
 	authConfig := auth.AuthConfig{
-		APIKeys: cfg.Auth.APIKeys,
-		Users:   userMap,
+		APIKeys:     apiKeys,
+		Users:       userMap,
+		Revocations: revocations,
+		Refresh:     refreshTokens,
+		KeyUsage:    keyUsage,
+		Accounts:    accounts,
+		TOTP:        totpState,
+		Lockout:     lockout,
+		OIDC:        oidcProvider,
+		ClientCerts: clientCerts,
+		SigningKeys: signingKeys,
 	}
 
 	authService := auth.NewAuthService(cfg.Auth.JWTSecret, tokenExpiry, authConfig)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService)
+	adminHandler := handlers.NewAdminHandler(authService)
 	statusHandler := handlers.NewStatusHandler(f2bClient)
 	jailHandler := handlers.NewJailHandler(f2bClient)
-	ipHandler := handlers.NewIPHandler(f2bClient)
+	ipHandler := handlers.NewIPHandler(f2bClient, handlers.BanPolicy{
+		IPv6Prefix:    cfg.Bans.IPv6Prefix,
+		MinIPv4Prefix: cfg.Bans.MinIPv4Prefix,
+		MinIPv6Prefix: cfg.Bans.MinIPv6Prefix,
+		AllowBroad: func(c *gin.Context) bool {
+			return auth.ScopeFromContext(c).HasRole(auth.RoleAdmin)
+		},
+	}, scheduler, banMetadata)
 	statsHandler := handlers.NewStatsHandler(f2bClient)
 
 	// Setup router
@@ -77,6 +328,13 @@ func main() {
 
 	router := gin.Default()
 
+	// Client addresses come from the connection unless it is from a trusted
+	// proxy, so callers cannot choose the address API key networks, rate
+	// limits, lockouts and the audit log see
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
 	// Global middleware
 	router.Use(middleware.RequestID())
 	router.Use(middleware.SecurityHeaders())
@@ -88,7 +346,7 @@ func main() {
 	router.GET("/health", func(c *gin.Context) {
 		// Test fail2ban connectivity
 		status := "ok"
-		if _, err := f2bClient.GetStatus(); err != nil {
+		if _, err := f2bClient.GetStatus(c.Request.Context()); err != nil {
 			status = "degraded"
 		}
 
@@ -99,36 +357,97 @@ func main() {
 		})
 	})
 
+	// Public keys for other services to verify our tokens with
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
+
 	// API routes
 	api := router.Group("/api/v1")
+	if auditLog != nil {
+		api.Use(middleware.Audit(auditLog))
+	}
 	{
 		// Public routes with rate limiting
 		api.POST("/auth/login", middleware.RateLimiter("10-M"), authHandler.Login)
+		api.POST("/auth/refresh", middleware.RateLimiter("30-M"), authHandler.Refresh)
+		api.GET("/auth/oidc/login", middleware.RateLimiter("30-M"), authHandler.OIDCLogin)
+		api.GET("/auth/oidc/callback", middleware.RateLimiter("30-M"), authHandler.OIDCCallback)
 
-		// Protected routes
+		// Protected routes. Status and statistics require the stats role,
+		// other reads the viewer role; jail routes also require the jail to
+		// be in the caller's scope.
 		protected := api.Group("")
-		protected.Use(authService.Middleware())
+		protected.Use(authService.Middleware(), authService.RequireRole(auth.RoleStats))
 		{
+			// Identity of the caller
+			protected.GET("/auth/me", authHandler.Me)
+			protected.POST("/auth/logout", authHandler.Logout)
+
 			// Status
 			protected.GET("/status", statusHandler.GetStatus)
 
+			// Statistics
+			protected.GET("/stats", statsHandler.GetStats)
+			protected.GET("/jails/:name/stats", statsHandler.GetJailStats)
+		}
+
+		viewer := protected.Group("", authService.RequireRole(auth.RoleViewer))
+		{
 			// Jails
-			protected.GET("/jails", jailHandler.GetJails)
-			protected.GET("/jails/:name", jailHandler.GetJail)
-			protected.GET("/jails/:name/status", jailHandler.GetJailStatus)
-			protected.POST("/jails/:name/start", jailHandler.StartJail)
-			protected.POST("/jails/:name/stop", jailHandler.StopJail)
-			protected.POST("/jails/:name/restart", jailHandler.RestartJail)
-			protected.POST("/jails/:name/reload", jailHandler.ReloadJail)
+			viewer.GET("/jails", jailHandler.GetJails)
+			viewer.GET("/jails/:name", jailHandler.GetJail)
+			viewer.GET("/jails/:name/status", jailHandler.GetJailStatus)
+			viewer.GET("/jails/:name/settings", jailHandler.GetJailSettings)
 
 			// IP Management
-			protected.GET("/jails/:name/banned", ipHandler.GetBannedIPs)
-			protected.POST("/jails/:name/ban", ipHandler.BanIP)
-			protected.POST("/jails/:name/unban", ipHandler.UnbanIP)
+			viewer.GET("/jails/:name/banned", ipHandler.GetBannedIPs)
+			viewer.GET("/ips/:ip", ipHandler.LookupIP)
+			viewer.GET("/jails/:name/ignoreip", ipHandler.GetIgnoreIPs)
+		}
 
-			// Statistics
-			protected.GET("/stats", statsHandler.GetStats)
-			protected.GET("/jails/:name/stats", statsHandler.GetJailStats)
+		// Banning and unbanning
+		operator := protected.Group("", authService.RequireRole(auth.RoleOperator))
+		{
+			operator.POST("/jails/:name/ban", ipHandler.BanIP)
+			operator.POST("/jails/:name/unban", ipHandler.UnbanIP)
+			operator.POST("/jails/:name/ban/bulk", ipHandler.BulkBanIP)
+			operator.POST("/jails/:name/unban/bulk", ipHandler.BulkUnbanIP)
+			operator.POST("/ips/:ip/unban", ipHandler.UnbanEverywhere)
+			operator.POST("/jails/:name/ignoreip", ipHandler.AddIgnoreIP)
+			operator.DELETE("/jails/:name/ignoreip", ipHandler.DeleteIgnoreIP)
+		}
+
+		// Jail control, emergency recovery (e.g. after a bad filter has
+		// locked out legitimate users), token revocation and the audit log
+		admin := protected.Group("", authService.RequireRole(auth.RoleAdmin))
+		{
+			admin.POST("/auth/revoke", authHandler.RevokeTokens)
+			admin.GET("/admin/api-keys", adminHandler.ListAPIKeys)
+			admin.POST("/admin/api-keys", adminHandler.CreateAPIKey)
+			admin.GET("/admin/api-keys/:id", adminHandler.GetAPIKey)
+			admin.PATCH("/admin/api-keys/:id", adminHandler.UpdateAPIKey)
+			admin.DELETE("/admin/api-keys/:id", adminHandler.DeleteAPIKey)
+			admin.GET("/admin/lockouts", adminHandler.ListLockouts)
+			admin.DELETE("/admin/lockouts/:principal", adminHandler.Unlock)
+			admin.GET("/admin/users", adminHandler.ListUsers)
+			admin.POST("/admin/users", adminHandler.CreateUser)
+			admin.GET("/admin/users/:username", adminHandler.GetUser)
+			admin.PATCH("/admin/users/:username", adminHandler.UpdateUser)
+			admin.DELETE("/admin/users/:username", adminHandler.DeleteUser)
+			admin.POST("/admin/users/:username/totp", adminHandler.EnrollTOTP)
+			admin.DELETE("/admin/users/:username/totp", adminHandler.DisableTOTP)
+			admin.POST("/jails/:name/start", jailHandler.StartJail)
+			admin.POST("/jails/:name/stop", jailHandler.StopJail)
+			admin.POST("/jails/:name/restart", jailHandler.RestartJail)
+			admin.POST("/jails/:name/reload", jailHandler.ReloadJail)
+			admin.PATCH("/jails/:name/settings", jailHandler.UpdateJailSettings)
+			admin.POST("/jails/:name/unban-all", ipHandler.UnbanAllInJail)
+			admin.POST("/unban-all", ipHandler.UnbanAll)
+
+			if auditLog != nil {
+				auditHandler := handlers.NewAuditHandler(auditLog)
+				admin.GET("/audit", auditHandler.GetAuditLog)
+				admin.GET("/audit/verify", auditHandler.VerifyAuditLog)
+			}
 		}
 	}
 
@@ -143,6 +462,24 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Client certificates are verified against the client CAs; which
+	// certificates are accepted as credentials is up to the auth middleware
+	if cfg.Server.TLS.Enabled && cfg.Server.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.Server.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatalf("Failed to read client CA file: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in client CA file %s", cfg.Server.TLS.ClientCAFile)
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: cfg.GetClientAuth(),
+		}
+		log.Printf("Client certificates: %s", cfg.Server.TLS.ClientAuth)
+	}
+
 	// Start server in a goroutine
 	go func() {
 		if cfg.Server.TLS.Enabled {
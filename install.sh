@@ -268,6 +268,7 @@ PrivateTmp=true
 ProtectSystem=strict
 ProtectHome=true
 ReadWritePaths=/var/log
+StateDirectory=fail2rest
 
 [Install]
 WantedBy=multi-user.target
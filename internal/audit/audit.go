@@ -0,0 +1,251 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one audited API call. Records are chained: each carries the hash
+// of the one before it, so editing or removing a record breaks the chain.
+type Record struct {
+	Seq       int64           `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Principal string          `json:"principal,omitempty"`
+	SourceIP  string          `json:"source_ip"`
+	RequestID string          `json:"request_id,omitempty"`
+	Action    string          `json:"action"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Jail      string          `json:"jail,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	Request   json.RawMessage `json:"request,omitempty"` // summary of the request body, secrets redacted
+	Status    int             `json:"status"`
+	Outcome   string          `json:"outcome"` // "success" or "failure"
+	Error     string          `json:"error,omitempty"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+// computeHash returns the hash of a record, covering every field but Hash
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Filter selects records in a query. Zero fields match everything.
+type Filter struct {
+	From      time.Time
+	To        time.Time
+	Principal string
+	Action    string
+	Jail      string
+	IP        string
+	Limit     int
+}
+
+func (f *Filter) matches(r *Record) bool {
+	switch {
+	case !f.From.IsZero() && r.Time.Before(f.From):
+		return false
+	case !f.To.IsZero() && r.Time.After(f.To):
+		return false
+	case f.Principal != "" && r.Principal != f.Principal:
+		return false
+	case f.Action != "" && r.Action != f.Action:
+		return false
+	case f.Jail != "" && r.Jail != f.Jail:
+		return false
+	case f.IP != "" && r.IP != f.IP:
+		return false
+	}
+	return true
+}
+
+// VerifyResult reports the integrity of the log. Records removed from the
+// end of the log leave a valid chain, so LastHash should be compared with a
+// copy kept elsewhere.
+type VerifyResult struct {
+	Valid    bool   `json:"valid"`
+	Records  int64  `json:"records"`
+	LastHash string `json:"last_hash,omitempty"`
+	BrokenAt int64  `json:"broken_at,omitempty"` // line number of the first bad record
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Log is an append-only audit log stored as hash-chained JSON lines
+type Log struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+// Open opens the audit log at path, creating it if needed, and continues the
+// chain from its last record
+func Open(path string) (*Log, error) {
+	l := &Log{path: path}
+
+	err := l.scan(func(line int64, r *Record, err error) bool {
+		if err == nil {
+			l.seq = r.Seq
+			l.lastHash = r.Hash
+		}
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return l, nil
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Append adds a record to the log, filling in its sequence number and hashes
+func (l *Log) Append(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Seq = l.seq + 1
+	r.Time = r.Time.UTC()
+	r.PrevHash = l.lastHash
+	hash, err := r.computeHash()
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	r.Hash = hash
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+
+	l.seq = r.Seq
+	l.lastHash = r.Hash
+	return nil
+}
+
+// Query returns the records matching filter, newest first
+func (l *Log) Query(filter Filter) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := []Record{}
+	err := l.scan(func(line int64, r *Record, err error) bool {
+		if err == nil && filter.matches(r) {
+			records = append(records, *r)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+// Verify checks that every record is intact and chained to the one before
+func (l *Log) Verify() (*VerifyResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := &VerifyResult{Valid: true}
+	prevHash := ""
+	var prevSeq int64
+	err := l.scan(func(line int64, r *Record, err error) bool {
+		reason := ""
+		switch {
+		case err != nil:
+			reason = "unreadable record: " + err.Error()
+		case r.Seq != prevSeq+1:
+			reason = fmt.Sprintf("expected record %d, found %d", prevSeq+1, r.Seq)
+		case r.PrevHash != prevHash:
+			reason = "record is not chained to the one before it"
+		default:
+			if hash, err := r.computeHash(); err != nil || hash != r.Hash {
+				reason = "record content does not match its hash"
+			}
+		}
+		if reason != "" {
+			result.Valid = false
+			result.BrokenAt = line
+			result.Reason = reason
+			return false
+		}
+
+		result.Records++
+		result.LastHash = r.Hash
+		prevSeq = r.Seq
+		prevHash = r.Hash
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return result, nil
+}
+
+// scan calls fn for each line of the log until it returns false
+func (l *Log) scan(fn func(line int64, r *Record, err error) bool) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && l.file != nil {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var line int64
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var r Record
+		err := json.Unmarshal(data, &r)
+		if !fn(line, &r, err) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
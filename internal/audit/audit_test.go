@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// writeTestLog appends five records, a minute apart, to a new log
+func writeTestLog(t *testing.T) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	records := []Record{
+		{Principal: "user:alice", Action: "auth.login", Status: 200},
+		{Principal: "user:alice", Action: "ip.ban", Jail: "sshd", IP: "192.0.2.1", Status: 200},
+		{Principal: "api-key:ci", Action: "ip.ban", Jail: "nginx", IP: "192.0.2.2", Status: 200},
+		{Principal: "api-key:ci", Action: "ip.unban", Jail: "sshd", IP: "192.0.2.1", Status: 200},
+		{Principal: "user:bob", Action: "jail.stop", Jail: "sshd", Status: 403, Outcome: "failure"},
+	}
+	for i, r := range records {
+		r.Time = testStart.Add(time.Duration(i) * time.Minute)
+		if err := l.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l, path
+}
+
+// editLines rewrites the log file through fn
+func editLines(t *testing.T, path string, fn func(lines []string) []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if err := os.WriteFile(path, []byte(strings.Join(fn(lines), "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	l, path := writeTestLog(t)
+	records, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newest first: each record carries the hash of the one before it
+	for i := 0; i < len(records)-1; i++ {
+		if records[i].PrevHash != records[i+1].Hash || records[i].Seq != records[i+1].Seq+1 {
+			t.Errorf("record %d is not chained to record %d", records[i].Seq, records[i+1].Seq)
+		}
+	}
+	if first := records[len(records)-1]; first.Seq != 1 || first.PrevHash != "" {
+		t.Errorf("first record = %+v", first)
+	}
+
+	result, err := l.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Records != 5 || result.LastHash != records[0].Hash {
+		t.Errorf("Verify() = %+v", result)
+	}
+
+	// Reopening continues the chain
+	l.Close()
+	if l, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Append(Record{Action: "auth.logout", Time: testStart.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := l.Verify(); !result.Valid || result.Records != 6 {
+		t.Errorf("Verify() after reopening = %+v", result)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		edit   func(lines []string) []string
+		line   int64
+		reason string
+	}{
+		{"edited record", func(lines []string) []string {
+			lines[2] = strings.Replace(lines[2], "api-key:ci", "api-key:xx", 1)
+			return lines
+		}, 3, "does not match its hash"},
+		{"deleted record", func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}, 3, "expected record 3, found 4"},
+		{"reordered records", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 2, "expected record 2, found 3"},
+		{"renumbered after deletion", func(lines []string) []string {
+			lines[3] = strings.Replace(lines[3], `"seq":4`, `"seq":3`, 1)
+			return append(lines[:2], lines[3:]...)
+		}, 3, "not chained"},
+		{"unreadable record", func(lines []string) []string {
+			lines[4] = lines[4][:20]
+			return lines
+		}, 5, "unreadable record"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, path := writeTestLog(t)
+			editLines(t, path, tt.edit)
+			result, err := l.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid || result.BrokenAt != tt.line || !strings.Contains(result.Reason, tt.reason) {
+				t.Errorf("Verify() = %+v, want broken at line %d (%s)", result, tt.line, tt.reason)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	l, _ := writeTestLog(t)
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []int64 // sequence numbers, newest first
+	}{
+		{"everything", Filter{}, []int64{5, 4, 3, 2, 1}},
+		{"principal", Filter{Principal: "api-key:ci"}, []int64{4, 3}},
+		{"action", Filter{Action: "ip.ban"}, []int64{3, 2}},
+		{"jail", Filter{Jail: "sshd"}, []int64{5, 4, 2}},
+		{"ip", Filter{IP: "192.0.2.1"}, []int64{4, 2}},
+		{"from", Filter{From: testStart.Add(3 * time.Minute)}, []int64{5, 4}},
+		{"to", Filter{To: testStart.Add(time.Minute)}, []int64{2, 1}},
+		{"time range", Filter{From: testStart.Add(time.Minute), To: testStart.Add(3 * time.Minute)}, []int64{4, 3, 2}},
+		{"limit keeps the newest", Filter{Limit: 2}, []int64{5, 4}},
+		{"combined", Filter{Principal: "user:alice", Action: "ip.ban", Jail: "sshd"}, []int64{2}},
+		{"no match", Filter{Principal: "user:mallory"}, []int64{}},
+	}
+	for _, tt := range tests {
+		records, err := l.Query(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []int64{}
+		for _, r := range records {
+			got = append(got, r.Seq)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Query() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,712 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned when managing users and API keys
+var (
+	ErrAccountInvalid  = errors.New("invalid account")
+	ErrAccountExists   = errors.New("already exists")
+	ErrAccountNotFound = errors.New("not found")
+	ErrAccountStatic   = errors.New("is defined in the config file and cannot be changed through the API")
+)
+
+// accountNamePattern restricts the names of users and API keys created
+// through the API, which appear in principals and logs
+var accountNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// reservedKeyNamePattern matches API key names that would read like the ID
+// of a generated key or the fingerprint of a plain text key in principals
+var reservedKeyNamePattern = regexp.MustCompile(`^[0-9A-Fa-f]{12}$`)
+
+// accountSet is an immutable snapshot of the users and API keys accepted,
+// from the config file and the account store together
+type accountSet struct {
+	apiKeys  []*APIKey
+	keysByID map[string]*APIKey
+	users    map[string]User
+}
+
+func newAccountSet(apiKeys []APIKey, users map[string]User) *accountSet {
+	set := &accountSet{
+		keysByID: make(map[string]*APIKey),
+		users:    make(map[string]User),
+	}
+	for i := range apiKeys {
+		key := apiKeys[i]
+		if key.Key == "" && key.ID == "" {
+			continue
+		}
+		key.prepare()
+		set.apiKeys = append(set.apiKeys, &key)
+		if key.ID != "" {
+			set.keysByID[key.ID] = &key
+		}
+	}
+	for username, user := range users {
+		user.Username = username
+		set.users[username] = user
+	}
+	return set
+}
+
+// accounts returns the current users and API keys
+func (a *AuthService) accounts() *accountSet {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.current
+}
+
+// reload rebuilds the accepted users and API keys from the config file and
+// the account store. The caller must hold a.mu for writing.
+func (a *AuthService) reload() {
+	apiKeys := append([]APIKey(nil), a.static.APIKeys...)
+	users := make(map[string]User, len(a.static.Users))
+	for username, user := range a.static.Users {
+		users[username] = user
+	}
+
+	// Entries in the config file take precedence over stored ones of the
+	// same name
+	if a.store != nil {
+		staticIDs := make(map[string]bool)
+		for _, key := range apiKeys {
+			staticIDs[key.ID] = true
+		}
+		for _, stored := range a.store.apiKeyList() {
+			if !staticIDs[stored.ID] {
+				apiKeys = append(apiKeys, stored.apiKey())
+			}
+		}
+		for _, stored := range a.store.userList() {
+			if _, exists := users[stored.Username]; !exists {
+				users[stored.Username] = stored.user()
+			}
+		}
+	}
+
+	a.current = newAccountSet(apiKeys, users)
+}
+
+// Users returns every user, sorted by username
+func (a *AuthService) Users() []User {
+	set := a.accounts()
+	users := make([]User, 0, len(set.users))
+	for _, user := range set.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// GetUser returns the user with the given name
+func (a *AuthService) GetUser(username string) (User, bool) {
+	user, exists := a.accounts().users[username]
+	return user, exists
+}
+
+// UserUpdate changes a user; nil fields are left as they are
+type UserUpdate struct {
+	Password *string
+	Roles    *[]string
+	Jails    *[]string
+}
+
+// CreateUser adds a user to the account store
+func (a *AuthService) CreateUser(username, password string, scope Scope, by string) (User, error) {
+	if !accountNamePattern.MatchString(username) {
+		return User{}, fmt.Errorf("%w: invalid username %q", ErrAccountInvalid, username)
+	}
+	if err := validateScope(scope); err != nil {
+		return User{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store == nil {
+		return User{}, errors.New("account management is not enabled")
+	}
+	if _, exists := a.current.users[username]; exists {
+		return User{}, fmt.Errorf("user %s %w", username, ErrAccountExists)
+	}
+
+	stored := storedUser{
+		Username:     username,
+		PasswordHash: string(hash),
+		Roles:        scope.Roles,
+		Jails:        scope.Jails,
+		CreatedAt:    time.Now().UTC(),
+		CreatedBy:    by,
+	}
+	if err := a.store.putUser(stored); err != nil {
+		return User{}, err
+	}
+	a.reload()
+	return a.current.users[username], nil
+}
+
+// UpdateUser changes a user of the account store. Tokens already issued to
+// the user are revoked, so a changed password or narrower scope applies at
+// once.
+func (a *AuthService) UpdateUser(username string, update UserUpdate, by string) (User, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stored, err := a.managedUser(username)
+	if err != nil {
+		return User{}, err
+	}
+
+	if update.Roles != nil {
+		stored.Roles = *update.Roles
+	}
+	if update.Jails != nil {
+		stored.Jails = *update.Jails
+	}
+	if err := validateScope(Scope{Roles: stored.Roles, Jails: stored.Jails}); err != nil {
+		return User{}, err
+	}
+	if update.Password != nil {
+		hash, err := bcrypt.GenerateFromPassword([]byte(*update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, err
+		}
+		stored.PasswordHash = string(hash)
+	}
+	now := time.Now().UTC()
+	stored.UpdatedAt = &now
+	stored.UpdatedBy = by
+
+	if err := a.store.putUser(stored); err != nil {
+		return User{}, err
+	}
+	a.reload()
+	return a.current.users[username], a.revokeAccount("user:" + username)
+}
+
+// DeleteUser removes a user from the account store and revokes its tokens
+func (a *AuthService) DeleteUser(username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.managedUser(username); err != nil {
+		return err
+	}
+	if err := a.store.deleteUser(username); err != nil {
+		return err
+	}
+	a.reload()
+	return a.revokeAccount("user:" + username)
+}
+
+// managedUser returns a user of the account store. The caller must hold
+// a.mu.
+func (a *AuthService) managedUser(username string) (storedUser, error) {
+	user, exists := a.current.users[username]
+	if !exists {
+		return storedUser{}, fmt.Errorf("user %s %w", username, ErrAccountNotFound)
+	}
+	if !user.Managed || a.store == nil {
+		return storedUser{}, fmt.Errorf("user %s %w", username, ErrAccountStatic)
+	}
+	return a.store.user(username), nil
+}
+
+// TOTPEnrollment is what a user needs to set up TOTP, shown only once
+type TOTPEnrollment struct {
+	Secret        string
+	URI           string // otpauth:// provisioning URI
+	RecoveryCodes []string
+}
+
+// EnrollTOTP gives a user of the account store a new TOTP secret and
+// recovery codes, replacing any previous ones. From then on the user must
+// give a code to log in.
+func (a *AuthService) EnrollTOTP(username, by string) (*TOTPEnrollment, error) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.setTOTP(username, secret, hashes, by); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret:        secret,
+		URI:           TOTPProvisioningURI(secret, username, TOTPIssuer),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// DisableTOTP removes TOTP from a user of the account store
+func (a *AuthService) DisableTOTP(username, by string) error {
+	return a.setTOTP(username, "", nil, by)
+}
+
+func (a *AuthService) setTOTP(username, secret string, recoveryCodes []string, by string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stored, err := a.managedUser(username)
+	if err != nil {
+		return err
+	}
+	stored.TOTPSecret = secret
+	stored.RecoveryCodes = recoveryCodes
+	now := time.Now().UTC()
+	stored.UpdatedAt = &now
+	stored.UpdatedBy = by
+
+	if err := a.store.putUser(stored); err != nil {
+		return err
+	}
+	a.reload()
+	return nil
+}
+
+// APIKeySpec describes an API key to create
+type APIKeySpec struct {
+	Name         string
+	Label        string
+	Scope        Scope
+	ExpiresAt    *time.Time
+	AllowedCIDRs []string
+}
+
+// APIKeyUpdate changes an API key; nil fields are left as they are
+type APIKeyUpdate struct {
+	Label        *string
+	Roles        *[]string
+	Jails        *[]string
+	AllowedCIDRs *[]string
+	ExpiresAt    *time.Time
+	NeverExpires bool // clears the expiry
+}
+
+// CreateAPIKey generates an API key and adds it to the account store. The
+// key is returned only here; the store keeps its hash.
+func (a *AuthService) CreateAPIKey(spec APIKeySpec, by string) (string, *APIKey, error) {
+	if spec.Name != "" && !accountNamePattern.MatchString(spec.Name) {
+		return "", nil, fmt.Errorf("%w: invalid API key name %q", ErrAccountInvalid, spec.Name)
+	}
+	if reservedKeyNamePattern.MatchString(spec.Name) {
+		return "", nil, fmt.Errorf("%w: API key name %q looks like a key ID", ErrAccountInvalid, spec.Name)
+	}
+	if err := validateScope(spec.Scope); err != nil {
+		return "", nil, err
+	}
+	if err := validateNetworks(spec.AllowedCIDRs); err != nil {
+		return "", nil, err
+	}
+	key, id, hash, err := GenerateAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store == nil {
+		return "", nil, errors.New("account management is not enabled")
+	}
+	if _, isID := a.current.keysByID[spec.Name]; isID {
+		return "", nil, fmt.Errorf("%w: API key name %q is the ID of another key", ErrAccountInvalid, spec.Name)
+	}
+	if spec.Name != "" && a.current.keyByPrincipal("api-key:"+spec.Name) != nil {
+		return "", nil, fmt.Errorf("API key %s %w", spec.Name, ErrAccountExists)
+	}
+
+	stored := storedAPIKey{
+		ID:           id,
+		Hash:         hash,
+		Name:         spec.Name,
+		Label:        spec.Label,
+		Roles:        spec.Scope.Roles,
+		Jails:        spec.Scope.Jails,
+		ExpiresAt:    spec.ExpiresAt,
+		AllowedCIDRs: spec.AllowedCIDRs,
+		CreatedAt:    time.Now().UTC(),
+		CreatedBy:    by,
+	}
+	if err := a.store.putAPIKey(stored); err != nil {
+		return "", nil, err
+	}
+	a.reload()
+	return key, a.current.keysByID[id], nil
+}
+
+// GetAPIKey returns the generated API key with the given ID
+func (a *AuthService) GetAPIKey(id string) (*APIKey, bool) {
+	key, exists := a.accounts().keysByID[id]
+	return key, exists
+}
+
+// UpdateAPIKey changes an API key of the account store. Tokens already
+// obtained with the key are revoked, so a narrower scope applies at once.
+func (a *AuthService) UpdateAPIKey(id string, update APIKeyUpdate, by string) (*APIKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stored, err := a.managedAPIKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Label != nil {
+		stored.Label = *update.Label
+	}
+	if update.Roles != nil {
+		stored.Roles = *update.Roles
+	}
+	if update.Jails != nil {
+		stored.Jails = *update.Jails
+	}
+	if update.AllowedCIDRs != nil {
+		stored.AllowedCIDRs = *update.AllowedCIDRs
+	}
+	if update.ExpiresAt != nil {
+		stored.ExpiresAt = update.ExpiresAt
+	}
+	if update.NeverExpires {
+		stored.ExpiresAt = nil
+	}
+	if err := validateScope(Scope{Roles: stored.Roles, Jails: stored.Jails}); err != nil {
+		return nil, err
+	}
+	if err := validateNetworks(stored.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	stored.UpdatedAt = &now
+	stored.UpdatedBy = by
+
+	if err := a.store.putAPIKey(stored); err != nil {
+		return nil, err
+	}
+	a.reload()
+	key := a.current.keysByID[id]
+	return key, a.revokeAccount(key.Principal())
+}
+
+// DeleteAPIKey removes an API key from the account store and revokes the
+// tokens obtained with it
+func (a *AuthService) DeleteAPIKey(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.managedAPIKey(id); err != nil {
+		return err
+	}
+	principal := a.current.keysByID[id].Principal()
+	if err := a.store.deleteAPIKey(id); err != nil {
+		return err
+	}
+	a.reload()
+	return a.revokeAccount(principal)
+}
+
+// managedAPIKey returns an API key of the account store. The caller must
+// hold a.mu.
+func (a *AuthService) managedAPIKey(id string) (storedAPIKey, error) {
+	key, exists := a.current.keysByID[id]
+	if !exists {
+		return storedAPIKey{}, fmt.Errorf("API key %s %w", id, ErrAccountNotFound)
+	}
+	if !key.Managed || a.store == nil {
+		return storedAPIKey{}, fmt.Errorf("API key %s %w", id, ErrAccountStatic)
+	}
+	return a.store.apiKey(id), nil
+}
+
+// revokeAccount revokes the tokens of a changed or deleted account, if
+// revocation is enabled
+func (a *AuthService) revokeAccount(principal string) error {
+	if a.revocations == nil {
+		return nil
+	}
+	return a.RevokePrincipal(principal)
+}
+
+func (set *accountSet) keyByRef(ref string) *APIKey {
+	for _, key := range set.apiKeys {
+		if key.Ref() == ref {
+			return key
+		}
+	}
+	return nil
+}
+
+func (set *accountSet) keyByPrincipal(principal string) *APIKey {
+	for _, key := range set.apiKeys {
+		if key.Principal() == principal {
+			return key
+		}
+	}
+	return nil
+}
+
+// validateScope checks the roles and jail patterns of a scope
+func validateScope(scope Scope) error {
+	if len(scope.Roles) == 0 {
+		return fmt.Errorf("%w: at least one role is required", ErrAccountInvalid)
+	}
+	for _, role := range scope.Roles {
+		if !ValidRole(role) {
+			return fmt.Errorf("%w: invalid role %q (must be stats, viewer, operator or admin)", ErrAccountInvalid, role)
+		}
+	}
+	for _, pattern := range scope.Jails {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("%w: invalid jail pattern %q", ErrAccountInvalid, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNetworks(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, err := ParseNetwork(cidr); err != nil {
+			return fmt.Errorf("%w: invalid network %q", ErrAccountInvalid, cidr)
+		}
+	}
+	return nil
+}
+
+// AccountStore keeps the users and API keys managed through the API,
+// persisted to a file
+type AccountStore struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]storedUser
+	apiKeys map[string]storedAPIKey // by ID
+}
+
+type storedUser struct {
+	Username      string     `json:"username"`
+	PasswordHash  string     `json:"password_hash"`
+	Roles         []string   `json:"roles"`
+	Jails         []string   `json:"jails,omitempty"`
+	TOTPSecret    string     `json:"totp_secret,omitempty"`
+	RecoveryCodes []string   `json:"recovery_codes,omitempty"` // bcrypt hashes
+	CreatedAt     time.Time  `json:"created_at"`
+	CreatedBy     string     `json:"created_by,omitempty"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy     string     `json:"updated_by,omitempty"`
+}
+
+func (u storedUser) user() User {
+	return User{
+		Username:      u.Username,
+		PasswordHash:  u.PasswordHash,
+		Scope:         Scope{Roles: u.Roles, Jails: u.Jails},
+		TOTPSecret:    u.TOTPSecret,
+		RecoveryCodes: u.RecoveryCodes,
+		Managed:       true,
+		CreatedAt:     &u.CreatedAt,
+		CreatedBy:     u.CreatedBy,
+		UpdatedAt:     u.UpdatedAt,
+	}
+}
+
+type storedAPIKey struct {
+	ID           string     `json:"id"`
+	Hash         string     `json:"hash"`
+	Name         string     `json:"name,omitempty"`
+	Label        string     `json:"label,omitempty"`
+	Roles        []string   `json:"roles"`
+	Jails        []string   `json:"jails,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	AllowedCIDRs []string   `json:"allowed_cidrs,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy    string     `json:"updated_by,omitempty"`
+}
+
+func (k storedAPIKey) apiKey() APIKey {
+	return APIKey{
+		ID:           k.ID,
+		Hash:         k.Hash,
+		Name:         k.Name,
+		Label:        k.Label,
+		Scope:        Scope{Roles: k.Roles, Jails: k.Jails},
+		ExpiresAt:    k.ExpiresAt,
+		AllowedCIDRs: k.AllowedCIDRs,
+		Managed:      true,
+		CreatedAt:    &k.CreatedAt,
+		CreatedBy:    k.CreatedBy,
+		UpdatedAt:    k.UpdatedAt,
+	}
+}
+
+type accountFile struct {
+	Users   []storedUser   `json:"users"`
+	APIKeys []storedAPIKey `json:"api_keys"`
+}
+
+// NewAccountStore creates a store persisting to path, loading any accounts
+// saved there
+func NewAccountStore(path string) (*AccountStore, error) {
+	s := &AccountStore{
+		path:    path,
+		users:   make(map[string]storedUser),
+		apiKeys: make(map[string]storedAPIKey),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read accounts: %w", err)
+	}
+
+	var saved accountFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse accounts %s: %w", path, err)
+	}
+	for _, u := range saved.Users {
+		s.users[u.Username] = u
+	}
+	for _, k := range saved.APIKeys {
+		s.apiKeys[k.ID] = k
+	}
+	return s, nil
+}
+
+func (s *AccountStore) userList() []storedUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]storedUser, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+func (s *AccountStore) apiKeyList() []storedAPIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]storedAPIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+func (s *AccountStore) user(username string) storedUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[username]
+}
+
+func (s *AccountStore) apiKey(id string) storedAPIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apiKeys[id]
+}
+
+func (s *AccountStore) putUser(u storedUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.users[u.Username]
+	s.users[u.Username] = u
+	if err := s.save(); err != nil {
+		if existed {
+			s.users[u.Username] = previous
+		} else {
+			delete(s.users, u.Username)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *AccountStore) deleteUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.users[username]
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *AccountStore) putAPIKey(k storedAPIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.apiKeys[k.ID]
+	s.apiKeys[k.ID] = k
+	if err := s.save(); err != nil {
+		if existed {
+			s.apiKeys[k.ID] = previous
+		} else {
+			delete(s.apiKeys, k.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *AccountStore) deleteAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.apiKeys[id]
+	delete(s.apiKeys, id)
+	if err := s.save(); err != nil {
+		s.apiKeys[id] = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the accounts to disk. The caller must hold s.mu.
+func (s *AccountStore) save() error {
+	saved := accountFile{
+		Users:   make([]storedUser, 0, len(s.users)),
+		APIKeys: make([]storedAPIKey, 0, len(s.apiKeys)),
+	}
+	for _, u := range s.users {
+		saved.Users = append(saved.Users, u)
+	}
+	for _, k := range s.apiKeys {
+		saved.APIKeys = append(saved.APIKeys, k)
+	}
+	sort.Slice(saved.Users, func(i, j int) bool { return saved.Users[i].Username < saved.Users[j].Username })
+	sort.Slice(saved.APIKeys, func(i, j int) bool { return saved.APIKeys[i].ID < saved.APIKeys[j].ID })
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateAPIKeyNames(t *testing.T) {
+	store, err := NewAccountStore(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthService("secret", time.Minute, AuthConfig{
+		APIKeys:  []APIKey{{ID: "deploy", Hash: "sha256:00:00", Name: "ci"}},
+		Accounts: store,
+	})
+
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"automation", nil},
+		{"automation", ErrAccountExists},
+		{"ci", ErrAccountExists},
+		{"0c4c0be74bb5", ErrAccountInvalid}, // reads like a generated key ID
+		{"ABCDEF012345", ErrAccountInvalid},
+		{"deploy", ErrAccountInvalid}, // ID of a key from the config file
+		{"0c4c0be74bb5x", nil},
+		{"-bad", ErrAccountInvalid},
+	}
+	for _, tt := range tests {
+		_, key, err := a.CreateAPIKey(APIKeySpec{Name: tt.name, Scope: Scope{Roles: []string{RoleViewer}}}, "user:admin")
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("CreateAPIKey(%q): %v", tt.name, err)
+			} else if got := key.Principal(); got != "api-key:"+tt.name {
+				t.Errorf("CreateAPIKey(%q) principal = %s", tt.name, got)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("CreateAPIKey(%q) error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
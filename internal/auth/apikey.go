@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Errors returned when an API key is refused
+var (
+	ErrAPIKeyInvalid   = errors.New("invalid API key")
+	ErrAPIKeyExpired   = errors.New("API key has expired")
+	ErrAPIKeyIPDenied  = errors.New("API key is not allowed from this address")
+	ErrAPIKeyMalformed = errors.New("malformed API key hash")
+)
+
+// Generated keys look like "f2r_<id>_<secret>". The ID is public and names
+// the key; only a salted hash of the secret is stored.
+const (
+	apiKeyPrefix    = "f2r"
+	apiKeyIDBytes   = 6
+	apiKeySecretLen = 32
+	apiKeySaltBytes = 16
+)
+
+// APIKey is an accepted API key and the permissions it grants. Keys are
+// either hashed (ID and Hash set) or, for older configurations, stored in
+// plain text (Key set).
+type APIKey struct {
+	ID           string
+	Hash         string // "sha256:<salt>:<digest>" of the secret
+	Key          string // plain text key
+	Name         string // identifies the key in tokens and logs
+	Label        string // human description
+	Scope        Scope
+	ExpiresAt    *time.Time
+	AllowedCIDRs []string // source networks the key may be used from; empty allows all
+	Managed      bool     // managed through the API rather than the config file
+	CreatedAt    *time.Time
+	CreatedBy    string
+	UpdatedAt    *time.Time
+
+	plainHash   [sha256.Size]byte
+	allowedNets []*net.IPNet
+}
+
+// Principal names the key without revealing it
+func (k *APIKey) Principal() string {
+	switch {
+	case k.Name != "":
+		return "api-key:" + k.Name
+	case k.ID != "":
+		return "api-key:" + k.ID
+	}
+	return APIKeyPrincipal(k.Key)
+}
+
+// Ref identifies the key itself rather than its name: the ID of a generated
+// key, or the fingerprint of a plain text key
+func (k *APIKey) Ref() string {
+	if k.ID != "" {
+		return k.ID
+	}
+	return keyFingerprint(k.Key)
+}
+
+// Hashed reports whether only a hash of the key is stored
+func (k *APIKey) Hashed() bool {
+	return k.ID != ""
+}
+
+// Expired reports whether the key has expired at now
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// AllowsIP reports whether the key may be used from ip
+func (k *APIKey) AllowsIP(ip net.IP) bool {
+	if len(k.allowedNets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range k.allowedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare precomputes what checking the key needs
+func (k *APIKey) prepare() {
+	if k.Key != "" {
+		k.plainHash = sha256.Sum256([]byte(k.Key))
+	}
+	k.allowedNets = nil
+	for _, cidr := range k.AllowedCIDRs {
+		if network, err := ParseNetwork(cidr); err == nil {
+			k.allowedNets = append(k.allowedNets, network)
+		}
+	}
+}
+
+// check refuses the key if it has expired or is used from a source it is not
+// allowed from
+func (k *APIKey) check(clientIP string) error {
+	if k.Expired(time.Now()) {
+		return ErrAPIKeyExpired
+	}
+	if !k.AllowsIP(net.ParseIP(clientIP)) {
+		return ErrAPIKeyIPDenied
+	}
+	return nil
+}
+
+// ParseNetwork parses a CIDR network or a single address
+func ParseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, errors.New("invalid address " + value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// GenerateAPIKey creates a new key, returning the key to hand out, its ID
+// and the hash to store
+func GenerateAPIKey() (key, id, hash string, err error) {
+	idBytes := make([]byte, apiKeyIDBytes)
+	secretBytes := make([]byte, apiKeySecretLen)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", "", err
+	}
+
+	id = hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	hash, err = HashAPIKeySecret(secret)
+	if err != nil {
+		return "", "", "", err
+	}
+	return apiKeyPrefix + "_" + id + "_" + secret, id, hash, nil
+}
+
+// HashAPIKeySecret returns a salted hash of the secret part of a key. The
+// secret is random, so a fast hash is enough and keeps per-request checks
+// cheap.
+func HashAPIKeySecret(secret string) (string, error) {
+	salt := make([]byte, apiKeySaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(salt) + ":" + hex.EncodeToString(saltedDigest(salt, secret)), nil
+}
+
+// ValidateAPIKeyHash checks the format of a stored hash
+func ValidateAPIKeyHash(hash string) error {
+	_, _, err := parseAPIKeyHash(hash)
+	return err
+}
+
+func parseAPIKeyHash(hash string) (salt, digest []byte, err error) {
+	parts := strings.Split(hash, ":")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return nil, nil, ErrAPIKeyMalformed
+	}
+	salt, err = hex.DecodeString(parts[1])
+	if err != nil || len(salt) == 0 {
+		return nil, nil, ErrAPIKeyMalformed
+	}
+	digest, err = hex.DecodeString(parts[2])
+	if err != nil || len(digest) != sha256.Size {
+		return nil, nil, ErrAPIKeyMalformed
+	}
+	return salt, digest, nil
+}
+
+func saltedDigest(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// splitAPIKey splits a generated key into its ID and secret
+func splitAPIKey(key string) (id, secret string, ok bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// matchesSecret reports whether secret hashes to the stored hash, in
+// constant time
+func (k *APIKey) matchesSecret(secret string) bool {
+	salt, digest, err := parseAPIKeyHash(k.Hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(saltedDigest(salt, secret), digest) == 1
+}
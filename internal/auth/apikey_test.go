@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Tokens obtained with an API key are checked against that key, not against
+// another key sharing its name
+func TestKeyTokenBoundToKey(t *testing.T) {
+	keys := []APIKey{
+		{Key: "admin-key", Name: "ci", Scope: Scope{Roles: []string{RoleAdmin}}, AllowedCIDRs: []string{"10.0.0.0/8"}},
+		{Key: "viewer-key", Name: "ci", Scope: Scope{Roles: []string{RoleViewer}}},
+	}
+	a := NewAuthService("secret", time.Minute, AuthConfig{APIKeys: keys})
+	viewer := a.APIKeys()[1]
+
+	_, identity, err := a.GenerateToken(Identity{
+		Principal: viewer.Principal(),
+		Method:    MethodAPIKey,
+		KeyID:     viewer.Ref(),
+		Roles:     viewer.Scope.Roles,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.KeyID != keyFingerprint("viewer-key") {
+		t.Fatalf("token key_id = %q, want the fingerprint of the key", identity.KeyID)
+	}
+
+	// The admin key's allowed networks do not apply, and neither do its roles
+	if err := a.authorizeKeyToken(identity, "192.0.2.1"); err != nil {
+		t.Errorf("authorizeKeyToken(): %v", err)
+	}
+	if scope, ok := a.currentScope(identity); !ok || scope.HasRole(RoleOperator) {
+		t.Errorf("currentScope() = %+v, %v; want the viewer key's scope", scope, ok)
+	}
+
+	tests := []struct {
+		name     string
+		identity Identity
+	}{
+		{"no key id", Identity{Principal: "api-key:ci", Method: MethodAPIKey}},
+		{"unknown key", Identity{Principal: "api-key:ci", Method: MethodAPIKey, KeyID: "0c4c0be74bb5"}},
+		{"renamed key", Identity{Principal: "api-key:deploy", Method: MethodAPIKey, KeyID: viewer.Ref()}},
+	}
+	for _, tt := range tests {
+		if err := a.authorizeKeyToken(tt.identity, "192.0.2.1"); !errors.Is(err, ErrAPIKeyInvalid) {
+			t.Errorf("%s: error = %v, want ErrAPIKeyInvalid", tt.name, err)
+		}
+		if _, ok := a.currentScope(tt.identity); ok {
+			t.Errorf("%s: currentScope() found a key", tt.name)
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package auth
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,67 +17,153 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrInvalidCredentials is returned for a wrong username or password
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
 type AuthService struct {
 	jwtSecret   []byte
+	signingKeys []SigningKey
 	tokenExpiry time.Duration
-	apiKeys     map[string]bool
-	users       map[string]string // username -> bcrypt hashed password
+	static      AuthConfig // users and keys from the config file
+	store       *AccountStore
+	revocations *RevocationList
+	refresh     *RefreshStore
+	usage       *KeyUsage
+	factors     *SecondFactorState
+	lockout     *Lockout
+	oidc        *OIDCProvider
+	clientCerts []ClientCert
+
+	mu      sync.RWMutex
+	current *accountSet
 }
 
 type AuthConfig struct {
-	APIKeys []string
-	Users   map[string]string // username -> bcrypt hashed password
+	APIKeys     []APIKey
+	Users       map[string]User    // by username
+	Revocations *RevocationList    // nil disables revocation
+	Refresh     *RefreshStore      // nil disables refresh tokens
+	KeyUsage    *KeyUsage          // nil disables API key usage tracking
+	Accounts    *AccountStore      // users and keys managed through the API; nil disables managing them
+	TOTP        *SecondFactorState // used TOTP steps and recovery codes; required for users with TOTP
+	Lockout     *Lockout           // nil disables locking accounts after failed logins
+	OIDC        *OIDCProvider      // nil disables OpenID Connect logins and tokens
+	ClientCerts []ClientCert       // verified TLS client certificates accepted as credentials
+	SigningKeys []SigningKey       // the first signs tokens instead of the JWT secret; all verify them
 }
 
-func NewAuthService(jwtSecret string, tokenExpiry time.Duration, authConfig AuthConfig) *AuthService {
-	// Build API key map for fast lookup
-	apiKeyMap := make(map[string]bool)
-	for _, key := range authConfig.APIKeys {
-		if key != "" {
-			apiKeyMap[key] = true
-		}
-	}
+// User is an account that logs in with a password
+type User struct {
+	Username      string
+	PasswordHash  string // bcrypt
+	Scope         Scope
+	TOTPSecret    string   // base32; empty if the user has not enrolled
+	RecoveryCodes []string // bcrypt hashes of one-time recovery codes
+	Managed       bool     // managed through the API rather than the config file
+	CreatedAt     *time.Time
+	CreatedBy     string
+	UpdatedAt     *time.Time
+}
 
-	return &AuthService{
+// NewAuthService creates the service. Tokens are signed with the first of
+// authConfig.SigningKeys, or with jwtSecret (HS256) if there are none. An
+// empty jwtSecret stops HS256 tokens from being accepted.
+func NewAuthService(jwtSecret string, tokenExpiry time.Duration, authConfig AuthConfig) *AuthService {
+	a := &AuthService{
 		jwtSecret:   []byte(jwtSecret),
+		signingKeys: authConfig.SigningKeys,
 		tokenExpiry: tokenExpiry,
-		apiKeys:     apiKeyMap,
-		users:       authConfig.Users,
+		static:      authConfig,
+		store:       authConfig.Accounts,
+		revocations: authConfig.Revocations,
+		refresh:     authConfig.Refresh,
+		usage:       authConfig.KeyUsage,
+		factors:     authConfig.TOTP,
+		lockout:     authConfig.Lockout,
+		oidc:        authConfig.OIDC,
+		clientCerts: authConfig.ClientCerts,
 	}
+	a.reload()
+	return a
 }
 
+// ContextPrincipal is the gin context key holding the authenticated principal
+const ContextPrincipal = "principal"
+
 type Claims struct {
-	Authorized bool `json:"authorized"`
+	Authorized bool     `json:"authorized"`
+	AuthMethod string   `json:"auth_method,omitempty"`
+	SessionID  string   `json:"sid,omitempty"`    // refresh token family
+	KeyID      string   `json:"key_id,omitempty"` // Ref of the API key the token was issued for
+	Roles      []string `json:"roles,omitempty"`
+	Jails      []string `json:"jails,omitempty"` // jail patterns; empty means every jail
 	jwt.RegisteredClaims
 }
 
-func (a *AuthService) GenerateToken() (string, time.Time, error) {
-	expirationTime := time.Now().Add(a.tokenExpiry)
+// Identity returns the caller the token was issued to
+func (c *Claims) Identity() Identity {
+	identity := Identity{
+		Principal: c.Subject,
+		Method:    c.AuthMethod,
+		Roles:     c.Roles,
+		Jails:     c.Jails,
+		TokenID:   c.ID,
+		SessionID: c.SessionID,
+		KeyID:     c.KeyID,
+	}
+	if c.ExpiresAt != nil {
+		expiresAt := c.ExpiresAt.Time
+		identity.ExpiresAt = &expiresAt
+	}
+	return identity
+}
+
+// GenerateToken issues a token to identity, giving it a unique token ID. It
+// returns the token and the identity as carried in it.
+func (a *AuthService) GenerateToken(identity Identity) (string, Identity, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", Identity{}, err
+	}
+
+	now := time.Now()
 	claims := &Claims{
 		Authorized: true,
+		AuthMethod: identity.Method,
+		SessionID:  identity.SessionID,
+		KeyID:      identity.KeyID,
+		Roles:      identity.Roles,
+		Jails:      identity.Jails,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        tokenID,
+			Subject:   identity.Principal,
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.tokenExpiry)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(a.jwtSecret)
+	var tokenString string
+	if len(a.signingKeys) > 0 {
+		key := a.signingKeys[0]
+		token := jwt.NewWithClaims(key.Method, claims)
+		token.Header["kid"] = key.ID
+		tokenString, err = token.SignedString(key.Private)
+	} else {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		tokenString, err = token.SignedString(a.jwtSecret)
+	}
 	if err != nil {
-		return "", time.Time{}, err
+		return "", Identity{}, err
 	}
 
-	return tokenString, expirationTime, nil
+	return tokenString, claims.Identity(), nil
 }
 
+// ValidateToken verifies a token issued by GenerateToken, with the signing
+// key named by its kid header or, for HS256 tokens, the JWT secret
 func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid signing method")
-		}
-		return a.jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, a.verificationKey)
 
 	if err != nil {
 		return nil, err
@@ -81,72 +173,657 @@ func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, errors.New("invalid token")
 	}
 
+	if a.revocations != nil && claims.IssuedAt != nil &&
+		a.revocations.IsRevoked(claims.ID, claims.Subject, claims.IssuedAt.Time) {
+		return nil, ErrTokenRevoked
+	}
+
 	return claims, nil
 }
 
-// ValidateAPIKey checks if the provided API key is valid
-func (a *AuthService) ValidateAPIKey(apiKey string) bool {
-	return a.apiKeys[apiKey]
+// verificationKey returns the key to verify token with, refusing methods
+// other than the one its key is for
+func (a *AuthService) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(a.jwtSecret) == 0 {
+			return nil, errors.New("invalid signing method")
+		}
+		return a.jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range a.signingKeys {
+		if key.ID == kid {
+			if token.Method.Alg() != key.Method.Alg() {
+				return nil, errors.New("invalid signing method")
+			}
+			return key.Public, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// JWKS returns the public keys tokens are verified with, for other services
+// to verify them
+func (a *AuthService) JWKS() (JWKSet, error) {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range a.signingKeys {
+		jwk, err := key.JWK()
+		if err != nil {
+			return JWKSet{}, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// Tokens are the tokens issued at login or refresh
+type Tokens struct {
+	AccessToken      string
+	Identity         Identity // as carried in the access token
+	RefreshToken     string   // empty if refresh tokens are disabled
+	RefreshExpiresAt time.Time
+}
+
+// IssueTokens issues an access token to identity and, if enabled, a refresh
+// token starting a new session. Users logged in through OpenID Connect get
+// no refresh token, since their groups cannot be looked up again; they log
+// in at the identity provider again instead.
+func (a *AuthService) IssueTokens(identity Identity) (*Tokens, error) {
+	if a.refresh != nil && identity.Method != MethodOIDC {
+		session, err := newTokenID()
+		if err != nil {
+			return nil, err
+		}
+		identity.SessionID = session
+	}
+	return a.issueTokens(identity)
+}
+
+func (a *AuthService) issueTokens(identity Identity) (*Tokens, error) {
+	accessToken, identity, err := a.GenerateToken(identity)
+	if err != nil {
+		return nil, err
+	}
+	tokens := &Tokens{AccessToken: accessToken, Identity: identity}
+
+	if a.refresh != nil && identity.SessionID != "" {
+		tokens.RefreshToken, tokens.RefreshExpiresAt, err = a.refresh.Issue(identity.SessionID, identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
 }
 
-// ValidateCredentials checks if username and password are valid
-func (a *AuthService) ValidateCredentials(username, password string) bool {
-	hashedPassword, exists := a.users[username]
+// Refresh redeems a refresh token for a new access token and the next
+// refresh token of its session. The roles and jails are looked up again, so
+// configuration changes apply. A refresh token used twice ends its session,
+// including the access tokens issued in it.
+func (a *AuthService) Refresh(refreshToken string) (*Tokens, error) {
+	if a.refresh == nil {
+		return nil, ErrRefreshInvalid
+	}
+
+	session, identities, err := a.refresh.Redeem(refreshToken)
+	if errors.Is(err, ErrRefreshReused) {
+		a.revokeIdentities(identities)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := identities[0]
+	scope, exists := a.currentScope(identity)
 	if !exists {
-		return false
+		if identities, err := a.refresh.RevokeFamily(session); err == nil {
+			a.revokeIdentities(identities)
+		}
+		return nil, ErrRefreshInvalid
+	}
+
+	return a.issueTokens(Identity{
+		Principal: identity.Principal,
+		Method:    identity.Method,
+		KeyID:     identity.KeyID,
+		Roles:     scope.Roles,
+		Jails:     scope.Jails,
+		SessionID: session,
+	})
+}
+
+// currentScope returns the permissions the principal of identity holds now,
+// or false if it no longer exists
+func (a *AuthService) currentScope(identity Identity) (Scope, bool) {
+	switch identity.Method {
+	case MethodPassword:
+		user, exists := a.accounts().users[strings.TrimPrefix(identity.Principal, "user:")]
+		return user.Scope, exists
+	case MethodAPIKey:
+		if key := a.tokenAPIKey(identity); key != nil && !key.Expired(time.Now()) {
+			return key.Scope, true
+		}
+	}
+	return Scope{}, false
+}
+
+// Logout revokes the token identity was read from and ends its session
+func (a *AuthService) Logout(identity Identity) error {
+	if a.revocations == nil {
+		return errors.New("token revocation is not enabled")
+	}
+	if identity.TokenID == "" || identity.ExpiresAt == nil {
+		return errors.New("not authenticated by token")
+	}
+	if err := a.revocations.RevokeToken(identity.TokenID, *identity.ExpiresAt); err != nil {
+		return err
+	}
+
+	if a.refresh != nil && identity.SessionID != "" {
+		identities, err := a.refresh.RevokeFamily(identity.SessionID)
+		if err != nil {
+			return err
+		}
+		a.revokeIdentities(identities)
+	}
+	return nil
+}
+
+// RevokePrincipal revokes every token issued to principal so far, including
+// refresh tokens
+func (a *AuthService) RevokePrincipal(principal string) error {
+	if a.revocations == nil {
+		return errors.New("token revocation is not enabled")
+	}
+	if err := a.revocations.RevokePrincipal(principal); err != nil {
+		return err
+	}
+	if a.refresh != nil {
+		return a.refresh.RevokePrincipal(principal)
+	}
+	return nil
+}
+
+// revokeIdentities revokes the access tokens of identities, as far as the
+// revocation list is available
+func (a *AuthService) revokeIdentities(identities []Identity) {
+	if a.revocations == nil {
+		return
+	}
+	for _, identity := range identities {
+		if identity.TokenID != "" && identity.ExpiresAt != nil {
+			a.revocations.RevokeToken(identity.TokenID, *identity.ExpiresAt)
+		}
 	}
+}
+
+// ValidateAPIKey checks if the provided API key is valid and returns it.
+// Generated keys are found by their ID and checked against the stored hash;
+// plain text keys are compared with every configured key. Both compare in
+// constant time, so response times do not reveal how much of a guess was
+// right.
+func (a *AuthService) ValidateAPIKey(apiKey string) (*APIKey, bool) {
+	set := a.accounts()
+	if id, secret, ok := splitAPIKey(apiKey); ok {
+		if key, exists := set.keysByID[id]; exists {
+			return key, key.matchesSecret(secret)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(apiKey))
+	var found *APIKey
+	for _, key := range set.apiKeys {
+		if key.Key != "" && subtle.ConstantTimeCompare(sum[:], key.plainHash[:]) == 1 {
+			found = key
+		}
+	}
+	return found, found != nil
+}
+
+// AuthorizeAPIKey checks an API key used from clientIP, refusing unknown and
+// expired keys and keys not allowed from that address, and records its use.
+// Generated keys are locked after repeated wrong secrets for their ID.
+func (a *AuthService) AuthorizeAPIKey(apiKey, clientIP string) (*APIKey, error) {
+	var lockoutPrincipal string
+	if _, _, ok := splitAPIKey(apiKey); ok {
+		lockoutPrincipal = a.KeyPrincipal(apiKey)
+		if err := a.checkLockout(lockoutPrincipal, clientIP); err != nil {
+			return nil, err
+		}
+	}
+
+	key, valid := a.ValidateAPIKey(apiKey)
+	if !valid {
+		a.loginFailed(lockoutPrincipal, clientIP)
+		return nil, ErrAPIKeyInvalid
+	}
+	if err := key.check(clientIP); err != nil {
+		return nil, err
+	}
+	a.loginSucceeded(lockoutPrincipal)
+	a.recordKeyUse(key, clientIP)
+	return key, nil
+}
+
+// authorizeKeyToken checks that the API key a token was issued for still
+// exists and may be used from clientIP, and records its use
+func (a *AuthService) authorizeKeyToken(identity Identity, clientIP string) error {
+	key := a.tokenAPIKey(identity)
+	if key == nil {
+		return ErrAPIKeyInvalid
+	}
+	if err := key.check(clientIP); err != nil {
+		return err
+	}
+	a.recordKeyUse(key, clientIP)
+	return nil
+}
+
+func (a *AuthService) recordKeyUse(key *APIKey, clientIP string) {
+	if a.usage != nil {
+		a.usage.Record(key.Principal(), clientIP)
+	}
+}
+
+// tokenAPIKey returns the API key a token was issued for, or nil if it no
+// longer exists or has been renamed. Tokens name the key by its Ref, since
+// the principal follows the key's name.
+func (a *AuthService) tokenAPIKey(identity Identity) *APIKey {
+	if identity.KeyID == "" {
+		return nil
+	}
+	key := a.accounts().keyByRef(identity.KeyID)
+	if key == nil || key.Principal() != identity.Principal {
+		return nil
+	}
+	return key
+}
 
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	return err == nil
+// APIKeys returns the accepted API keys, from the config file first
+func (a *AuthService) APIKeys() []*APIKey {
+	return a.accounts().apiKeys
+}
+
+// KeyUsage returns when and from where the key of principal was last used
+func (a *AuthService) KeyUsage(principal string) (Usage, bool) {
+	if a.usage == nil {
+		return Usage{}, false
+	}
+	return a.usage.Get(principal)
+}
+
+// KeyPrincipal names the principal an API key claims to be, whether or not
+// it is valid, without revealing the key. Generated keys are named by their
+// public ID.
+func (a *AuthService) KeyPrincipal(apiKey string) string {
+	if id, _, ok := splitAPIKey(apiKey); ok {
+		if key, exists := a.accounts().keysByID[id]; exists {
+			return key.Principal()
+		}
+		return "api-key:" + id
+	}
+	return APIKeyPrincipal(apiKey)
+}
+
+// APIKeyPrincipal names the principal of a plain text API key without
+// revealing it
+func APIKeyPrincipal(apiKey string) string {
+	return "api-key:" + keyFingerprint(apiKey)
+}
+
+func keyFingerprint(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+// AuthenticateUser checks the password and, for users with TOTP, the TOTP or
+// recovery code of a login from clientIP. Wrong passwords and codes count
+// towards locking the account.
+func (a *AuthService) AuthenticateUser(username, password, code, clientIP string) (Scope, error) {
+	principal := "user:" + username
+	if err := a.checkLockout(principal, clientIP); err != nil {
+		return Scope{}, err
+	}
+
+	scope, valid := a.ValidateCredentials(username, password)
+	if !valid {
+		a.loginFailed(principal, clientIP)
+		return Scope{}, ErrInvalidCredentials
+	}
+	if err := a.VerifySecondFactor(username, code); err != nil {
+		if errors.Is(err, ErrTOTPInvalid) {
+			a.loginFailed(principal, clientIP)
+		}
+		return Scope{}, err
+	}
+
+	a.loginSucceeded(principal)
+	return scope, nil
+}
+
+func (a *AuthService) checkLockout(principal, clientIP string) error {
+	if a.lockout == nil || principal == "" {
+		return nil
+	}
+	return a.lockout.Check(principal, clientIP)
+}
+
+func (a *AuthService) loginFailed(principal, clientIP string) {
+	if a.lockout != nil && principal != "" {
+		a.lockout.Failure(principal, clientIP)
+	}
+}
+
+func (a *AuthService) loginSucceeded(principal string) {
+	if a.lockout != nil && principal != "" {
+		a.lockout.Success(principal)
+	}
+}
+
+// Lockouts returns the accounts with recent failed logins
+func (a *AuthService) Lockouts() []LockoutEntry {
+	if a.lockout == nil {
+		return []LockoutEntry{}
+	}
+	return a.lockout.Entries()
+}
+
+// Unlock clears the failed logins and lockout of principal, reporting
+// whether there were any
+func (a *AuthService) Unlock(principal string) bool {
+	return a.lockout != nil && a.lockout.Unlock(principal)
+}
+
+// ValidateCredentials checks if username and password are valid and returns
+// the user's permissions
+func (a *AuthService) ValidateCredentials(username, password string) (Scope, bool) {
+	user, exists := a.accounts().users[username]
+	if !exists {
+		return Scope{}, false
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	return user.Scope, err == nil
+}
+
+// TOTPEnabled reports whether the user must give a TOTP or recovery code to
+// log in
+func (u User) TOTPEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// VerifySecondFactor checks the TOTP or recovery code given by a user whose
+// password was accepted. Users without TOTP need no code. Each TOTP code and
+// recovery code is accepted only once.
+func (a *AuthService) VerifySecondFactor(username, code string) error {
+	user, exists := a.accounts().users[username]
+	if !exists || !user.TOTPEnabled() {
+		return nil
+	}
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	if a.factors == nil {
+		return errors.New("TOTP is not available")
+	}
+	return a.factors.verify(username, user, code)
+}
+
+// RecoveryCodesLeft returns how many recovery codes of a user are unused
+func (a *AuthService) RecoveryCodesLeft(username string) int {
+	user, exists := a.accounts().users[username]
+	if !exists || a.factors == nil {
+		return 0
+	}
+	return a.factors.remaining(username, user.RecoveryCodes)
+}
+
+// OIDCLoginURL starts a login through the OpenID Connect provider, returning
+// the URL to send the browser to
+func (a *AuthService) OIDCLoginURL(ctx context.Context) (string, error) {
+	if a.oidc == nil {
+		return "", ErrOIDCDisabled
+	}
+	return a.oidc.AuthCodeURL(ctx)
+}
+
+// OIDCCallback completes a login through the OpenID Connect provider and
+// issues tokens to the user
+func (a *AuthService) OIDCCallback(ctx context.Context, state, code string) (*Tokens, error) {
+	if a.oidc == nil {
+		return nil, ErrOIDCDisabled
+	}
+	identity, err := a.oidc.Exchange(ctx, state, code)
+	if err != nil {
+		return nil, err
+	}
+	return a.IssueTokens(identity)
+}
+
+// oidcIdentity verifies a bearer token issued by the OpenID Connect provider
+func (a *AuthService) oidcIdentity(ctx context.Context, tokenString string) (Identity, error) {
+	identity, err := a.oidc.VerifyBearer(ctx, tokenString)
+	if err != nil {
+		return Identity{}, err
+	}
+	if a.revocations != nil {
+		claims := jwt.MapClaims{}
+		jwt.NewParser().ParseUnverified(tokenString, claims)
+		if iat, err := claims.GetIssuedAt(); err == nil && iat != nil &&
+			a.revocations.IsRevoked(identity.TokenID, identity.Principal, iat.Time) {
+			return Identity{}, ErrTokenRevoked
+		}
+	}
+	return identity, nil
 }
 
 // HasAuthConfigured returns true if any authentication method is configured
 func (a *AuthService) HasAuthConfigured() bool {
-	return len(a.apiKeys) > 0 || len(a.users) > 0
+	set := a.accounts()
+	return len(set.apiKeys) > 0 || len(set.users) > 0 || a.oidc != nil || len(a.clientCerts) > 0
 }
 
+// Middleware authenticates requests by a bearer token from /auth/login,
+// directly by an API key in an "X-API-Key: <key>" or "Authorization: ApiKey
+// <key>" header, or by a mapped TLS client certificate
 func (a *AuthService) Middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"success": false,
-				"error":   "Authorization header required",
-			})
-			c.Abort()
-			return
-		}
-
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"success": false,
-				"error":   "Invalid authorization header format",
-			})
-			c.Abort()
-			return
-		}
+		var identity Identity
+		if apiKey, ok := apiKeyFromRequest(c); ok {
+			key, err := a.AuthorizeAPIKey(apiKey, c.ClientIP())
+			if err != nil {
+				c.Set(ContextPrincipal, a.KeyPrincipal(apiKey))
+				SetRetryAfter(c, err)
+				c.JSON(APIKeyErrorStatus(err), gin.H{
+					"success": false,
+					"error":   APIKeyErrorMessage(err),
+				})
+				c.Abort()
+				return
+			}
+			identity = Identity{
+				Principal: key.Principal(),
+				Method:    MethodAPIKey,
+				KeyID:     key.Ref(),
+				Roles:     key.Scope.Roles,
+				Jails:     key.Scope.Jails,
+			}
+		} else if cert := verifiedClientCert(c); cert != nil && c.GetHeader("Authorization") == "" {
+			// Requests without credentials of their own are authenticated
+			// by their client certificate
+			var ok bool
+			if identity, ok = a.certIdentity(cert); !ok {
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"success": false,
+					"error":   "Client certificate is not mapped to a principal",
+				})
+				c.Abort()
+				return
+			}
+		} else {
+			var ok bool
+			if identity, ok = a.tokenIdentity(c); !ok {
+				c.Abort()
+				return
+			}
 
-		tokenString := parts[1]
-		claims, err := a.ValidateToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"success": false,
-				"error":   "Invalid or expired token",
-			})
-			c.Abort()
-			return
+			// Tokens obtained with an API key stop working when the key is
+			// removed or expires, and are bound to its allowed networks
+			if identity.Method == MethodAPIKey {
+				if err := a.authorizeKeyToken(identity, c.ClientIP()); err != nil {
+					c.Set(ContextPrincipal, identity.Principal)
+					c.JSON(APIKeyErrorStatus(err), gin.H{
+						"success": false,
+						"error":   APIKeyErrorMessage(err),
+					})
+					c.Abort()
+					return
+				}
+			}
 		}
 
-		if !claims.Authorized {
+		if jail := c.Param("name"); jail != "" && !identity.Scope().AllowsJail(jail) {
 			c.JSON(http.StatusForbidden, gin.H{
 				"success": false,
-				"error":   "Not authorized",
+				"error":   "Not authorized for jail " + jail,
 			})
 			c.Abort()
 			return
 		}
 
+		SetIdentity(c, identity)
+
 		c.Next()
 	}
 }
+
+// APIKeyErrorStatus returns the HTTP status for an error refusing an API key
+func APIKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAPIKeyIPDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrLockedOut):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusUnauthorized
+}
+
+// APIKeyErrorMessage returns the message for an error refusing an API key
+func APIKeyErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrAPIKeyExpired):
+		return "API key has expired"
+	case errors.Is(err, ErrAPIKeyIPDenied):
+		return "API key is not allowed from this address"
+	case errors.Is(err, ErrLockedOut):
+		return "Too many failed attempts, try again later"
+	}
+	return "Invalid API key"
+}
+
+// apiKeyFromRequest returns the API key sent directly with a request, if any
+func apiKeyFromRequest(c *gin.Context) (string, bool) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key, true
+	}
+	parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+	if len(parts) == 2 && parts[0] == "ApiKey" {
+		return parts[1], true
+	}
+	return "", false
+}
+
+// tokenIdentity returns the identity carried by the bearer token of a
+// request. If the token is missing or invalid it writes the error response
+// and returns false.
+func (a *AuthService) tokenIdentity(c *gin.Context) (Identity, bool) {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Authorization header required",
+		})
+		return Identity{}, false
+	}
+
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Invalid authorization header format",
+		})
+		return Identity{}, false
+	}
+
+	tokenString := parts[1]
+
+	// Access tokens of the identity provider are verified against its keys
+	if a.oidc != nil && a.oidc.Issued(tokenString) {
+		return a.oidcTokenIdentity(c, tokenString)
+	}
+
+	claims, err := a.ValidateToken(tokenString)
+	if errors.Is(err, ErrTokenRevoked) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Token has been revoked",
+		})
+		return Identity{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Invalid or expired token",
+		})
+		return Identity{}, false
+	}
+
+	if !claims.Authorized {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "Not authorized",
+		})
+		return Identity{}, false
+	}
+
+	// Tokens issued by older versions lack the identity claims
+	identity := claims.Identity()
+	if identity.Principal == "" || identity.TokenID == "" || len(identity.Roles) == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Token is outdated, please log in again",
+		})
+		return Identity{}, false
+	}
+
+	return identity, true
+}
+
+// oidcTokenIdentity returns the identity carried by a bearer token of the
+// OpenID Connect provider. If the token is invalid it writes the error
+// response and returns false.
+func (a *AuthService) oidcTokenIdentity(c *gin.Context, tokenString string) (Identity, bool) {
+	identity, err := a.oidcIdentity(c.Request.Context(), tokenString)
+	switch {
+	case errors.Is(err, ErrTokenRevoked):
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Token has been revoked",
+		})
+		return Identity{}, false
+	case errors.Is(err, ErrOIDCNoRole):
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "No role is mapped to your groups",
+		})
+		return Identity{}, false
+	case err != nil:
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"success": false,
+			"error":   "Invalid or expired token",
+		})
+		return Identity{}, false
+	}
+	return identity, true
+}
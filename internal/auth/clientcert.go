@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientCert maps TLS client certificates to a principal and scope. The
+// first non-empty one of Subject, CommonName, DNSName, URI, Email and
+// Fingerprint selects the certificates it applies to.
+type ClientCert struct {
+	Name        string
+	Subject     string // distinguished name, e.g. "CN=deploy,O=Example"
+	CommonName  string
+	DNSName     string // subject alternative names
+	URI         string
+	Email       string
+	Fingerprint string // SHA-256 of the certificate, hex with or without colons
+	Scope       Scope
+}
+
+// Principal returns the principal of callers with a matching certificate
+func (m ClientCert) Principal() string {
+	return "cert:" + m.Name
+}
+
+// Matches reports whether the certificate is one this mapping applies to
+func (m ClientCert) Matches(cert *x509.Certificate) bool {
+	switch {
+	case m.Subject != "":
+		return cert.Subject.String() == m.Subject
+	case m.CommonName != "":
+		return cert.Subject.CommonName == m.CommonName
+	case m.DNSName != "":
+		for _, name := range cert.DNSNames {
+			if strings.EqualFold(name, m.DNSName) {
+				return true
+			}
+		}
+	case m.URI != "":
+		for _, uri := range cert.URIs {
+			if uri.String() == m.URI {
+				return true
+			}
+		}
+	case m.Email != "":
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(email, m.Email) {
+				return true
+			}
+		}
+	case m.Fingerprint != "":
+		return strings.EqualFold(strings.ReplaceAll(m.Fingerprint, ":", ""), certFingerprint(cert))
+	}
+	return false
+}
+
+// certFingerprint returns the hex SHA-256 fingerprint of a certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifiedClientCert returns the client certificate of a request, if it
+// presented one the TLS handshake verified
+func verifiedClientCert(c *gin.Context) *x509.Certificate {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// certIdentity returns the identity of the first mapping applying to a
+// verified client certificate
+func (a *AuthService) certIdentity(cert *x509.Certificate) (Identity, bool) {
+	for _, mapping := range a.clientCerts {
+		if mapping.Matches(cert) {
+			return Identity{
+				Principal: mapping.Principal(),
+				Method:    MethodClientCert,
+				Roles:     mapping.Scope.Roles,
+				Jails:     mapping.Scope.Jails,
+			}, true
+		}
+	}
+	return Identity{}, false
+}
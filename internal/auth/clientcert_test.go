@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testCert returns a certificate with the attributes mappings match on. Raw
+// stands in for its DER encoding, which is all the fingerprint depends on.
+func testCert() *x509.Certificate {
+	uri, _ := url.Parse("spiffe://example.org/deploy")
+	return &x509.Certificate{
+		Raw:            []byte("deploy certificate"),
+		Subject:        pkix.Name{CommonName: "deploy", Organization: []string{"Example"}},
+		DNSNames:       []string{"deploy.example.org", "ci.example.org"},
+		URIs:           []*url.URL{uri},
+		EmailAddresses: []string{"deploy@example.org"},
+	}
+}
+
+func testCertFingerprint() string {
+	sum := sha256.Sum256(testCert().Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestClientCertMatches(t *testing.T) {
+	fingerprint := testCertFingerprint()
+	var colons []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	tests := []struct {
+		name    string
+		mapping ClientCert
+		want    bool
+	}{
+		{"subject", ClientCert{Subject: "CN=deploy,O=Example"}, true},
+		{"other subject", ClientCert{Subject: "CN=deploy,O=Other"}, false},
+		{"subject is not a common name", ClientCert{Subject: "deploy"}, false},
+		{"common name", ClientCert{CommonName: "deploy"}, true},
+		{"other common name", ClientCert{CommonName: "monitoring"}, false},
+		{"dns name", ClientCert{DNSName: "ci.example.org"}, true},
+		{"dns name in other case", ClientCert{DNSName: "CI.Example.org"}, true},
+		{"other dns name", ClientCert{DNSName: "example.org"}, false},
+		{"uri", ClientCert{URI: "spiffe://example.org/deploy"}, true},
+		{"other uri", ClientCert{URI: "spiffe://example.org/monitoring"}, false},
+		{"email", ClientCert{Email: "Deploy@example.org"}, true},
+		{"other email", ClientCert{Email: "ops@example.org"}, false},
+		{"fingerprint", ClientCert{Fingerprint: fingerprint}, true},
+		{"fingerprint with colons", ClientCert{Fingerprint: strings.Join(colons, ":")}, true},
+		{"other fingerprint", ClientCert{Fingerprint: strings.Repeat("0", 64)}, false},
+		{"first attribute only", ClientCert{CommonName: "monitoring", DNSName: "ci.example.org"}, false},
+		{"no attribute", ClientCert{Name: "deploy"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.mapping.Matches(testCert()); got != tt.want {
+			t.Errorf("%s: Matches() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []ClientCert
+		want     string // principal, or "" if the certificate is rejected
+		roles    []string
+	}{
+		{
+			name:     "unmapped",
+			mappings: []ClientCert{{Name: "monitoring", CommonName: "monitoring"}},
+		},
+		{
+			name:     "no mappings",
+			mappings: nil,
+		},
+		{
+			name: "mapped",
+			mappings: []ClientCert{
+				{Name: "monitoring", CommonName: "monitoring", Scope: Scope{Roles: []string{RoleViewer}}},
+				{Name: "deploy", URI: "spiffe://example.org/deploy", Scope: Scope{Roles: []string{RoleOperator}}},
+			},
+			want:  "cert:deploy",
+			roles: []string{RoleOperator},
+		},
+		{
+			name: "several mappings match",
+			mappings: []ClientCert{
+				{Name: "ci", DNSName: "ci.example.org", Scope: Scope{Roles: []string{RoleViewer}}},
+				{Name: "deploy", Subject: "CN=deploy,O=Example", Scope: Scope{Roles: []string{RoleAdmin}}},
+			},
+			want:  "cert:ci", // the first one applies
+			roles: []string{RoleViewer},
+		},
+	}
+	for _, tt := range tests {
+		a := NewAuthService("secret", time.Minute, AuthConfig{ClientCerts: tt.mappings})
+		identity, ok := a.certIdentity(testCert())
+		if ok != (tt.want != "") || identity.Principal != tt.want {
+			t.Errorf("%s: certIdentity() = %q, %v; want %q", tt.name, identity.Principal, ok, tt.want)
+			continue
+		}
+		if ok && (identity.Method != MethodClientCert || strings.Join(identity.Roles, ",") != strings.Join(tt.roles, ",")) {
+			t.Errorf("%s: certIdentity() = %+v, want method %s and roles %v", tt.name, identity, MethodClientCert, tt.roles)
+		}
+	}
+}
+
+func TestMiddlewareClientCert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a := NewAuthService("secret", time.Minute, AuthConfig{ClientCerts: []ClientCert{
+		{Name: "deploy", Fingerprint: testCertFingerprint(), Scope: Scope{Roles: []string{RoleOperator}, Jails: []string{"nginx-*"}}},
+	}})
+	router := gin.New()
+	router.GET("/jails/:name", a.Middleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, PrincipalFromContext(c))
+	})
+
+	other := testCert()
+	other.Raw = []byte("another certificate")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		path string
+		want int
+		body string
+	}{
+		{"mapped", testCert(), "/jails/nginx-http-auth", http.StatusOK, "cert:deploy"},
+		{"outside its jails", testCert(), "/jails/sshd", http.StatusForbidden, ""},
+		{"unmapped", other, "/jails/nginx-http-auth", http.StatusUnauthorized, ""},
+		{"no certificate", nil, "/jails/nginx-http-auth", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s: %d %s, want %d %s", tt.name, w.Code, w.Body.String(), tt.want, tt.body)
+		}
+	}
+}
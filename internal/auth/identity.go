@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ways a principal can authenticate
+const (
+	MethodAPIKey     = "api_key"
+	MethodPassword   = "password"
+	MethodOIDC       = "oidc"
+	MethodClientCert = "client_cert"
+)
+
+// ContextIdentity is the gin context key holding the Identity of the caller
+const ContextIdentity = "identity"
+
+// Identity is who is calling and how they authenticated
+type Identity struct {
+	Principal string     `json:"principal"` // "user:<name>", "api-key:<id>", "oidc:<name>" or "cert:<name>"
+	Method    string     `json:"auth_method"`
+	Roles     []string   `json:"roles"`
+	Jails     []string   `json:"jails,omitempty"` // jail patterns; empty means every jail
+	TokenID   string     `json:"token_id,omitempty"`
+	SessionID string     `json:"session_id,omitempty"` // shared by the tokens refreshed from one login
+	KeyID     string     `json:"key_id,omitempty"`     // Ref of the API key, for API key callers
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil unless authenticated by token
+}
+
+// Scope returns the permissions of the identity
+func (i Identity) Scope() Scope {
+	return Scope{Roles: i.Roles, Jails: i.Jails}
+}
+
+// SetIdentity stores the identity of the caller in the request context
+func SetIdentity(c *gin.Context, identity Identity) {
+	c.Set(ContextIdentity, identity)
+	c.Set(ContextPrincipal, identity.Principal)
+	c.Set(ContextScope, identity.Scope())
+}
+
+// IdentityFromContext returns the identity of the authenticated caller, if
+// the request passed the auth middleware
+func IdentityFromContext(c *gin.Context) (Identity, bool) {
+	if value, ok := c.Get(ContextIdentity); ok {
+		if identity, ok := value.(Identity); ok {
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+// PrincipalFromContext returns the principal of the caller. It is also set
+// for failed logins, naming the principal that tried to log in.
+func PrincipalFromContext(c *gin.Context) string {
+	return c.GetString(ContextPrincipal)
+}
+
+// newTokenID returns a random unique token ID
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
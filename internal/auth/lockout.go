@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrLockedOut is returned for logins to an account locked after repeated
+// failures
+var ErrLockedOut = errors.New("too many failed attempts")
+
+// LockoutError is a refused login to a locked account
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%v, locked until %s", ErrLockedOut, e.Until.Format(time.RFC3339))
+}
+
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+// SetRetryAfter sets the Retry-After header of a response refusing a locked
+// account
+func SetRetryAfter(c *gin.Context, err error) {
+	var lockErr *LockoutError
+	if errors.As(err, &lockErr) {
+		seconds := int(time.Until(lockErr.Until).Seconds()) + 1
+		c.Header("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
+// maxLockoutEntries bounds the failures tracked, so guessing many usernames
+// cannot exhaust memory
+const maxLockoutEntries = 10000
+
+// LockoutPolicy says when repeated failed logins lock an account
+type LockoutPolicy struct {
+	MaxAttempts int           // failures before the account is locked
+	BaseDelay   time.Duration // first lockout, doubled with each further failure
+	MaxDelay    time.Duration
+	ResetAfter  time.Duration // failures are forgotten after this long without one
+	BanAfter    int           // failures from one client IP before it is banned; 0 disables
+}
+
+// Lockout tracks failed logins per account (a user or the ID of a generated
+// API key) and per client IP, in memory
+type Lockout struct {
+	policy LockoutPolicy
+	onBan  func(ip string)
+
+	mu       sync.Mutex
+	accounts map[string]*failures // by principal
+	clients  map[string]*failures // by client IP
+}
+
+type failures struct {
+	count       int
+	last        time.Time
+	lastIP      string
+	lockedUntil time.Time
+}
+
+// LockoutEntry describes an account with recent failed logins
+type LockoutEntry struct {
+	Principal     string
+	Failures      int
+	LastFailureAt time.Time
+	LastIP        string
+	LockedUntil   *time.Time // nil if not locked
+}
+
+// NewLockout creates a tracker applying policy. onBan, if not nil, is called
+// in the background for client IPs with BanAfter failures.
+func NewLockout(policy LockoutPolicy, onBan func(ip string)) *Lockout {
+	return &Lockout{
+		policy:   policy,
+		onBan:    onBan,
+		accounts: make(map[string]*failures),
+		clients:  make(map[string]*failures),
+	}
+}
+
+// Check returns a LockoutError if principal is locked. Attempts refused
+// this way still count against clientIP.
+func (l *Lockout) Check(principal, clientIP string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if f, exists := l.accounts[principal]; exists && now.Before(f.lockedUntil) {
+		l.clientFailure(clientIP, now)
+		return &LockoutError{Until: f.lockedUntil}
+	}
+	return nil
+}
+
+// Failure records a failed login to principal from clientIP, locking the
+// account once it reaches MaxAttempts failures. Each further failure doubles
+// the lockout, up to MaxDelay.
+func (l *Lockout) Failure(principal, clientIP string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if f := l.record(l.accounts, principal, clientIP, now); f.count >= l.policy.MaxAttempts {
+		f.lockedUntil = now.Add(l.delay(f.count))
+	}
+	l.clientFailure(clientIP, now)
+}
+
+// clientFailure counts a failed login from clientIP, banning it once it
+// reaches BanAfter failures. The caller must hold l.mu.
+func (l *Lockout) clientFailure(clientIP string, now time.Time) {
+	if l.policy.BanAfter <= 0 || l.onBan == nil || clientIP == "" {
+		return
+	}
+	if f := l.record(l.clients, clientIP, clientIP, now); f.count >= l.policy.BanAfter {
+		delete(l.clients, clientIP)
+		go l.onBan(clientIP)
+	}
+}
+
+// Success forgets the failures of principal after a successful login
+func (l *Lockout) Success(principal string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, principal)
+}
+
+// Unlock clears the failures and lockout of principal, reporting whether
+// there were any
+func (l *Lockout) Unlock(principal string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, exists := l.accounts[principal]
+	delete(l.accounts, principal)
+	return exists
+}
+
+// Entries returns the accounts with recent failures, locked ones first
+func (l *Lockout) Entries() []LockoutEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entries := []LockoutEntry{}
+	for principal, f := range l.accounts {
+		if l.stale(f, now) {
+			continue
+		}
+		entry := LockoutEntry{
+			Principal:     principal,
+			Failures:      f.count,
+			LastFailureAt: f.last,
+			LastIP:        f.lastIP,
+		}
+		if now.Before(f.lockedUntil) {
+			lockedUntil := f.lockedUntil
+			entry.LockedUntil = &lockedUntil
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if (entries[i].LockedUntil != nil) != (entries[j].LockedUntil != nil) {
+			return entries[i].LockedUntil != nil
+		}
+		return entries[i].LastFailureAt.After(entries[j].LastFailureAt)
+	})
+	return entries
+}
+
+// record counts a failure for key, starting over if the previous ones are
+// stale. A full table makes room by forgetting the oldest entry. The caller
+// must hold l.mu.
+func (l *Lockout) record(table map[string]*failures, key, clientIP string, now time.Time) *failures {
+	f, exists := table[key]
+	if !exists {
+		if len(table) >= maxLockoutEntries {
+			l.prune(table, now)
+			if len(table) >= maxLockoutEntries {
+				evictOldest(table, now)
+			}
+		}
+		f = &failures{}
+		table[key] = f
+	}
+	if l.stale(f, now) {
+		*f = failures{}
+	}
+	f.count++
+	f.last = now
+	f.lastIP = clientIP
+	return f
+}
+
+// stale reports whether failures are old enough to be forgotten
+func (l *Lockout) stale(f *failures, now time.Time) bool {
+	return now.Sub(f.last) > l.policy.ResetAfter && !now.Before(f.lockedUntil)
+}
+
+// prune drops stale entries. The caller must hold l.mu.
+func (l *Lockout) prune(table map[string]*failures, now time.Time) {
+	for key, f := range table {
+		if l.stale(f, now) {
+			delete(table, key)
+		}
+	}
+}
+
+// delay returns how long count failures lock an account for
+func (l *Lockout) delay(count int) time.Duration {
+	delay := l.policy.BaseDelay
+	for i := l.policy.MaxAttempts; i < count && delay < l.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.policy.MaxDelay {
+		delay = l.policy.MaxDelay
+	}
+	return delay
+}
+
+// evictOldest drops the entry with the oldest failure, sparing locked ones
+// unless every entry is locked
+func evictOldest(table map[string]*failures, now time.Time) {
+	var oldest string
+	var oldestLocked bool
+	found := false
+	for key, f := range table {
+		locked := now.Before(f.lockedUntil)
+		if !found || (oldestLocked && !locked) || (oldestLocked == locked && f.last.Before(table[oldest].last)) {
+			oldest, oldestLocked, found = key, locked, true
+		}
+	}
+	delete(table, oldest)
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLockout(onBan func(ip string)) *Lockout {
+	return NewLockout(LockoutPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Minute,
+		MaxDelay:    5 * time.Minute,
+		ResetAfter:  time.Hour,
+		BanAfter:    5,
+	}, onBan)
+}
+
+func TestLockoutDelay(t *testing.T) {
+	l := testLockout(nil)
+	tests := []struct {
+		count int
+		want  time.Duration
+	}{
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 5 * time.Minute}, // capped at MaxDelay
+		{20, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := l.delay(tt.count); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutLocksAfterMaxAttempts(t *testing.T) {
+	l := testLockout(nil)
+	for i := 1; i <= 3; i++ {
+		if err := l.Check("user:alice", "192.0.2.1"); err != nil {
+			t.Fatalf("locked after %d failures: %v", i-1, err)
+		}
+		l.Failure("user:alice", "192.0.2.1")
+	}
+
+	err := l.Check("user:alice", "192.0.2.1")
+	var lockErr *LockoutError
+	if !errors.As(err, &lockErr) || !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("Check() after 3 failures = %v, want a LockoutError", err)
+	}
+	if until := time.Until(lockErr.Until); until <= 0 || until > time.Minute {
+		t.Errorf("locked for %v, want up to the base delay", until)
+	}
+
+	// Other accounts are unaffected, and a success or unlock clears the lock
+	if err := l.Check("user:bob", "192.0.2.1"); err != nil {
+		t.Errorf("other account locked: %v", err)
+	}
+	if !l.Unlock("user:alice") {
+		t.Error("Unlock() reported no failures")
+	}
+	if err := l.Check("user:alice", "192.0.2.1"); err != nil {
+		t.Errorf("still locked after Unlock(): %v", err)
+	}
+}
+
+func TestLockoutForgetsStaleFailures(t *testing.T) {
+	l := testLockout(nil)
+	l.Failure("user:alice", "192.0.2.1")
+	l.Failure("user:alice", "192.0.2.1")
+
+	// Age the failures past ResetAfter: the next one starts over
+	l.accounts["user:alice"].last = time.Now().Add(-2 * time.Hour)
+	l.Failure("user:alice", "192.0.2.1")
+	if got := l.accounts["user:alice"].count; got != 1 {
+		t.Errorf("count after stale failures = %d, want 1", got)
+	}
+	if err := l.Check("user:alice", "192.0.2.1"); err != nil {
+		t.Errorf("locked by stale failures: %v", err)
+	}
+
+	l.accounts["user:alice"].last = time.Now().Add(-2 * time.Hour)
+	if entries := l.Entries(); len(entries) != 0 {
+		t.Errorf("Entries() lists stale failures: %+v", entries)
+	}
+	l.prune(l.accounts, time.Now())
+	if len(l.accounts) != 0 {
+		t.Errorf("prune() kept %d stale entries", len(l.accounts))
+	}
+}
+
+func TestLockoutEvictsOldestWhenFull(t *testing.T) {
+	l := testLockout(nil)
+	now := time.Now()
+	for i := 0; i < maxLockoutEntries; i++ {
+		l.accounts[fmt.Sprintf("user:u%d", i)] = &failures{count: 1, last: now.Add(time.Duration(i) * time.Second)}
+	}
+	// The oldest entry is locked, so the next oldest goes instead
+	l.accounts["user:u0"].lockedUntil = now.Add(time.Hour)
+
+	l.Failure("user:new", "192.0.2.1")
+	if _, tracked := l.accounts["user:new"]; !tracked {
+		t.Fatal("failure not tracked when the table is full")
+	}
+	if len(l.accounts) != maxLockoutEntries {
+		t.Errorf("table has %d entries, want %d", len(l.accounts), maxLockoutEntries)
+	}
+	if _, kept := l.accounts["user:u0"]; !kept {
+		t.Error("locked entry was evicted")
+	}
+	if _, kept := l.accounts["user:u1"]; kept {
+		t.Error("oldest unlocked entry was kept")
+	}
+}
+
+func TestLockoutBansClient(t *testing.T) {
+	var mu sync.Mutex
+	var banned []string
+	done := make(chan struct{})
+	l := testLockout(func(ip string) {
+		mu.Lock()
+		banned = append(banned, ip)
+		mu.Unlock()
+		close(done)
+	})
+
+	for i := 0; i < 5; i++ {
+		l.Failure(fmt.Sprintf("user:u%d", i), "192.0.2.7")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client was not banned")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(banned) != 1 || banned[0] != "192.0.2.7" {
+		t.Errorf("banned %v, want [192.0.2.7]", banned)
+	}
+	if _, tracked := l.clients["192.0.2.7"]; tracked {
+		t.Error("banned client is still tracked")
+	}
+}
@@ -0,0 +1,446 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Errors returned for OpenID Connect logins and tokens
+var (
+	ErrOIDCDisabled = errors.New("OpenID Connect is not enabled")
+	ErrOIDCState    = errors.New("unknown or expired login state")
+	ErrOIDCNoRole   = errors.New("no role is mapped to the user's groups")
+)
+
+const (
+	// oidcLoginTimeout is how long a browser has to complete a login at the
+	// identity provider
+	oidcLoginTimeout = 10 * time.Minute
+
+	// oidcKeysMaxAge is how long the provider's keys are cached; unknown key
+	// IDs refetch them sooner, at most every oidcKeysMinRefresh
+	oidcKeysMaxAge     = time.Hour
+	oidcKeysMinRefresh = 30 * time.Second
+
+	// maxPendingLogins bounds the logins started but not completed
+	maxPendingLogins = 1000
+)
+
+// Signing algorithms accepted from identity providers
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDCConfig configures login through an OpenID Connect identity provider
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string // the /auth/oidc/callback URL registered at the provider
+	Scopes        []string
+	Audience      string // expected audience of bearer tokens; defaults to ClientID
+	UsernameClaim string
+	GroupsClaim   string
+	GroupScopes   []GroupScope // the first one matching one of the user's groups applies
+	DefaultScope  *Scope       // for users in no mapped group; nil refuses them
+}
+
+// GroupScope grants the members of an identity provider group a scope
+type GroupScope struct {
+	Group string
+	Scope Scope
+}
+
+// OIDCProvider logs users in through an OpenID Connect identity provider and
+// verifies the tokens it issues
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey // by key ID
+	keysFetched time.Time
+	pending     map[string]oidcLogin // by state
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a browser login waiting for the provider's callback
+type oidcLogin struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	expires  time.Time
+}
+
+// NewOIDCProvider creates a provider for config. The provider's endpoints
+// and keys are fetched when first needed.
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	config.Issuer = strings.TrimRight(config.Issuer, "/")
+	if config.Audience == "" {
+		config.Audience = config.ClientID
+	}
+	return &OIDCProvider{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    make(map[string]crypto.PublicKey),
+		pending: make(map[string]oidcLogin),
+	}
+}
+
+// Issued reports whether a token claims to come from the provider, without
+// verifying it
+func (p *OIDCProvider) Issued(tokenString string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, claims); err != nil {
+		return false
+	}
+	issuer, _ := claims.GetIssuer()
+	return strings.TrimRight(issuer, "/") == p.config.Issuer
+}
+
+// VerifyBearer verifies an access token issued by the provider and returns
+// the identity it carries
+func (p *OIDCProvider) VerifyBearer(ctx context.Context, tokenString string) (Identity, error) {
+	claims, err := p.verify(ctx, tokenString, p.config.Audience)
+	if err != nil {
+		return Identity{}, err
+	}
+	return p.identity(claims)
+}
+
+// AuthCodeURL starts a browser login, returning the provider URL to redirect
+// the browser to
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context) (string, error) {
+	if p.config.RedirectURL == "" {
+		return "", fmt.Errorf("%w for browsers: no redirect URL is configured", ErrOIDCDisabled)
+	}
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	for s, login := range p.pending {
+		if now.After(login.expires) {
+			delete(p.pending, s)
+		}
+	}
+	if len(p.pending) >= maxPendingLogins {
+		p.mu.Unlock()
+		return "", errors.New("too many logins in progress")
+	}
+	p.pending[state] = oidcLogin{nonce: nonce, verifier: verifier, expires: now.Add(oidcLoginTimeout)}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange completes a browser login, redeeming the authorization code the
+// provider sent back with state, and returns the identity of the user
+func (p *OIDCProvider) Exchange(ctx context.Context, state, code string) (Identity, error) {
+	p.mu.Lock()
+	login, exists := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !exists || time.Now().After(login.expires) {
+		return Identity{}, ErrOIDCState
+	}
+
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", login.verifier)
+	form.Set("client_id", p.config.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.do(req, &tokens); err != nil {
+		return Identity{}, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return Identity{}, errors.New("identity provider returned no ID token")
+	}
+
+	claims, err := p.verify(ctx, tokens.IDToken, p.config.ClientID)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return Identity{}, errors.New("invalid ID token: nonce mismatch")
+	}
+
+	identity, err := p.identity(claims)
+	if err != nil {
+		return Identity{}, err
+	}
+	// The ID token only proves the login; tokens are issued by the caller
+	identity.TokenID = ""
+	identity.ExpiresAt = nil
+	return identity, nil
+}
+
+// verify checks the signature, issuer, audience and expiry of a token from
+// the provider
+func (p *OIDCProvider) verify(ctx context.Context, tokenString, audience string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// identity maps the claims of a verified token to a local identity
+func (p *OIDCProvider) identity(claims jwt.MapClaims) (Identity, error) {
+	username, _ := claims[p.config.UsernameClaim].(string)
+	if username == "" {
+		username, _ = claims.GetSubject()
+	}
+	if username == "" {
+		return Identity{}, errors.New("token names no user")
+	}
+
+	scope, ok := p.scopeFor(stringList(claims[p.config.GroupsClaim]))
+	if !ok {
+		return Identity{}, ErrOIDCNoRole
+	}
+
+	identity := Identity{
+		Principal: "oidc:" + username,
+		Method:    MethodOIDC,
+		Roles:     scope.Roles,
+		Jails:     scope.Jails,
+	}
+	identity.TokenID, _ = claims["jti"].(string)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt := exp.Time
+		identity.ExpiresAt = &expiresAt
+	}
+	return identity, nil
+}
+
+// scopeFor returns the scope of the first group mapping matching one of
+// groups, or the default scope
+func (p *OIDCProvider) scopeFor(groups []string) (Scope, bool) {
+	for _, mapping := range p.config.GroupScopes {
+		for _, group := range groups {
+			if group == mapping.Group {
+				return mapping.Scope, true
+			}
+		}
+	}
+	if p.config.DefaultScope != nil {
+		return *p.config.DefaultScope, true
+	}
+	return Scope{}, false
+}
+
+// stringList reads a claim holding a string or a list of strings
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+		return items
+	}
+	return nil
+}
+
+// key returns the provider's public key with ID kid, refetching the keys if
+// it is unknown. Tokens without a key ID are accepted if the provider has a
+// single key.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	stale := time.Since(p.keysFetched) > oidcKeysMaxAge
+	key, known := p.lookupKey(kid)
+	canRefresh := time.Since(p.keysFetched) > oidcKeysMinRefresh
+	p.mu.Unlock()
+
+	if known && !stale {
+		return key, nil
+	}
+	if !stale && !canRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if err := p.fetchKeys(ctx); err != nil {
+		if known {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, known := p.lookupKey(kid); known {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key. The caller must hold p.mu.
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, known := p.keys[kid]
+	return key, known
+}
+
+func (p *OIDCProvider) fetchKeys(ctx context.Context) error {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return err
+	}
+	var set JWKSet
+	if err := p.do(req, &set); err != nil {
+		return fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// discover fetches the provider's endpoints once
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	discovery := p.discovery
+	p.mu.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	discovery = &oidcDiscovery{}
+	if err := p.do(req, discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover identity provider: %w", err)
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("identity provider reports issuer %q, expected %q", discovery.Issuer, p.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("identity provider discovery document is incomplete")
+	}
+
+	p.mu.Lock()
+	p.discovery = discovery
+	p.mu.Unlock()
+	return discovery, nil
+}
+
+// do sends req and decodes the JSON response into v
+func (p *OIDCProvider) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,378 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIdP is a minimal OpenID Connect provider: discovery, keys, and a
+// token endpoint redeeming codes handed out by approve
+type testIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu     sync.Mutex
+	codes  map[string]testLogin
+	claims jwt.MapClaims // added to or overriding the claims of ID tokens
+	issuer string        // reported by discovery instead of the server URL
+}
+
+type testLogin struct {
+	challenge string
+	nonce     string
+	groups    []string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, kid: "key-1", codes: make(map[string]testLogin)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.server.URL
+		if idp.issuer != "" {
+			issuer = idp.issuer
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		jwk, err := NewJWK(idp.kid, &idp.key.PublicKey)
+		idp.mu.Unlock()
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{jwk}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// approve completes a login at the provider for the authorization URL from
+// AuthCodeURL and returns the state and code sent back to the callback
+func (idp *testIdP) approve(t *testing.T, authURL string, groups ...string) (state, code string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL without a PKCE challenge: %s", authURL)
+	}
+	code = "code-" + q.Get("state")
+	idp.mu.Lock()
+	idp.codes[code] = testLogin{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), groups: groups}
+	idp.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mu.Lock()
+	login, exists := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !exists:
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != login.challenge:
+		http.Error(w, `{"error":"invalid_grant","error_description":"code_verifier does not match"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := idp.baseClaims("alice", login.groups)
+	claims["nonce"] = login.nonce
+	idp.mu.Lock()
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+	idp.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims, idp.kid), "token_type": "Bearer"})
+}
+
+func (idp *testIdP) baseClaims(user string, groups []string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":                idp.server.URL,
+		"sub":                "sub-" + user,
+		"aud":                "fail2rest",
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"jti":                "jti-" + user,
+		"preferred_username": user,
+		"groups":             groups,
+	}
+}
+
+func (idp *testIdP) sign(claims jwt.MapClaims, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func (idp *testIdP) provider() *OIDCProvider {
+	return NewOIDCProvider(OIDCConfig{
+		Issuer:        idp.server.URL,
+		ClientID:      "fail2rest",
+		RedirectURL:   "https://fail2rest.example/api/v1/auth/oidc/callback",
+		Scopes:        []string{"openid", "profile", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		GroupScopes: []GroupScope{
+			{Group: "ops", Scope: Scope{Roles: []string{RoleAdmin}}},
+			{Group: "web", Scope: Scope{Roles: []string{RoleOperator}, Jails: []string{"nginx-*"}}},
+		},
+	})
+}
+
+func TestOIDCExchange(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	authURL, err := p.AuthCodeURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Fatalf("authorization URL %s is not the discovered endpoint", authURL)
+	}
+	state, code := idp.approve(t, authURL, "web")
+
+	identity, err := p.Exchange(ctx, state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Principal: "oidc:alice", Method: MethodOIDC, Roles: []string{RoleOperator}, Jails: []string{"nginx-*"}}
+	if !reflect.DeepEqual(identity, want) {
+		t.Errorf("Exchange() = %+v, want %+v", identity, want)
+	}
+
+	// A state can only be used once
+	if _, err := p.Exchange(ctx, state, code); !errors.Is(err, ErrOIDCState) {
+		t.Errorf("reused state: error = %v, want ErrOIDCState", err)
+	}
+	if _, err := p.Exchange(ctx, "made-up", code); !errors.Is(err, ErrOIDCState) {
+		t.Errorf("unknown state: error = %v, want ErrOIDCState", err)
+	}
+}
+
+func TestOIDCExchangeRejects(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		tamper func(idp *testIdP, code string)
+		claims jwt.MapClaims
+		want   string
+	}{
+		{
+			name: "PKCE verifier mismatch",
+			tamper: func(idp *testIdP, code string) {
+				login := idp.codes[code]
+				login.challenge = "something-else"
+				idp.codes[code] = login
+			},
+			want: "code_verifier does not match",
+		},
+		{name: "nonce mismatch", claims: jwt.MapClaims{"nonce": "replayed"}, want: "nonce mismatch"},
+		{name: "missing nonce", claims: jwt.MapClaims{"nonce": nil}, want: "nonce mismatch"},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "another-client"}, want: "audience"},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://evil.example"}, want: "issuer"},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, want: "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			idp.claims = tt.claims
+			p := idp.provider()
+
+			authURL, err := p.AuthCodeURL(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, code := idp.approve(t, authURL, "ops")
+			if tt.tamper != nil {
+				tt.tamper(idp, code)
+			}
+			if _, err := p.Exchange(ctx, state, code); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Exchange() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyBearer(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	identity, err := p.VerifyBearer(ctx, idp.sign(idp.baseClaims("bob", []string{"ops"}), idp.kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Principal != "oidc:bob" || identity.TokenID != "jti-bob" || identity.ExpiresAt == nil {
+		t.Errorf("VerifyBearer() = %+v", identity)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.baseClaims("bob", []string{"ops"}))
+	forged.Header["kid"] = idp.kid
+	forgedToken, _ := forged.SignedString(other)
+
+	withClaims := func(changes jwt.MapClaims) string {
+		claims := idp.baseClaims("bob", []string{"ops"})
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return idp.sign(claims, idp.kid)
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"unknown kid", idp.sign(idp.baseClaims("bob", []string{"ops"}), "key-2")},
+		{"wrong key", forgedToken},
+		{"wrong audience", withClaims(jwt.MapClaims{"aud": "another-client"})},
+		{"wrong issuer", withClaims(jwt.MapClaims{"iss": "https://evil.example"})},
+		{"expired", withClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})},
+		{"no expiry", withClaims(jwt.MapClaims{"exp": nil})},
+		{"no mapped group", withClaims(jwt.MapClaims{"groups": []string{"guests"}})},
+	}
+	for _, tt := range tests {
+		if _, err := p.VerifyBearer(ctx, tt.token); err == nil {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.baseClaims("bob", []string{"ops"}))
+	hsToken, _ := hs.SignedString([]byte("guessable"))
+	if _, err := p.VerifyBearer(ctx, hsToken); err == nil {
+		t.Error("HS256 token accepted")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdP(t)
+	p := idp.provider()
+	if _, err := p.VerifyBearer(ctx, idp.sign(idp.baseClaims("bob", []string{"ops"}), idp.kid)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider switches to a new key
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.key, idp.kid = key, "key-2"
+	idp.mu.Unlock()
+	token := idp.sign(idp.baseClaims("bob", []string{"ops"}), "key-2")
+
+	// Right after a fetch, unknown keys do not cause another one
+	if _, err := p.VerifyBearer(ctx, token); err == nil {
+		t.Fatal("token with an unknown key accepted before refetching")
+	}
+	p.mu.Lock()
+	p.keysFetched = time.Now().Add(-oidcKeysMinRefresh - time.Second)
+	p.mu.Unlock()
+	if _, err := p.VerifyBearer(ctx, token); err != nil {
+		t.Errorf("token with the new key refused after refetching: %v", err)
+	}
+}
+
+func TestOIDCGroupMapping(t *testing.T) {
+	viewer := Scope{Roles: []string{RoleViewer}}
+	mappings := []GroupScope{
+		{Group: "ops", Scope: Scope{Roles: []string{RoleAdmin}}},
+		{Group: "web", Scope: Scope{Roles: []string{RoleOperator}, Jails: []string{"nginx-*"}}},
+	}
+	tests := []struct {
+		name         string
+		defaultScope *Scope
+		groups       interface{}
+		want         []string
+		wantJails    []string
+		refused      bool
+	}{
+		{name: "single group", groups: []interface{}{"web"}, want: []string{RoleOperator}, wantJails: []string{"nginx-*"}},
+		{name: "first mapping wins", groups: []interface{}{"web", "ops"}, want: []string{RoleAdmin}},
+		{name: "string claim", groups: "ops", want: []string{RoleAdmin}},
+		{name: "unmapped group", groups: []interface{}{"guests"}, refused: true},
+		{name: "no groups", groups: nil, refused: true},
+		{name: "case sensitive", groups: []interface{}{"OPS"}, refused: true},
+		{name: "default scope", defaultScope: &viewer, groups: []interface{}{"guests"}, want: []string{RoleViewer}},
+	}
+	for _, tt := range tests {
+		p := NewOIDCProvider(OIDCConfig{
+			Issuer:        "https://idp.example",
+			ClientID:      "fail2rest",
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			GroupScopes:   mappings,
+			DefaultScope:  tt.defaultScope,
+		})
+		identity, err := p.identity(jwt.MapClaims{"preferred_username": "carol", "groups": tt.groups})
+		if tt.refused {
+			if !errors.Is(err, ErrOIDCNoRole) {
+				t.Errorf("%s: error = %v, want ErrOIDCNoRole", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(identity.Roles, tt.want) || !reflect.DeepEqual(identity.Jails, tt.wantJails) {
+			t.Errorf("%s: roles %v jails %v, want %v %v", tt.name, identity.Roles, identity.Jails, tt.want, tt.wantJails)
+		}
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.issuer = "https://evil.example"
+	if _, err := idp.provider().AuthCodeURL(context.Background()); err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("AuthCodeURL() error = %v, want an issuer mismatch", err)
+	}
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles, from least to most privileged. Each role includes the permissions
+// of the roles before it.
+const (
+	RoleStats    = "stats"    // read status and statistics, without banned addresses
+	RoleViewer   = "viewer"   // also read jails, bans, IP lookups and ignore lists
+	RoleOperator = "operator" // also ban and unban IPs and edit ignore lists
+	RoleAdmin    = "admin"    // also control jails, change settings and read the audit log
+)
+
+var roleLevels = map[string]int{
+	RoleStats:    1,
+	RoleViewer:   2,
+	RoleOperator: 3,
+	RoleAdmin:    4,
+}
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	return roleLevels[role] > 0
+}
+
+// ContextScope is the gin context key holding the Scope of the caller
+const ContextScope = "scope"
+
+// Scope is what a principal may do: its roles, and the jails it may act on
+// as glob patterns (e.g. "nginx-*"). No jail patterns means every jail.
+type Scope struct {
+	Roles []string `json:"roles"`
+	Jails []string `json:"jails,omitempty"`
+}
+
+// HasRole reports whether the scope grants role, directly or through a more
+// privileged role
+func (s Scope) HasRole(role string) bool {
+	want := roleLevels[role]
+	for _, r := range s.Roles {
+		if roleLevels[r] >= want {
+			return true
+		}
+	}
+	return false
+}
+
+// AllJails reports whether the scope covers every jail
+func (s Scope) AllJails() bool {
+	return len(s.Jails) == 0
+}
+
+// AllowsJail reports whether the scope covers jail
+func (s Scope) AllowsJail(jail string) bool {
+	if s.AllJails() {
+		return true
+	}
+	for _, pattern := range s.Jails {
+		if ok, _ := path.Match(pattern, jail); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterJails returns the jails the scope covers
+func (s Scope) FilterJails(jails []string) []string {
+	if s.AllJails() {
+		return jails
+	}
+	allowed := []string{}
+	for _, jail := range jails {
+		if s.AllowsJail(jail) {
+			allowed = append(allowed, jail)
+		}
+	}
+	return allowed
+}
+
+// ScopeFromContext returns the scope of the authenticated caller. Requests
+// that did not pass the auth middleware get an empty scope.
+func ScopeFromContext(c *gin.Context) Scope {
+	if value, ok := c.Get(ContextScope); ok {
+		if scope, ok := value.(Scope); ok {
+			return scope
+		}
+	}
+	return Scope{}
+}
+
+// RequireRole rejects callers whose scope does not grant role. It must run
+// after Middleware.
+func (a *AuthService) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ScopeFromContext(c).HasRole(role) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   "This operation requires the " + role + " role",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
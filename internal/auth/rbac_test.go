@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestScopeHasRole(t *testing.T) {
+	tests := []struct {
+		roles []string
+		role  string
+		want  bool
+	}{
+		{[]string{RoleStats}, RoleStats, true},
+		{[]string{RoleStats}, RoleViewer, false},
+		{[]string{RoleViewer}, RoleStats, true},
+		{[]string{RoleViewer}, RoleViewer, true},
+		{[]string{RoleViewer}, RoleOperator, false},
+		{[]string{RoleOperator}, RoleViewer, true},
+		{[]string{RoleOperator}, RoleAdmin, false},
+		{[]string{RoleAdmin}, RoleOperator, true},
+		{[]string{RoleViewer, RoleAdmin}, RoleAdmin, true},
+		{[]string{"root"}, RoleViewer, false},
+		{nil, RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := (Scope{Roles: tt.roles}).HasRole(tt.role); got != tt.want {
+			t.Errorf("Scope%v.HasRole(%s) = %v, want %v", tt.roles, tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestScopeAllowsJail(t *testing.T) {
+	tests := []struct {
+		jails []string
+		jail  string
+		want  bool
+	}{
+		{nil, "sshd", true},
+		{[]string{"sshd"}, "sshd", true},
+		{[]string{"sshd"}, "sshd-ddos", false},
+		{[]string{"nginx-*"}, "nginx-http-auth", true},
+		{[]string{"nginx-*"}, "nginx", false},
+		{[]string{"nginx-*"}, "apache-auth", false},
+		{[]string{"*-auth"}, "apache-auth", true},
+		{[]string{"postfix?"}, "postfix1", true},
+		{[]string{"postfix?"}, "postfix12", false},
+		{[]string{"[ab]*"}, "apache", true},
+		{[]string{"[ab]*"}, "sshd", false},
+		{[]string{"sshd", "nginx-*"}, "nginx-botsearch", true},
+		{[]string{"*"}, "anything", true},
+		{[]string{"["}, "[", false}, // malformed patterns match nothing
+	}
+	for _, tt := range tests {
+		if got := (Scope{Jails: tt.jails}).AllowsJail(tt.jail); got != tt.want {
+			t.Errorf("Scope%v.AllowsJail(%s) = %v, want %v", tt.jails, tt.jail, got, tt.want)
+		}
+	}
+}
+
+func TestScopeFilterJails(t *testing.T) {
+	jails := []string{"sshd", "nginx-http-auth", "nginx-botsearch", "postfix"}
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{nil, jails},
+		{[]string{"nginx-*"}, []string{"nginx-http-auth", "nginx-botsearch"}},
+		{[]string{"sshd", "post*"}, []string{"sshd", "postfix"}},
+		{[]string{"apache-*"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := (Scope{Jails: tt.patterns}).FilterJails(jails); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterJails with %v = %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	tests := []struct {
+		scope Scope
+		ok    bool
+	}{
+		{Scope{Roles: []string{RoleViewer}}, true},
+		{Scope{Roles: []string{RoleOperator}, Jails: []string{"nginx-*", "sshd"}}, true},
+		{Scope{}, false},
+		{Scope{Roles: []string{"root"}}, false},
+		{Scope{Roles: []string{RoleAdmin}, Jails: []string{""}}, false},
+		{Scope{Roles: []string{RoleAdmin}, Jails: []string{"nginx-["}}, false},
+	}
+	for _, tt := range tests {
+		err := validateScope(tt.scope)
+		if tt.ok && err != nil {
+			t.Errorf("validateScope(%+v): %v", tt.scope, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrAccountInvalid) {
+			t.Errorf("validateScope(%+v) = %v, want ErrAccountInvalid", tt.scope, err)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a := &AuthService{}
+	tests := []struct {
+		scope *Scope
+		want  int
+	}{
+		{&Scope{Roles: []string{RoleOperator}}, http.StatusOK},
+		{&Scope{Roles: []string{RoleAdmin}}, http.StatusOK},
+		{&Scope{Roles: []string{RoleViewer}}, http.StatusForbidden},
+		{nil, http.StatusForbidden}, // did not pass the auth middleware
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			if tt.scope != nil {
+				c.Set(ContextScope, *tt.scope)
+			}
+		}, a.RequireRole(RoleOperator), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != tt.want {
+			t.Errorf("RequireRole(operator) with %+v = %d, want %d", tt.scope, w.Code, tt.want)
+		}
+	}
+}
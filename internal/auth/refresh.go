@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errors returned when redeeming a refresh token
+var (
+	ErrRefreshInvalid = errors.New("invalid or expired refresh token")
+	ErrRefreshReused  = errors.New("refresh token was already used")
+)
+
+// RefreshStore holds refresh tokens, persisted to a file. Each login starts
+// a family of refresh tokens; redeeming one replaces it with the next in the
+// family. Only hashes of the tokens are stored.
+type RefreshStore struct {
+	path   string
+	expiry time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*refreshToken // token hash -> token
+}
+
+type refreshToken struct {
+	Hash      string     `json:"hash"`
+	Family    string     `json:"family"`
+	Identity  Identity   `json:"identity"` // caller and access token issued with the refresh token
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"` // kept after use to detect replays
+}
+
+// NewRefreshStore creates a store persisting to path, loading any tokens
+// saved there. Refresh tokens are valid for expiry after they are issued.
+func NewRefreshStore(path string, expiry time.Duration) (*RefreshStore, error) {
+	s := &RefreshStore{
+		path:   path,
+		expiry: expiry,
+		tokens: make(map[string]*refreshToken),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read refresh tokens: %w", err)
+	}
+
+	var tokens []*refreshToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse refresh tokens %s: %w", path, err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.Hash] = t
+	}
+	return s, nil
+}
+
+// Issue returns a new refresh token for identity in family and its expiry
+func (s *RefreshStore) Issue(family string, identity Identity) (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	t := &refreshToken{
+		Hash:      hashRefreshToken(token),
+		Family:    family,
+		Identity:  identity,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.expiry),
+	}
+	s.tokens[t.Hash] = t
+	if err := s.save(); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, t.ExpiresAt, nil
+}
+
+// Redeem marks a refresh token as used and returns its family and identity.
+// Redeeming a token a second time revokes its whole family, since either
+// the legitimate client or an attacker holds a stolen copy; the identities
+// of the family are returned with ErrRefreshReused so their access tokens
+// can be revoked as well.
+func (s *RefreshStore) Redeem(token string) (string, []Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, exists := s.tokens[hashRefreshToken(token)]
+	now := time.Now()
+	if !exists || !now.Before(t.ExpiresAt) {
+		return "", nil, ErrRefreshInvalid
+	}
+
+	if t.UsedAt != nil {
+		identities := s.dropFamily(t.Family)
+		if err := s.save(); err != nil {
+			return "", nil, err
+		}
+		return t.Family, identities, ErrRefreshReused
+	}
+
+	t.UsedAt = &now
+	if err := s.save(); err != nil {
+		return "", nil, err
+	}
+	return t.Family, []Identity{t.Identity}, nil
+}
+
+// RevokeFamily removes every token of a family, returning the identities
+// they were issued to
+func (s *RefreshStore) RevokeFamily(family string) ([]Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identities := s.dropFamily(family)
+	if len(identities) == 0 {
+		return nil, nil
+	}
+	return identities, s.save()
+}
+
+// RevokePrincipal removes every token issued to principal
+func (s *RefreshStore) RevokePrincipal(principal string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, t := range s.tokens {
+		if t.Identity.Principal == principal {
+			delete(s.tokens, hash)
+		}
+	}
+	return s.save()
+}
+
+// dropFamily removes the tokens of a family. The caller must hold s.mu.
+func (s *RefreshStore) dropFamily(family string) []Identity {
+	var identities []Identity
+	for hash, t := range s.tokens {
+		if t.Family == family {
+			identities = append(identities, t.Identity)
+			delete(s.tokens, hash)
+		}
+	}
+	return identities
+}
+
+// save drops expired tokens and writes the rest to disk. The caller must
+// hold s.mu.
+func (s *RefreshStore) save() error {
+	now := time.Now()
+	tokens := make([]*refreshToken, 0, len(s.tokens))
+	for hash, t := range s.tokens {
+		if !now.Before(t.ExpiresAt) {
+			delete(s.tokens, hash)
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].IssuedAt.Before(tokens[j].IssuedAt) })
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRefreshStoreRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "refresh_tokens.json")
+	s, err := NewRefreshStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := Identity{Principal: "user:alice", Method: MethodPassword, SessionID: "s1"}
+	first, _, err := s.Issue("s1", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := s.Issue("s1", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := s.Issue("s2", Identity{Principal: "user:bob", SessionID: "s2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens are stored hashed and survive a restart
+	if _, stored := s.tokens[first]; stored {
+		t.Error("refresh token stored in clear")
+	}
+	if s, err = NewRefreshStore(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		family string
+		want   error
+	}{
+		{"first use", first, "s1", nil},
+		{"unknown token", "not-a-token", "", ErrRefreshInvalid},
+		{"reuse revokes the family", first, "s1", ErrRefreshReused},
+		{"rest of the family is gone", second, "", ErrRefreshInvalid},
+		{"other family unaffected", other, "s2", nil},
+	}
+	for _, tt := range tests {
+		family, identities, err := s.Redeem(tt.token)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if family != tt.family {
+			t.Errorf("%s: family = %q, want %q", tt.name, family, tt.family)
+		}
+		if tt.want == ErrRefreshReused && len(identities) != 2 {
+			t.Errorf("%s: returned %d identities, want the 2 of the family", tt.name, len(identities))
+		}
+	}
+}
+
+func TestRefreshStoreExpiry(t *testing.T) {
+	s, err := NewRefreshStore(filepath.Join(t.TempDir(), "refresh_tokens.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, expiresAt, err := s.Issue("s1", Identity{Principal: "user:alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(expiresAt); until <= 0 || until > time.Hour {
+		t.Errorf("expires in %v, want up to an hour", until)
+	}
+
+	s.tokens[hashRefreshToken(token)].ExpiresAt = time.Now().Add(-time.Second)
+	if _, _, err := s.Redeem(token); !errors.Is(err, ErrRefreshInvalid) {
+		t.Errorf("expired token: error = %v, want ErrRefreshInvalid", err)
+	}
+	if err := s.RevokePrincipal("user:nobody"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tokens) != 0 {
+		t.Errorf("save() kept %d expired tokens", len(s.tokens))
+	}
+}
+
+func testRefreshService(t *testing.T) *AuthService {
+	t.Helper()
+	dir := t.TempDir()
+	refresh, err := NewRefreshStore(filepath.Join(dir, "refresh_tokens.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations, err := NewRevocationList(filepath.Join(dir, "revoked_tokens.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAuthService("secret", time.Minute, AuthConfig{
+		Users: map[string]User{
+			"alice": {Username: "alice", Scope: Scope{Roles: []string{RoleOperator}}},
+		},
+		Refresh:     refresh,
+		Revocations: revocations,
+	})
+}
+
+func TestRefreshReuseEndsSession(t *testing.T) {
+	a := testRefreshService(t)
+	login, err := a.IssueTokens(Identity{Principal: "user:alice", Method: MethodPassword, Roles: []string{RoleOperator}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.RefreshToken == "" || login.Identity.SessionID == "" {
+		t.Fatalf("login tokens = %+v, want a refresh token and session", login)
+	}
+
+	refreshed, err := a.Refresh(login.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Identity.SessionID != login.Identity.SessionID || refreshed.RefreshToken == login.RefreshToken {
+		t.Errorf("refresh did not rotate within the session: %+v", refreshed)
+	}
+	if _, err := a.ValidateToken(refreshed.AccessToken); err != nil {
+		t.Fatalf("refreshed access token: %v", err)
+	}
+
+	// Replaying the first refresh token ends the session: the latest refresh
+	// token and every access token issued in the session stop working
+	if _, err := a.Refresh(login.RefreshToken); !errors.Is(err, ErrRefreshReused) {
+		t.Fatalf("replayed refresh token: error = %v, want ErrRefreshReused", err)
+	}
+	if _, err := a.Refresh(refreshed.RefreshToken); !errors.Is(err, ErrRefreshInvalid) {
+		t.Errorf("latest refresh token after replay: error = %v, want ErrRefreshInvalid", err)
+	}
+	for _, token := range []string{login.AccessToken, refreshed.AccessToken} {
+		if _, err := a.ValidateToken(token); !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("access token after replay: error = %v, want ErrTokenRevoked", err)
+		}
+	}
+}
+
+func TestRefreshLooksUpScope(t *testing.T) {
+	a := testRefreshService(t)
+	login, err := a.IssueTokens(Identity{Principal: "user:alice", Method: MethodPassword, Roles: []string{RoleAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := a.Refresh(login.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles := refreshed.Identity.Roles; len(roles) != 1 || roles[0] != RoleOperator {
+		t.Errorf("refreshed roles = %v, want the current [operator]", roles)
+	}
+
+	// Principals that no longer exist cannot refresh
+	login, err = a.IssueTokens(Identity{Principal: "user:mallory", Method: MethodPassword, Roles: []string{RoleAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Refresh(login.RefreshToken); !errors.Is(err, ErrRefreshInvalid) {
+		t.Errorf("refresh of a removed user: error = %v, want ErrRefreshInvalid", err)
+	}
+	if _, err := a.ValidateToken(login.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("access token of a removed user: error = %v, want ErrTokenRevoked", err)
+	}
+
+	// OpenID Connect logins get no refresh token
+	tokens, err := a.IssueTokens(Identity{Principal: "oidc:carol", Method: MethodOIDC, Roles: []string{RoleViewer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.RefreshToken != "" {
+		t.Error("OpenID Connect login was issued a refresh token")
+	}
+}
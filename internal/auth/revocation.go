@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTokenRevoked is returned by ValidateToken for tokens that were revoked
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// RevocationList holds revoked tokens, persisted to a file. A token is
+// revoked by its ID, or together with every other token of its principal
+// issued up to a cutoff time. Entries are dropped once every token they
+// cover would have expired anyway.
+type RevocationList struct {
+	path   string
+	maxAge time.Duration // lifetime of the longest-lived token
+
+	mu         sync.Mutex
+	tokens     map[string]time.Time // token ID -> token expiry
+	principals map[string]time.Time // principal -> revocation cutoff
+}
+
+type revokedToken struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type revokedPrincipal struct {
+	Principal string    `json:"principal"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+type revocationFile struct {
+	Tokens     []revokedToken     `json:"tokens"`
+	Principals []revokedPrincipal `json:"principals"`
+}
+
+// NewRevocationList creates a list persisting to path, loading any entries
+// saved there. maxAge is the lifetime of the longest-lived token issued.
+func NewRevocationList(path string, maxAge time.Duration) (*RevocationList, error) {
+	l := &RevocationList{
+		path:       path,
+		maxAge:     maxAge,
+		tokens:     make(map[string]time.Time),
+		principals: make(map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revoked tokens: %w", err)
+	}
+
+	var saved revocationFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse revoked tokens %s: %w", path, err)
+	}
+	for _, t := range saved.Tokens {
+		l.tokens[t.ID] = t.ExpiresAt
+	}
+	for _, p := range saved.Principals {
+		l.principals[p.Principal] = p.RevokedAt
+	}
+	return l, nil
+}
+
+// RevokeToken revokes the token with the given ID until it expires
+func (l *RevocationList) RevokeToken(tokenID string, expiresAt time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens[tokenID] = expiresAt
+	return l.save()
+}
+
+// RevokePrincipal revokes every token of principal issued until now
+func (l *RevocationList) RevokePrincipal(principal string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.principals[principal] = time.Now()
+	return l.save()
+}
+
+// IsRevoked reports whether the token with the given ID, issued to principal
+// at issuedAt, has been revoked
+func (l *RevocationList) IsRevoked(tokenID, principal string, issuedAt time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, revoked := l.tokens[tokenID]; revoked {
+		return true
+	}
+	// Issue times have a one second resolution, so a token issued in the
+	// same second as the cutoff is revoked as well
+	if cutoff, revoked := l.principals[principal]; revoked {
+		return !issuedAt.After(cutoff)
+	}
+	return false
+}
+
+// save drops entries that no longer cover an unexpired token and writes the
+// rest to disk. The caller must hold l.mu.
+func (l *RevocationList) save() error {
+	now := time.Now()
+	saved := revocationFile{
+		Tokens:     []revokedToken{},
+		Principals: []revokedPrincipal{},
+	}
+	for id, expiresAt := range l.tokens {
+		if now.After(expiresAt) {
+			delete(l.tokens, id)
+			continue
+		}
+		saved.Tokens = append(saved.Tokens, revokedToken{ID: id, ExpiresAt: expiresAt})
+	}
+	for principal, cutoff := range l.principals {
+		if now.After(cutoff.Add(l.maxAge)) {
+			delete(l.principals, principal)
+			continue
+		}
+		saved.Principals = append(saved.Principals, revokedPrincipal{Principal: principal, RevokedAt: cutoff})
+	}
+	sort.Slice(saved.Tokens, func(i, j int) bool { return saved.Tokens[i].ID < saved.Tokens[j].ID })
+	sort.Slice(saved.Principals, func(i, j int) bool { return saved.Principals[i].Principal < saved.Principals[j].Principal })
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path, data)
+}
+
+// writeFileAtomic replaces path with data, so a crash never leaves a
+// partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	return nil
+}
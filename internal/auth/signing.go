@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is an asymmetric key tokens are signed or verified with. Keys
+// without a private key only verify tokens, e.g. while being rotated out.
+type SigningKey struct {
+	ID      string // "kid" header of the tokens it signs
+	Method  jwt.SigningMethod
+	Private crypto.PrivateKey // nil for keys that only verify
+	Public  crypto.PublicKey
+}
+
+// CanSign reports whether the key can sign new tokens
+func (k SigningKey) CanSign() bool {
+	return k.Private != nil
+}
+
+// JWK returns the public key in JWK form
+func (k SigningKey) JWK() (JWK, error) {
+	jwk, err := NewJWK(k.ID, k.Public)
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk.Alg = k.Method.Alg()
+	return jwk, nil
+}
+
+// LoadSigningKey reads a PEM private or public key from path. algorithm may
+// be empty to use the default for the key type: RS256 for RSA, ES256,
+// ES384 or ES512 for EC keys by curve, and EdDSA for Ed25519.
+func LoadSigningKey(kid, algorithm, path string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	key := SigningKey{ID: kid}
+	if strings.Contains(block.Type, "PUBLIC KEY") {
+		key.Public, err = parsePublicKey(block)
+	} else {
+		key.Private, err = parsePrivateKey(block)
+		if signer, ok := key.Private.(crypto.Signer); ok {
+			key.Public = signer.Public()
+		}
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	key.Method, err = signingMethod(algorithm, key.Public)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	return key, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func parsePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// signingMethod returns the method for algorithm, checking that it suits
+// the key, or the default method for the key
+func signingMethod(algorithm string, public crypto.PublicKey) (jwt.SigningMethod, error) {
+	var defaultAlg string
+	var methods []string
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must have at least 2048 bits")
+		}
+		defaultAlg = "RS256"
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().Name {
+		case "P-256":
+			defaultAlg = "ES256"
+		case "P-384":
+			defaultAlg = "ES384"
+		case "P-521":
+			defaultAlg = "ES512"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		methods = []string{defaultAlg}
+	case ed25519.PublicKey:
+		defaultAlg = "EdDSA"
+		methods = []string{defaultAlg}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	if algorithm == "" {
+		algorithm = defaultAlg
+	}
+	if !containsString(methods, algorithm) {
+		return nil, fmt.Errorf("algorithm %s does not suit the key (use %s)", algorithm, strings.Join(methods, ", "))
+	}
+	return jwt.GetSigningMethod(algorithm), nil
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes a PEM block to a file in dir, returning its path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustPKCS8(t *testing.T, key crypto.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func mustPKIX(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	weakRSA, _ := rsa.GenerateKey(rand.Reader, 1024)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	p256DER, _ := x509.MarshalECPrivateKey(p256)
+
+	rsaPKCS1 := writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	notPEM := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(notPEM, []byte("not a key"), 0600)
+
+	tests := []struct {
+		name      string
+		algorithm string
+		path      string
+		want      string // algorithm, or a substring of the error
+		canSign   bool
+	}{
+		{"RSA PKCS#1", "", rsaPKCS1, "RS256", true},
+		{"RSA with PSS", "PS384", rsaPKCS1, "PS384", true},
+		{"RSA PKCS#8", "RS512", writePEM(t, dir, "rsa8.pem", "PRIVATE KEY", mustPKCS8(t, rsaKey)), "RS512", true},
+		{"RSA public key", "", writePEM(t, dir, "rsa.pub", "PUBLIC KEY", mustPKIX(t, &rsaKey.PublicKey)), "RS256", false},
+		{"RSA PKCS#1 public key", "", writePEM(t, dir, "rsa1.pub", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)), "RS256", false},
+		{"P-256 SEC 1", "", writePEM(t, dir, "p256.pem", "EC PRIVATE KEY", p256DER), "ES256", true},
+		{"P-384 PKCS#8", "", writePEM(t, dir, "p384.pem", "PRIVATE KEY", mustPKCS8(t, p384)), "ES384", true},
+		{"Ed25519", "", writePEM(t, dir, "ed.pem", "PRIVATE KEY", mustPKCS8(t, edPrivate)), "EdDSA", true},
+		{"Ed25519 public key", "", writePEM(t, dir, "ed.pub", "PUBLIC KEY", mustPKIX(t, edPublic)), "EdDSA", false},
+		{"RSA below 2048 bits", "", writePEM(t, dir, "weak.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(weakRSA)), "at least 2048 bits", false},
+		{"P-224", "", writePEM(t, dir, "p224.pem", "PRIVATE KEY", mustPKCS8(t, p224)), "unsupported curve", false},
+		{"EC algorithm on RSA", "ES256", rsaPKCS1, "does not suit the key", false},
+		{"curve mismatch", "ES384", writePEM(t, dir, "p256b.pem", "EC PRIVATE KEY", p256DER), "does not suit the key", false},
+		{"HMAC algorithm", "HS256", rsaPKCS1, "does not suit the key", false},
+		{"not PEM", "", notPEM, "no PEM data", false},
+		{"unsupported block", "", writePEM(t, dir, "cert.pem", "CERTIFICATE", []byte{0}), "unsupported PEM block", false},
+	}
+	for _, tt := range tests {
+		key, err := LoadSigningKey("k1", tt.algorithm, tt.path)
+		if err != nil {
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if key.Method.Alg() != tt.want || key.CanSign() != tt.canSign || key.ID != "k1" || key.Public == nil {
+			t.Errorf("%s: got %s (can sign %v), want %s (can sign %v)", tt.name, key.Method.Alg(), key.CanSign(), tt.want, tt.canSign)
+		}
+	}
+}
+
+// signTestToken signs viewer claims for user:alice with method and key,
+// setting the kid header unless it is empty
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, &Claims{
+		Authorized: true,
+		Roles:      []string{RoleViewer},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "user:alice",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerificationKey(t *testing.T) {
+	current, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	retired, _ := rsa.GenerateKey(rand.Reader, 2048)
+	stranger, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := []SigningKey{
+		{ID: "current", Method: jwt.SigningMethodES256, Private: current, Public: &current.PublicKey},
+		{ID: "retired", Method: jwt.SigningMethodRS256, Public: &retired.PublicKey}, // verifies only
+	}
+	retiredPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustPKIX(t, &retired.PublicKey)})
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		ok     bool
+	}{
+		{"current key", "", signTestToken(t, jwt.SigningMethodES256, current, "current"), true},
+		{"retired key", "", signTestToken(t, jwt.SigningMethodRS256, retired, "retired"), true},
+		{"retired key with PSS", "", signTestToken(t, jwt.SigningMethodPS256, retired, "retired"), false},
+		{"kid of another key", "", signTestToken(t, jwt.SigningMethodES256, current, "retired"), false},
+		{"unknown kid", "", signTestToken(t, jwt.SigningMethodES256, stranger, "stranger"), false},
+		{"no kid", "", signTestToken(t, jwt.SigningMethodES256, current, ""), false},
+		{"wrong key for kid", "", signTestToken(t, jwt.SigningMethodES256, stranger, "current"), false},
+		{"none", "", signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "current"), false},
+		{"HS256 without a secret", "", signTestToken(t, jwt.SigningMethodHS256, []byte{}, ""), false},
+		{"HS256 keyed with the public key", "", signTestToken(t, jwt.SigningMethodHS256, retiredPEM, "retired"), false},
+		{"HS256 with the secret", "secret", signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), ""), true},
+		{"HS256 with another secret", "secret", signTestToken(t, jwt.SigningMethodHS256, []byte("guess"), ""), false},
+	}
+	for _, tt := range tests {
+		a := NewAuthService(tt.secret, time.Minute, AuthConfig{SigningKeys: keys})
+		claims, err := a.ValidateToken(tt.token)
+		if tt.ok && (err != nil || claims.Subject != "user:alice") {
+			t.Errorf("%s: ValidateToken() = %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: token was accepted", tt.name)
+		}
+	}
+}
+
+func TestGenerateTokenSigningKey(t *testing.T) {
+	current, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, retired, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []SigningKey{
+		{ID: "current", Method: jwt.SigningMethodES256, Private: current, Public: &current.PublicKey},
+		{ID: "retired", Method: jwt.SigningMethodEdDSA, Public: retired.Public()},
+	}
+	identity := Identity{Principal: "user:alice", Method: MethodPassword, Roles: []string{RoleViewer}}
+
+	// Tokens are signed with the first key, whatever the secret
+	a := NewAuthService("secret", time.Minute, AuthConfig{SigningKeys: keys})
+	signed, _, err := a.GenerateToken(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(signed, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Method.Alg() != "ES256" || token.Header["kid"] != "current" {
+		t.Errorf("token header = %v, want ES256 with kid current", token.Header)
+	}
+	if _, err := a.ValidateToken(signed); err != nil {
+		t.Errorf("ValidateToken(): %v", err)
+	}
+
+	// Every key is published, including those that only verify
+	set, err := a.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 || set.Keys[0].Kid != "current" || set.Keys[0].Alg != "ES256" || set.Keys[1].Alg != "EdDSA" {
+		t.Errorf("JWKS() = %+v", set)
+	}
+
+	// Without signing keys, tokens fall back to HS256 with the secret
+	a = NewAuthService("secret", time.Minute, AuthConfig{})
+	signed, _, err = a.GenerateToken(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _, _ := jwt.NewParser().ParseUnverified(signed, &Claims{}); token.Method.Alg() != "HS256" {
+		t.Errorf("token signed with %s, want HS256", token.Method.Alg())
+	}
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned when checking the second factor of a login
+var (
+	ErrTOTPRequired = errors.New("TOTP code required")
+	ErrTOTPInvalid  = errors.New("invalid TOTP or recovery code")
+)
+
+// TOTP parameters (RFC 6238), the defaults every authenticator app supports
+const (
+	totpPeriod      = 30 * time.Second
+	totpDigits      = 6
+	totpSkew        = 1 // steps accepted either side of the current one
+	totpSecretBytes = 20
+
+	// TOTPIssuer names the service in authenticator apps
+	TOTPIssuer = "fail2rest"
+
+	// RecoveryCodeCount is how many recovery codes enrollment produces
+	RecoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 TOTP secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// ValidateTOTPSecret checks that secret is valid base32 of a sensible length
+func ValidateTOTPSecret(secret string) error {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return errors.New("TOTP secret is not valid base32")
+	}
+	if len(key) < 10 {
+		return errors.New("TOTP secret is too short (at least 80 bits)")
+	}
+	return nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI authenticator apps enroll
+// with, usually shown as a QR code
+func TOTPProvisioningURI(secret, account, issuer string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode returns the code for a time step (RFC 4226 HOTP)
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step code is valid for at now, allowing for
+// clock skew
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// GenerateRecoveryCodes returns n one-time recovery codes and their bcrypt
+// hashes to store
+func GenerateRecoveryCodes(n int) (codes, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode strips the separators and case a recovery code may be
+// typed with
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// SecondFactorState records which TOTP time steps and recovery codes each
+// user has used, so neither can be replayed, persisted to a file
+type SecondFactorState struct {
+	path string
+
+	mu    sync.Mutex
+	users map[string]secondFactorUse // by username
+}
+
+type secondFactorUse struct {
+	LastStep     int64    `json:"last_step,omitempty"`
+	UsedRecovery []string `json:"used_recovery_codes,omitempty"` // hashes of used codes
+}
+
+// NewSecondFactorState creates a state persisting to path, loading any state
+// saved there
+func NewSecondFactorState(path string) (*SecondFactorState, error) {
+	s := &SecondFactorState{
+		path:  path,
+		users: make(map[string]secondFactorUse),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read second factor state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("failed to parse second factor state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// verify checks code for user as a TOTP code or, failing that, one of the
+// user's recovery codes, and marks it used
+func (s *SecondFactorState) verify(username string, user User, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	use := s.users[username]
+	code = strings.TrimSpace(code)
+
+	if step, ok := matchTOTP(user.TOTPSecret, code, time.Now()); ok {
+		if step <= use.LastStep {
+			return ErrTOTPInvalid
+		}
+		use.LastStep = step
+		s.users[username] = use
+		return s.save()
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	for _, hash := range user.RecoveryCodes {
+		if containsString(use.UsedRecovery, hash) {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(normalized)) == nil {
+			use.UsedRecovery = append(use.UsedRecovery, hash)
+			s.users[username] = use
+			return s.save()
+		}
+	}
+	return ErrTOTPInvalid
+}
+
+// remaining returns how many of the recovery codes have not been used
+func (s *SecondFactorState) remaining(username string, hashes []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, hash := range hashes {
+		if !containsString(s.users[username].UsedRecovery, hash) {
+			count++
+		}
+	}
+	return count
+}
+
+// save writes the state to disk. The caller must hold s.mu.
+func (s *SecondFactorState) save() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the RFC 6238 test vectors, in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, err := decodeTOTPSecret(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 6238 appendix B, truncated to our six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/30); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		secret string
+		code   string
+		step   int64
+		ok     bool
+	}{
+		{rfc6238Secret, "050471", 37037037, true},
+		{strings.ToLower(rfc6238Secret), "050471", 37037037, true},
+		{"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ", "050471", 37037037, true},
+		{rfc6238Secret, "081804", 37037036, true}, // previous step, within the skew
+		{rfc6238Secret, "287082", 0, false},       // far in the past
+		{rfc6238Secret, "000000", 0, false},
+		{rfc6238Secret, "50471", 0, false},
+		{"not base32!", "050471", 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := matchTOTP(tt.secret, tt.code, now)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("matchTOTP(%q, %s) = %d, %v; want %d, %v", tt.secret, tt.code, step, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+func TestValidateTOTPSecret(t *testing.T) {
+	tests := []struct {
+		secret string
+		ok     bool
+	}{
+		{rfc6238Secret, true},
+		{"GEZDGNBVGY3TQOJQ", true}, // 80 bits
+		{"GEZDGNBVGY3TQ", false},
+		{"GEZDGNBVGY3TQOJ1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateTOTPSecret(tt.secret); (err == nil) != tt.ok {
+			t.Errorf("ValidateTOTPSecret(%q) = %v", tt.secret, err)
+		}
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTOTPSecret(secret); err != nil {
+		t.Errorf("generated secret %q: %v", secret, err)
+	}
+}
+
+func testTOTPService(t *testing.T, path string, recovery []string) *AuthService {
+	t.Helper()
+	state, err := NewSecondFactorState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAuthService("secret", time.Minute, AuthConfig{
+		Users: map[string]User{
+			"alice": {Username: "alice", Scope: Scope{Roles: []string{RoleViewer}}, TOTPSecret: rfc6238Secret, RecoveryCodes: recovery},
+			"bob":   {Username: "bob", Scope: Scope{Roles: []string{RoleViewer}}},
+		},
+		TOTP: state,
+	})
+}
+
+func TestTOTPStepReplay(t *testing.T) {
+	a := testTOTPService(t, filepath.Join(t.TempDir(), "totp_state.json"), nil)
+	key, _ := decodeTOTPSecret(rfc6238Secret)
+	current := time.Now().Unix() / 30
+
+	if err := a.VerifySecondFactor("alice", ""); !errors.Is(err, ErrTOTPRequired) {
+		t.Errorf("no code: error = %v, want ErrTOTPRequired", err)
+	}
+	if err := a.VerifySecondFactor("bob", ""); err != nil {
+		t.Errorf("user without TOTP: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		step int64
+		want error
+	}{
+		{"current step", current, nil},
+		{"same step again", current, ErrTOTPInvalid},
+		{"earlier step after a later one", current - 1, ErrTOTPInvalid},
+		{"next step", current + 1, nil},
+		{"next step again", current + 1, ErrTOTPInvalid},
+	}
+	for _, tt := range tests {
+		if err := a.VerifySecondFactor("alice", totpCode(key, tt.step)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRecoveryCodeReuse(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 2 || len(codes[0]) != 11 || codes[0][5] != '-' {
+		t.Fatalf("recovery codes = %q, want two xxxxx-xxxxx codes", codes)
+	}
+
+	path := filepath.Join(t.TempDir(), "totp_state.json")
+	a := testTOTPService(t, path, hashes)
+	if left := a.RecoveryCodesLeft("alice"); left != 2 {
+		t.Errorf("RecoveryCodesLeft() = %d, want 2", left)
+	}
+
+	// Codes may be typed without the dash and in upper case
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if err := a.VerifySecondFactor("alice", typed); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if err := a.VerifySecondFactor("alice", codes[0]); !errors.Is(err, ErrTOTPInvalid) {
+		t.Errorf("reused recovery code: error = %v, want ErrTOTPInvalid", err)
+	}
+	if left := a.RecoveryCodesLeft("alice"); left != 1 {
+		t.Errorf("RecoveryCodesLeft() after use = %d, want 1", left)
+	}
+
+	// Used codes stay used after a restart
+	a = testTOTPService(t, path, hashes)
+	if err := a.VerifySecondFactor("alice", codes[0]); !errors.Is(err, ErrTOTPInvalid) {
+		t.Errorf("reused recovery code after restart: error = %v, want ErrTOTPInvalid", err)
+	}
+	if err := a.VerifySecondFactor("alice", codes[1]); err != nil {
+		t.Errorf("second recovery code: %v", err)
+	}
+	if err := a.VerifySecondFactor("bob", codes[1]); err != nil {
+		t.Errorf("user without TOTP: %v", err)
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	got := TOTPProvisioningURI(rfc6238Secret, "alice", TOTPIssuer)
+	want := "otpauth://totp/fail2rest:alice?algorithm=SHA1&digits=6&issuer=fail2rest&period=30&secret=" + rfc6238Secret
+	if got != want {
+		t.Errorf("TOTPProvisioningURI() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// usageSaveInterval limits how often key usage is written to disk, since it
+// changes on every request made with a key
+const usageSaveInterval = time.Minute
+
+// KeyUsage records when and from where each API key was last used,
+// persisted to a file
+type KeyUsage struct {
+	path string
+
+	mu      sync.Mutex
+	usage   map[string]Usage // by principal
+	dirty   bool
+	savedAt time.Time
+}
+
+// Usage is the last use of an API key
+type Usage struct {
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string    `json:"last_used_ip"`
+}
+
+// NewKeyUsage creates a usage record persisting to path, loading any usage
+// saved there
+func NewKeyUsage(path string) (*KeyUsage, error) {
+	u := &KeyUsage{
+		path:  path,
+		usage: make(map[string]Usage),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key usage: %w", err)
+	}
+	if err := json.Unmarshal(data, &u.usage); err != nil {
+		return nil, fmt.Errorf("failed to parse API key usage %s: %w", path, err)
+	}
+	return u, nil
+}
+
+// Record notes a use of the key of principal from clientIP. It is saved to
+// disk at most once per usageSaveInterval; call Flush on shutdown.
+func (u *KeyUsage) Record(principal, clientIP string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	u.usage[principal] = Usage{LastUsedAt: now, LastUsedIP: clientIP}
+	u.dirty = true
+	if now.Sub(u.savedAt) < usageSaveInterval {
+		return nil
+	}
+	return u.save()
+}
+
+// Get returns the last use of the key of principal
+func (u *KeyUsage) Get(principal string) (Usage, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage, exists := u.usage[principal]
+	return usage, exists
+}
+
+// Flush writes unsaved usage to disk
+func (u *KeyUsage) Flush() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.dirty {
+		return nil
+	}
+	return u.save()
+}
+
+// save writes the usage to disk. The caller must hold u.mu.
+func (u *KeyUsage) save() error {
+	data, err := json.MarshalIndent(u.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(u.path, data); err != nil {
+		return err
+	}
+	u.dirty = false
+	u.savedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,180 @@
+package bans
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metadata records who banned an IP through the API and why. Records of
+// bans that are over are kept as history for the store's retention.
+type Metadata struct {
+	Jail       string     `json:"jail"`
+	IP         string     `json:"ip"`
+	Reason     string     `json:"reason,omitempty"`
+	Ticket     string     `json:"ticket,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Principal  string     `json:"principal,omitempty"`
+	BannedAt   time.Time  `json:"banned_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`  // nil if permanent or unknown
+	EndedAt    *time.Time `json:"ended_at,omitempty"`    // set when unbanned or replaced by a new ban
+	UnbannedBy string     `json:"unbanned_by,omitempty"` // principal that lifted the ban
+}
+
+// expired reports whether the ban the metadata describes ran out, after
+// which fail2ban may ban the IP again on its own
+func (m *Metadata) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// Ended reports whether the ban is over, by an unban or by expiring
+func (m *Metadata) Ended(now time.Time) bool {
+	return m.EndedAt != nil || m.expired(now)
+}
+
+// endTime returns when an ended ban was over
+func (m *Metadata) endTime() time.Time {
+	if m.EndedAt != nil {
+		return *m.EndedAt
+	}
+	return *m.ExpiresAt
+}
+
+// MetadataStore keeps the metadata of manual bans, persisted to a file
+type MetadataStore struct {
+	path      string
+	retention time.Duration // how long records of ended bans are kept
+
+	mu      sync.Mutex
+	records []*Metadata // oldest first
+}
+
+// NewMetadataStore creates a store persisting to path, loading any records
+// saved there. Records of ended bans are kept for retention; zero keeps
+// none.
+func NewMetadataStore(path string, retention time.Duration) (*MetadataStore, error) {
+	s := &MetadataStore{
+		path:      path,
+		retention: retention,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ban metadata: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, fmt.Errorf("failed to parse ban metadata %s: %w", path, err)
+	}
+	sort.SliceStable(s.records, func(i, j int) bool {
+		return s.records[i].BannedAt.Before(s.records[j].BannedAt)
+	})
+	return s, nil
+}
+
+// Put records the metadata of a ban. A record of an earlier ban of the same
+// jail and IP still in place ends with it.
+func (s *MetadataStore) Put(m Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current := s.current(m.Jail, m.IP, m.BannedAt); current != nil {
+		endedAt := m.BannedAt
+		current.EndedAt = &endedAt
+	}
+	s.records = append(s.records, &m)
+	return s.save()
+}
+
+// Get returns the metadata of the current ban of ip in jail. Records of bans
+// that have since ended are not returned.
+func (s *MetadataStore) Get(jail, ip string) (Metadata, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.current(jail, ip, time.Now())
+	if m == nil {
+		return Metadata{}, false
+	}
+	return *m, true
+}
+
+// End records that the current ban of ip in jail, if any, was lifted by
+// principal
+func (s *MetadataStore) End(jail, ip, principal string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	m := s.current(jail, ip, now)
+	if m == nil {
+		return nil
+	}
+	m.EndedAt = &now
+	m.UnbannedBy = principal
+	return s.save()
+}
+
+// History returns the records of the current and past bans of ip in any
+// jail, newest first
+func (s *MetadataStore) History(ip string) []Metadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	history := []Metadata{}
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if s.records[i].IP == ip && !s.outdated(s.records[i], now) {
+			history = append(history, *s.records[i])
+		}
+	}
+	return history
+}
+
+// current returns the record of the ban of ip in jail in place at now. The
+// caller must hold s.mu.
+func (s *MetadataStore) current(jail, ip string, now time.Time) *Metadata {
+	for i := len(s.records) - 1; i >= 0; i-- {
+		m := s.records[i]
+		if m.Jail == jail && m.IP == ip {
+			if m.Ended(now) {
+				return nil
+			}
+			return m
+		}
+	}
+	return nil
+}
+
+// outdated reports whether m is the record of a ban that ended longer than
+// the retention ago
+func (s *MetadataStore) outdated(m *Metadata, now time.Time) bool {
+	return m.Ended(now) && !now.Before(m.endTime().Add(s.retention))
+}
+
+// save drops outdated records and writes the rest to disk. The caller must
+// hold s.mu.
+func (s *MetadataStore) save() error {
+	now := time.Now()
+	kept := s.records[:0]
+	for _, m := range s.records {
+		if s.outdated(m, now) {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	s.records = kept
+
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
@@ -0,0 +1,101 @@
+package bans
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ban_metadata.json")
+	s, err := NewMetadataStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	first := Metadata{Jail: "sshd", IP: "192.0.2.1", Reason: "first", Principal: "user:alice", BannedAt: now.Add(-2 * time.Minute)}
+	if err := s.Put(first); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := s.Get("sshd", "192.0.2.1"); !ok || m.Reason != "first" {
+		t.Fatalf("Get() = %+v, %v", m, ok)
+	}
+
+	// A new ban replaces the current one, which stays as history
+	second := Metadata{Jail: "sshd", IP: "192.0.2.1", Reason: "second", BannedAt: now.Add(-time.Minute)}
+	if err := s.Put(second); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := s.Get("sshd", "192.0.2.1"); !ok || m.Reason != "second" {
+		t.Fatalf("Get() after new ban = %+v, %v", m, ok)
+	}
+
+	if err := s.End("sshd", "192.0.2.1", "user:bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("sshd", "192.0.2.1"); ok {
+		t.Error("Get() returned a lifted ban")
+	}
+
+	history := s.History("192.0.2.1")
+	if len(history) != 2 {
+		t.Fatalf("History() returned %d records, want 2", len(history))
+	}
+	if history[0].Reason != "second" || history[0].EndedAt == nil || history[0].UnbannedBy != "user:bob" {
+		t.Errorf("lifted record = %+v", history[0])
+	}
+	if history[1].Reason != "first" || history[1].EndedAt == nil || !history[1].EndedAt.Equal(second.BannedAt) {
+		t.Errorf("replaced record = %+v", history[1])
+	}
+
+	// History survives a restart
+	reloaded, err := NewMetadataStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.History("192.0.2.1"); len(got) != 2 || got[0].Reason != "second" {
+		t.Errorf("reloaded History() = %+v", got)
+	}
+}
+
+func TestMetadataRetention(t *testing.T) {
+	s, err := NewMetadataStore(filepath.Join(t.TempDir(), "ban_metadata.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	longAgo := now.Add(-2 * time.Hour)
+	recently := now.Add(-time.Minute)
+
+	// Expired past the retention: dropped
+	s.Put(Metadata{Jail: "sshd", IP: "192.0.2.1", BannedAt: longAgo.Add(-time.Hour), ExpiresAt: &longAgo})
+	// Expired within the retention: kept but not current
+	s.Put(Metadata{Jail: "sshd", IP: "192.0.2.2", BannedAt: longAgo, ExpiresAt: &recently})
+	// Permanent: kept and current
+	s.Put(Metadata{Jail: "sshd", IP: "192.0.2.3", BannedAt: longAgo})
+
+	if got := s.History("192.0.2.1"); len(got) != 0 {
+		t.Errorf("record past the retention was kept: %+v", got)
+	}
+	if got := s.History("192.0.2.2"); len(got) != 1 {
+		t.Errorf("record within the retention was dropped")
+	}
+	if _, ok := s.Get("sshd", "192.0.2.2"); ok {
+		t.Error("Get() returned an expired ban")
+	}
+	if _, ok := s.Get("sshd", "192.0.2.3"); !ok {
+		t.Error("Get() did not return a permanent ban")
+	}
+
+	// Without retention, lifted bans are not kept
+	s, err = NewMetadataStore(filepath.Join(t.TempDir(), "ban_metadata.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(Metadata{Jail: "sshd", IP: "192.0.2.4", BannedAt: now})
+	s.End("sshd", "192.0.2.4", "user:bob")
+	if got := s.History("192.0.2.4"); len(got) != 0 {
+		t.Errorf("History() without retention = %+v", got)
+	}
+}
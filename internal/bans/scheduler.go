@@ -0,0 +1,276 @@
+package bans
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fail2rest/v2/internal/fail2ban"
+)
+
+// checkInterval is how often scheduled bans are compared against fail2ban
+const checkInterval = 30 * time.Second
+
+// Entry is a ban whose duration is maintained by the API rather than by
+// fail2ban
+type Entry struct {
+	Jail      string     `json:"jail"`
+	IP        string     `json:"ip"`
+	BannedAt  time.Time  `json:"banned_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil for permanent bans
+}
+
+// Permanent reports whether the ban never expires
+func (e *Entry) Permanent() bool {
+	return e.ExpiresAt == nil
+}
+
+// Scheduler keeps bans with an explicit duration for servers that cannot set
+// a bantime per ban. It unbans them when they expire, and bans them again if
+// fail2ban releases them earlier because the jail's bantime is shorter.
+// Entries are persisted so schedules survive restarts.
+type Scheduler struct {
+	backend fail2ban.Backend
+	path    string
+
+	mu      sync.Mutex
+	entries map[string]*Entry // jail + "|" + ip -> entry
+	wake    chan struct{}
+}
+
+// NewScheduler creates a scheduler persisting to path, loading any entries
+// saved there
+func NewScheduler(backend fail2ban.Backend, path string) (*Scheduler, error) {
+	s := &Scheduler{
+		backend: backend,
+		path:    path,
+		entries: make(map[string]*Entry),
+		wake:    make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled bans: %w", err)
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse scheduled bans %s: %w", path, err)
+	}
+	for _, e := range entries {
+		s.entries[entryKey(e.Jail, e.IP)] = e
+	}
+	return s, nil
+}
+
+func entryKey(jail, ip string) string {
+	return jail + "|" + ip
+}
+
+// Schedule records a ban of ip in jail lasting until expiresAt (nil for a
+// permanent ban), replacing any earlier schedule for it
+func (s *Scheduler) Schedule(jail, ip string, bannedAt time.Time, expiresAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[entryKey(jail, ip)] = &Entry{
+		Jail:      jail,
+		IP:        ip,
+		BannedAt:  bannedAt,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+
+	// The new ban may expire before the next planned check
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Cancel forgets the schedule of ip in jail, if any. It must be called when a
+// ban is lifted or replaced so the scheduler does not ban the IP again.
+func (s *Scheduler) Cancel(jail, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := entryKey(jail, ip)
+	if _, exists := s.entries[key]; !exists {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.save()
+}
+
+// Lookup returns the schedule of ip in jail
+func (s *Scheduler) Lookup(jail, ip string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, exists := s.entries[entryKey(jail, ip)]
+	if !exists {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Run enforces the schedules until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		s.check(ctx)
+
+		timer := time.NewTimer(s.nextCheck())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// nextCheck returns the time until the next expiry or regular check
+func (s *Scheduler) nextCheck() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wait := checkInterval
+	now := time.Now()
+	for _, e := range s.entries {
+		if e.ExpiresAt != nil {
+			if until := e.ExpiresAt.Sub(now); until < wait {
+				wait = until
+			}
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// check unbans expired entries and bans again those fail2ban released early
+func (s *Scheduler) check(ctx context.Context) {
+	now := time.Now()
+
+	s.mu.Lock()
+	byJail := make(map[string][]Entry)
+	for _, e := range s.entries {
+		byJail[e.Jail] = append(byJail[e.Jail], *e)
+	}
+	s.mu.Unlock()
+
+	jails := make([]string, 0, len(byJail))
+	for jail := range byJail {
+		jails = append(jails, jail)
+	}
+	sort.Strings(jails)
+
+	for _, jail := range jails {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A jail that is stopped or unreachable keeps its schedules until
+		// it can be checked again
+		banned, err := s.backend.GetBannedIPs(ctx, jail)
+		if err != nil {
+			continue
+		}
+		isBanned := make(map[string]bool)
+		for _, ip := range banned {
+			isBanned[ip] = true
+		}
+
+		for _, e := range byJail[jail] {
+			s.enforce(ctx, e, isBanned[e.IP], now)
+		}
+	}
+}
+
+// enforce unbans an expired entry or bans again one fail2ban released early.
+// The entry is checked again and the backend called under s.mu, so a ban
+// cancelled or rescheduled since the entries were read is left alone.
+func (s *Scheduler) enforce(ctx context.Context, e Entry, banned bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := entryKey(e.Jail, e.IP)
+	if current, exists := s.entries[key]; !exists || !current.BannedAt.Equal(e.BannedAt) {
+		return
+	}
+
+	switch {
+	case e.ExpiresAt != nil && !now.Before(*e.ExpiresAt):
+		if banned {
+			if err := s.backend.UnbanIP(ctx, e.Jail, e.IP); err != nil {
+				log.Printf("Failed to lift expired ban of %s in %s: %v", e.IP, e.Jail, err)
+				return
+			}
+		}
+		delete(s.entries, key)
+		if err := s.save(); err != nil {
+			log.Printf("Failed to save scheduled bans: %v", err)
+		}
+	case !banned:
+		if err := s.backend.BanIP(ctx, e.Jail, e.IP); err != nil {
+			log.Printf("Failed to renew ban of %s in %s: %v", e.IP, e.Jail, err)
+		}
+	}
+}
+
+// save writes all entries to disk. The caller must hold s.mu.
+func (s *Scheduler) save() error {
+	entries := make([]*Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Jail != entries[j].Jail {
+			return entries[i].Jail < entries[j].Jail
+		}
+		return entries[i].IP < entries[j].IP
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces path with data so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package bans
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fail2rest/v2/internal/fail2ban"
+)
+
+func newTestScheduler(t *testing.T) (*Scheduler, *fail2ban.FakeBackend) {
+	t.Helper()
+	backend := fail2ban.NewFakeBackend([]string{"sshd"}, time.Hour)
+	s, err := NewScheduler(backend, filepath.Join(t.TempDir(), "scheduled.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, backend
+}
+
+func isBanned(t *testing.T, backend fail2ban.Backend, ip string) bool {
+	t.Helper()
+	banned, err := backend.GetBannedIPs(context.Background(), "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range banned {
+		if b == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSchedulerCheck(t *testing.T) {
+	ctx := context.Background()
+	s, backend := newTestScheduler(t)
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+
+	// Expired and still banned: lifted and forgotten
+	backend.BanIP(ctx, "sshd", "192.0.2.1")
+	s.Schedule("sshd", "192.0.2.1", now.Add(-time.Hour), &past)
+	// Released early by fail2ban: banned again
+	s.Schedule("sshd", "192.0.2.2", now, &future)
+	// Permanent and released: banned again
+	s.Schedule("sshd", "192.0.2.3", now, nil)
+
+	s.check(ctx)
+
+	if isBanned(t, backend, "192.0.2.1") {
+		t.Error("expired ban was not lifted")
+	}
+	if _, ok := s.Lookup("sshd", "192.0.2.1"); ok {
+		t.Error("expired entry was kept")
+	}
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		if !isBanned(t, backend, ip) {
+			t.Errorf("%s was not banned again", ip)
+		}
+		if _, ok := s.Lookup("sshd", ip); !ok {
+			t.Errorf("entry of %s was dropped", ip)
+		}
+	}
+}
+
+func TestSchedulerSkipsChangedEntries(t *testing.T) {
+	ctx := context.Background()
+	s, backend := newTestScheduler(t)
+	now := time.Now()
+	future := now.Add(time.Hour)
+
+	// Cancelled after check read it: not banned again
+	s.Schedule("sshd", "192.0.2.1", now, &future)
+	e, _ := s.Lookup("sshd", "192.0.2.1")
+	s.Cancel("sshd", "192.0.2.1")
+	s.enforce(ctx, e, false, now)
+	if isBanned(t, backend, "192.0.2.1") {
+		t.Error("cancelled ban was renewed")
+	}
+
+	// Rescheduled after check read it: the new ban is not lifted
+	past := now.Add(-time.Minute)
+	s.Schedule("sshd", "192.0.2.2", now.Add(-time.Hour), &past)
+	stale, _ := s.Lookup("sshd", "192.0.2.2")
+	backend.BanIP(ctx, "sshd", "192.0.2.2")
+	s.Schedule("sshd", "192.0.2.2", now, &future)
+	s.enforce(ctx, stale, true, now)
+	if !isBanned(t, backend, "192.0.2.2") {
+		t.Error("rescheduled ban was lifted")
+	}
+	if e, ok := s.Lookup("sshd", "192.0.2.2"); !ok || !e.BannedAt.Equal(now) {
+		t.Error("rescheduled entry was removed")
+	}
+}
+
+func TestSchedulerPersists(t *testing.T) {
+	backend := fail2ban.NewFakeBackend([]string{"sshd"}, time.Hour)
+	path := filepath.Join(t.TempDir(), "scheduled.json")
+	s, err := NewScheduler(backend, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.Schedule("sshd", "192.0.2.1", time.Now(), &expires); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewScheduler(backend, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := reloaded.Lookup("sshd", "192.0.2.1")
+	if !ok || e.ExpiresAt == nil || !e.ExpiresAt.Equal(expires) {
+		t.Errorf("reloaded entry = %+v, %v", e, ok)
+	}
+}
@@ -1,8 +1,18 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base32"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,6 +22,9 @@ type Config struct {
 	Server   ServerConfig   `yaml:"server"`
 	Auth     AuthConfig     `yaml:"auth"`
 	Fail2ban Fail2banConfig `yaml:"fail2ban"`
+	Bans     BansConfig     `yaml:"bans"`
+	Storage  StorageConfig  `yaml:"storage"`
+	Audit    AuditConfig    `yaml:"audit"`
 	Logging  LoggingConfig  `yaml:"logging"`
 }
 
@@ -19,29 +32,183 @@ type ServerConfig struct {
 	Host string    `yaml:"host"`
 	Port int       `yaml:"port"`
 	TLS  TLSConfig `yaml:"tls"`
+
+	// Reverse proxies whose X-Forwarded-For and X-Real-IP headers are
+	// believed; clients connecting directly cannot spoof their address
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
 }
 
 type TLSConfig struct {
-	Enabled  bool   `yaml:"enabled"`
-	CertFile string `yaml:"cert_file"`
-	KeyFile  string `yaml:"key_file"`
+	Enabled      bool   `yaml:"enabled"`
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file,omitempty"` // CA certificates client certificates must be issued by
+	ClientAuth   string `yaml:"client_auth,omitempty"`    // none, optional or require
 }
 
 type AuthConfig struct {
-	JWTSecret   string        `yaml:"jwt_secret"`
-	TokenExpiry string        `yaml:"token_expiry"`
-	APIKeys     []string      `yaml:"api_keys,omitempty"`
-	Users       []UserAccount `yaml:"users,omitempty"`
+	JWTSecret          string         `yaml:"jwt_secret"`
+	TokenExpiry        string         `yaml:"token_expiry"`
+	RefreshTokenExpiry string         `yaml:"refresh_token_expiry"` // "0" disables refresh tokens
+	APIKeys            []APIKeyConfig `yaml:"api_keys,omitempty"`
+	Users              []UserAccount  `yaml:"users,omitempty"`
+	Lockout            LockoutConfig  `yaml:"lockout"`
+	OIDC               OIDCConfig     `yaml:"oidc"`
+
+	// Client certificates accepted as credentials, see server.tls.client_auth
+	ClientCerts []ClientCertConfig `yaml:"client_certs,omitempty"`
+
+	// Asymmetric keys signing tokens instead of jwt_secret. The first signs
+	// new tokens; all of them verify tokens and are published at
+	// /.well-known/jwks.json, so keys can be rotated without logging
+	// everyone out.
+	SigningKeys []SigningKeyConfig `yaml:"signing_keys,omitempty"`
+}
+
+// SigningKeyConfig is a key tokens are signed or verified with
+type SigningKeyConfig struct {
+	ID        string `yaml:"kid"`                 // Key ID, sent in the kid header of tokens
+	Algorithm string `yaml:"algorithm,omitempty"` // RS256, PS256, ES256, EdDSA, ... (default: from the key type)
+	KeyFile   string `yaml:"key_file"`            // PEM private key, or public key for keys that only verify
+}
+
+// ClientCertConfig maps TLS client certificates to a principal and roles.
+// Exactly one of Subject, CommonName, DNSName, URI, Email and Fingerprint
+// selects the certificates it applies to.
+type ClientCertConfig struct {
+	Name        string   `yaml:"name,omitempty"`        // Shown in the audit log (default: the matched value)
+	Subject     string   `yaml:"subject,omitempty"`     // Distinguished name, e.g. "CN=deploy,O=Example"
+	CommonName  string   `yaml:"common_name,omitempty"` // Subject common name
+	DNSName     string   `yaml:"dns_name,omitempty"`    // DNS subject alternative name
+	URI         string   `yaml:"uri,omitempty"`         // URI subject alternative name, e.g. spiffe://example.org/deploy
+	Email       string   `yaml:"email,omitempty"`       // Email subject alternative name
+	Fingerprint string   `yaml:"fingerprint,omitempty"` // SHA-256 of the certificate, e.g. from openssl x509 -fingerprint -sha256
+	Roles       []string `yaml:"roles,omitempty"`       // stats, viewer, operator or admin (default: admin)
+	Jails       []string `yaml:"jails,omitempty"`       // Jail name patterns such as "nginx-*" (default: all jails)
+}
+
+// OIDCConfig enables login through an OpenID Connect identity provider
+type OIDCConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Issuer        string   `yaml:"issuer"` // e.g. "https://idp.example.com/realms/corp"
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret,omitempty"` // empty for public clients
+	RedirectURL   string   `yaml:"redirect_url"`            // this server's /api/v1/auth/oidc/callback URL
+	Scopes        []string `yaml:"scopes,omitempty"`
+	Audience      string   `yaml:"audience,omitempty"` // expected audience of bearer tokens (default: client_id)
+	UsernameClaim string   `yaml:"username_claim"`
+	GroupsClaim   string   `yaml:"groups_claim"`
+
+	// Roles and jails of users by group; the first mapping matching one of a
+	// user's groups applies. Users in no mapped group get default_roles, or
+	// are refused if there are none.
+	GroupMappings []OIDCGroupMapping `yaml:"group_mappings,omitempty"`
+	DefaultRoles  []string           `yaml:"default_roles,omitempty"`
+}
+
+type OIDCGroupMapping struct {
+	Group string   `yaml:"group"`
+	Roles []string `yaml:"roles"`
+	Jails []string `yaml:"jails,omitempty"`
+}
+
+// LockoutConfig limits repeated failed logins to one user or API key
+type LockoutConfig struct {
+	MaxAttempts int    `yaml:"max_attempts"` // Failures before the account is locked (0 disables lockout)
+	BaseDelay   string `yaml:"base_delay"`   // First lockout, doubled with each further failure
+	MaxDelay    string `yaml:"max_delay"`    // Longest lockout
+	ResetAfter  string `yaml:"reset_after"`  // Failures are forgotten after this long without one
+
+	// Client IPs failing to log in this often within reset_after are banned
+	// in this fail2ban jail
+	BanJail  string `yaml:"ban_jail,omitempty"`
+	BanAfter int    `yaml:"ban_after,omitempty"`
+}
+
+// APIKeyConfig is an API key and its permissions. Keys generated with
+// "hash-password -api-key" are stored as their ID and a hash; plain text keys
+// are still accepted, and a plain string in the config is a plain text key
+// with admin access to every jail.
+type APIKeyConfig struct {
+	ID           string     `yaml:"id,omitempty"`            // Public ID of a generated key (f2r_<id>_<secret>)
+	Hash         string     `yaml:"hash,omitempty"`          // Salted hash of the secret of a generated key
+	Key          string     `yaml:"key,omitempty"`           // Plain text key
+	Name         string     `yaml:"name,omitempty"`          // Shown in the audit log instead of the key ID or fingerprint
+	Label        string     `yaml:"label,omitempty"`         // Human description
+	ExpiresAt    *time.Time `yaml:"expires_at,omitempty"`    // The key is refused from then on
+	AllowedCIDRs []string   `yaml:"allowed_cidrs,omitempty"` // Source addresses or networks the key may be used from (default: any)
+	Roles        []string   `yaml:"roles,omitempty"`         // stats, viewer, operator or admin (default: admin)
+	Jails        []string   `yaml:"jails,omitempty"`         // Jail name patterns such as "nginx-*" (default: all jails)
+}
+
+func (k *APIKeyConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&k.Key)
+	}
+	type plain APIKeyConfig
+	return value.Decode((*plain)(k))
 }
 
 type UserAccount struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"` // Should be bcrypt hashed
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`        // Should be bcrypt hashed
+	Roles    []string `yaml:"roles,omitempty"` // stats, viewer, operator or admin (default: admin)
+	Jails    []string `yaml:"jails,omitempty"` // Jail name patterns such as "nginx-*" (default: all jails)
+
+	// Two-factor authentication, from hash-password -totp
+	TOTPSecret    string   `yaml:"totp_secret,omitempty"`    // base32; when set, logins need a TOTP or recovery code
+	RecoveryCodes []string `yaml:"recovery_codes,omitempty"` // bcrypt hashes of one-time recovery codes
 }
 
+// Formats of the ID and hash of generated API keys, and of recovery code
+// hashes
+var (
+	apiKeyIDPattern   = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+	apiKeyHashPattern = regexp.MustCompile(`^sha256:[0-9a-f]+:[0-9a-f]{64}$`)
+
+	// Key names like these would read like a key ID or fingerprint
+	apiKeyReservedNamePattern = regexp.MustCompile(`^[0-9A-Fa-f]{12}$`)
+
+	recoveryCodePattern = regexp.MustCompile(`^\$2[aby]\$\d\d\$.{53}$`)
+)
+
+// Roles that may be granted to API keys and users
+var validRoles = map[string]bool{"stats": true, "viewer": true, "operator": true, "admin": true}
+
+// defaultRoles are granted to API keys and users configured without roles
+var defaultRoles = []string{"admin"}
+
 type Fail2banConfig struct {
+	Backend    string `yaml:"backend"` // "exec" (fail2ban-client), "socket" or "fake"
 	ClientPath string `yaml:"client_path"`
-	UseSudo    bool   `yaml:"use_sudo,omitempty"` // Use sudo to run fail2ban-client
+	UseSudo    bool   `yaml:"use_sudo,omitempty"`    // Use sudo to run fail2ban-client
+	SocketPath string `yaml:"socket_path,omitempty"` // fail2ban server socket used by the socket backend
+	Timeout    string `yaml:"timeout"`               // Default deadline for every fail2ban command
+
+	// In-memory simulation used by the fake backend
+	FakeJails   []string `yaml:"fake_jails,omitempty"`
+	FakeBanTime string   `yaml:"fake_bantime,omitempty"`
+}
+
+type BansConfig struct {
+	IPv6Prefix    int `yaml:"ipv6_prefix"`     // Ban single IPv6 addresses as their network of this size (128 = address only)
+	MinIPv4Prefix int `yaml:"min_ipv4_prefix"` // Broader IPv4 networks require elevated permission
+	MinIPv6Prefix int `yaml:"min_ipv6_prefix"` // Broader IPv6 networks require elevated permission
+}
+
+type StorageConfig struct {
+	DataDir             string `yaml:"data_dir"`              // Directory for state kept by the API, such as scheduled bans
+	BanHistoryRetention string `yaml:"ban_history_retention"` // How long records of lifted and expired bans are kept ("0" keeps none)
+
+	fallbackDir string // used instead of the default DataDir if that is not writable
+}
+
+// DefaultDataDir is the data directory used unless storage.data_dir is set
+const DefaultDataDir = "/var/lib/fail2rest"
+
+type AuditConfig struct {
+	Enabled bool   `yaml:"enabled"`        // Off unless enabled, since it writes to the data directory on every change
+	Path    string `yaml:"path,omitempty"` // Hash-chained JSON lines file (default: audit.jsonl in the data directory)
 }
 
 type LoggingConfig struct {
@@ -53,16 +220,41 @@ var defaultConfig = Config{
 		Host: "0.0.0.0",
 		Port: 8080,
 		TLS: TLSConfig{
-			Enabled: false,
+			Enabled:    false,
+			ClientAuth: "none",
 		},
 	},
 	Auth: AuthConfig{
-		JWTSecret:   "change-this-secret",
-		TokenExpiry: "24h",
+		JWTSecret:          "change-this-secret",
+		TokenExpiry:        "15m",
+		RefreshTokenExpiry: "168h",
+		Lockout: LockoutConfig{
+			MaxAttempts: 5,
+			BaseDelay:   "1m",
+			MaxDelay:    "1h",
+			ResetAfter:  "24h",
+			BanAfter:    20,
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"openid", "profile", "groups"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+		},
 	},
 	Fail2ban: Fail2banConfig{
+		Backend:    "exec",
 		ClientPath: "/usr/bin/fail2ban-client",
 		UseSudo:    false,
+		SocketPath: "/var/run/fail2ban/fail2ban.sock",
+		Timeout:    "10s",
+	},
+	Bans: BansConfig{
+		IPv6Prefix:    128,
+		MinIPv4Prefix: 16,
+		MinIPv6Prefix: 32,
+	},
+	Storage: StorageConfig{
+		BanHistoryRetention: "2160h",
 	},
 	Logging: LoggingConfig{
 		Level: "info",
@@ -95,25 +287,425 @@ func LoadConfig(path string) (*Config, error) {
 	}
 
 	// Validate
-	if config.Auth.JWTSecret == "" || config.Auth.JWTSecret == "change-this-secret" {
+	if len(config.Auth.SigningKeys) > 0 {
+		if err := validateSigningKeys(config.Auth.SigningKeys); err != nil {
+			return nil, fmt.Errorf("auth.signing_keys: %w", err)
+		}
+		// Without an explicit jwt_secret, HS256 tokens are refused
+		if config.Auth.JWTSecret == "change-this-secret" {
+			config.Auth.JWTSecret = ""
+		}
+	} else if config.Auth.JWTSecret == "" || config.Auth.JWTSecret == "change-this-secret" {
 		return nil, fmt.Errorf("jwt_secret must be set in config")
 	}
 
 	// Validate that at least one auth method is configured
 	hasAPIKeys := len(config.Auth.APIKeys) > 0
 	hasUsers := len(config.Auth.Users) > 0
-	if !hasAPIKeys && !hasUsers {
-		return nil, fmt.Errorf("at least one authentication method must be configured (api_keys or users)")
+	hasClientCerts := len(config.Auth.ClientCerts) > 0
+	if !hasAPIKeys && !hasUsers && !config.Auth.OIDC.Enabled && !hasClientCerts {
+		return nil, fmt.Errorf("at least one authentication method must be configured (api_keys, users, oidc or client_certs)")
+	}
+
+	keyIDs := make(map[string]bool)
+	for i := range config.Auth.APIKeys {
+		key := &config.Auth.APIKeys[i]
+		if err := validateAPIKey(key); err != nil {
+			return nil, fmt.Errorf("api_keys[%d]: %w", i, err)
+		}
+		if key.ID != "" {
+			if keyIDs[key.ID] {
+				return nil, fmt.Errorf("api_keys[%d]: duplicate key id %q", i, key.ID)
+			}
+			keyIDs[key.ID] = true
+		}
+		roles, err := validateGrant(key.Roles, key.Jails)
+		if err != nil {
+			return nil, fmt.Errorf("api_keys[%d]: %w", i, err)
+		}
+		key.Roles = roles
+	}
+	keyNames := make(map[string]bool)
+	for i, key := range config.Auth.APIKeys {
+		if key.Name != "" {
+			if keyNames[key.Name] {
+				return nil, fmt.Errorf("api_keys[%d]: duplicate key name %q", i, key.Name)
+			}
+			keyNames[key.Name] = true
+		}
+		if apiKeyReservedNamePattern.MatchString(key.Name) {
+			return nil, fmt.Errorf("api_keys[%d]: name %q looks like a key ID; choose a name that is not 12 hex digits", i, key.Name)
+		}
+		if keyIDs[key.Name] && key.Name != key.ID {
+			return nil, fmt.Errorf("api_keys[%d]: name %q is the ID of another key", i, key.Name)
+		}
+	}
+	for i := range config.Auth.Users {
+		user := &config.Auth.Users[i]
+		roles, err := validateGrant(user.Roles, user.Jails)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", user.Username, err)
+		}
+		user.Roles = roles
+		if err := validateTOTP(user); err != nil {
+			return nil, fmt.Errorf("user %q: %w", user.Username, err)
+		}
+	}
+
+	if err := validateLockout(&config.Auth.Lockout); err != nil {
+		return nil, fmt.Errorf("auth.lockout: %w", err)
+	}
+	if config.Auth.OIDC.Enabled {
+		if err := validateOIDC(&config.Auth.OIDC); err != nil {
+			return nil, fmt.Errorf("auth.oidc: %w", err)
+		}
+	}
+
+	for _, proxy := range config.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("invalid server.trusted_proxies entry %q", proxy)
+		}
+	}
+
+	if err := validateTLS(&config.Server.TLS); err != nil {
+		return nil, fmt.Errorf("server.tls: %w", err)
+	}
+	if hasClientCerts && config.Server.TLS.ClientAuth == "none" {
+		return nil, fmt.Errorf("auth.client_certs need server.tls.client_auth to be optional or require")
+	}
+	certNames := make(map[string]bool)
+	for i := range config.Auth.ClientCerts {
+		cert := &config.Auth.ClientCerts[i]
+		if err := validateClientCert(cert); err != nil {
+			return nil, fmt.Errorf("client_certs[%d]: %w", i, err)
+		}
+		if certNames[cert.Name] {
+			return nil, fmt.Errorf("client_certs[%d]: duplicate name %q", i, cert.Name)
+		}
+		certNames[cert.Name] = true
+		roles, err := validateGrant(cert.Roles, cert.Jails)
+		if err != nil {
+			return nil, fmt.Errorf("client_certs[%d]: %w", i, err)
+		}
+		cert.Roles = roles
+	}
+
+	switch config.Fail2ban.Backend {
+	case "exec", "socket", "fake":
+	default:
+		return nil, fmt.Errorf("invalid fail2ban backend %q (must be exec, socket or fake)", config.Fail2ban.Backend)
+	}
+
+	if config.Bans.IPv6Prefix < 0 || config.Bans.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("bans.ipv6_prefix must be between 0 and 128")
+	}
+	if config.Bans.MinIPv4Prefix < 0 || config.Bans.MinIPv4Prefix > 32 {
+		return nil, fmt.Errorf("bans.min_ipv4_prefix must be between 0 and 32")
+	}
+	if config.Bans.MinIPv6Prefix < 0 || config.Bans.MinIPv6Prefix > 128 {
+		return nil, fmt.Errorf("bans.min_ipv6_prefix must be between 0 and 128")
+	}
+
+	if d, err := time.ParseDuration(config.Storage.BanHistoryRetention); err != nil || d < 0 {
+		return nil, fmt.Errorf("invalid storage.ban_history_retention %q", config.Storage.BanHistoryRetention)
+	}
+
+	// Installs that cannot write to the default data directory, e.g. when
+	// not running as root, keep their state next to the config file
+	if config.Storage.DataDir == "" {
+		config.Storage.DataDir = DefaultDataDir
+		config.Storage.fallbackDir = filepath.Join(filepath.Dir(path), "data")
 	}
 
 	return &config, nil
 }
 
+// validateAPIKey checks that an API key is either a plain text key or the
+// ID and hash of a generated key, and that its allowed networks are valid
+func validateAPIKey(key *APIKeyConfig) error {
+	switch {
+	case key.Key != "" && (key.ID != "" || key.Hash != ""):
+		return fmt.Errorf("set either key, or id and hash")
+	case key.Key == "" && (key.ID == "" || key.Hash == ""):
+		return fmt.Errorf("key, or id and hash, must be set")
+	}
+	if key.ID != "" && !apiKeyIDPattern.MatchString(key.ID) {
+		return fmt.Errorf("invalid key id %q (letters and digits only)", key.ID)
+	}
+	if key.Hash != "" && !apiKeyHashPattern.MatchString(key.Hash) {
+		return fmt.Errorf("invalid key hash (generate keys with hash-password -api-key)")
+	}
+	for _, cidr := range key.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("invalid allowed_cidrs entry %q", cidr)
+		}
+	}
+	return nil
+}
+
+// validateGrant checks the roles and jail patterns granted to an API key or
+// user, returning the roles with the default applied
+func validateGrant(roles, jails []string) ([]string, error) {
+	if len(roles) == 0 {
+		roles = defaultRoles
+	}
+	for _, role := range roles {
+		if !validRoles[role] {
+			return nil, fmt.Errorf("invalid role %q (must be stats, viewer, operator or admin)", role)
+		}
+	}
+	for _, pattern := range jails {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("invalid jail pattern %q", pattern)
+		}
+	}
+	return roles, nil
+}
+
+// validateTOTP checks the TOTP secret and recovery codes of a user
+func validateTOTP(user *UserAccount) error {
+	if user.TOTPSecret == "" {
+		if len(user.RecoveryCodes) > 0 {
+			return fmt.Errorf("recovery_codes need a totp_secret")
+		}
+		return nil
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(user.TOTPSecret)
+	if err != nil {
+		return fmt.Errorf("totp_secret is not valid base32")
+	}
+	if len(secret) < 10 {
+		return fmt.Errorf("totp_secret is too short (at least 80 bits)")
+	}
+	for _, hash := range user.RecoveryCodes {
+		if !recoveryCodePattern.MatchString(hash) {
+			return fmt.Errorf("recovery_codes must be bcrypt hashes (generate them with hash-password -totp)")
+		}
+	}
+	return nil
+}
+
+// validateLockout checks the lockout durations and limits
+func validateLockout(lockout *LockoutConfig) error {
+	if lockout.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+	delays := map[string]string{
+		"base_delay":  lockout.BaseDelay,
+		"max_delay":   lockout.MaxDelay,
+		"reset_after": lockout.ResetAfter,
+	}
+	for field, value := range delays {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", field, value)
+		}
+	}
+	base, _ := time.ParseDuration(lockout.BaseDelay)
+	max, _ := time.ParseDuration(lockout.MaxDelay)
+	if max < base {
+		return fmt.Errorf("max_delay must not be shorter than base_delay")
+	}
+	if lockout.BanJail != "" && lockout.BanAfter <= 0 {
+		return fmt.Errorf("ban_after must be positive when ban_jail is set")
+	}
+	return nil
+}
+
+// validateSigningKeys checks that token signing keys have unique IDs and a
+// supported algorithm; the key files are read at startup
+func validateSigningKeys(keys []SigningKeyConfig) error {
+	ids := make(map[string]bool)
+	for i, key := range keys {
+		if key.ID == "" {
+			return fmt.Errorf("[%d]: kid must be set", i)
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("[%d]: duplicate kid %q", i, key.ID)
+		}
+		ids[key.ID] = true
+		if key.KeyFile == "" {
+			return fmt.Errorf("[%d]: key_file must be set", i)
+		}
+		switch key.Algorithm {
+		case "", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA":
+		default:
+			return fmt.Errorf("[%d]: unsupported algorithm %q", i, key.Algorithm)
+		}
+	}
+	return nil
+}
+
+// validateTLS checks the client certificate settings
+func validateTLS(settings *TLSConfig) error {
+	switch settings.ClientAuth {
+	case "":
+		settings.ClientAuth = "none"
+	case "none", "optional", "require":
+	default:
+		return fmt.Errorf("invalid client_auth %q (must be none, optional or require)", settings.ClientAuth)
+	}
+	if settings.ClientAuth != "none" {
+		if !settings.Enabled {
+			return fmt.Errorf("client_auth %q needs TLS to be enabled", settings.ClientAuth)
+		}
+		if settings.ClientCAFile == "" {
+			return fmt.Errorf("client_auth %q needs a client_ca_file", settings.ClientAuth)
+		}
+	}
+	return nil
+}
+
+// validateClientCert checks that a client certificate mapping selects
+// certificates by exactly one attribute, and defaults its name to that value
+func validateClientCert(cert *ClientCertConfig) error {
+	var match string
+	count := 0
+	for _, value := range []string{cert.Subject, cert.CommonName, cert.DNSName, cert.URI, cert.Email, cert.Fingerprint} {
+		if value != "" {
+			match = value
+			count++
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("exactly one of subject, common_name, dns_name, uri, email and fingerprint must be set")
+	}
+	if cert.Fingerprint != "" {
+		if fingerprint, err := hex.DecodeString(strings.ReplaceAll(cert.Fingerprint, ":", "")); err != nil || len(fingerprint) != sha256.Size {
+			return fmt.Errorf("fingerprint must be a hex SHA-256 digest")
+		}
+	}
+	if cert.Name == "" {
+		cert.Name = match
+	}
+	return nil
+}
+
+// validateOIDC checks the identity provider settings and group mappings
+func validateOIDC(oidc *OIDCConfig) error {
+	issuer, err := url.Parse(oidc.Issuer)
+	if err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+		return fmt.Errorf("issuer must be an http(s) URL")
+	}
+	if oidc.ClientID == "" {
+		return fmt.Errorf("client_id must be set")
+	}
+	if oidc.RedirectURL != "" {
+		if u, err := url.Parse(oidc.RedirectURL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid redirect_url %q", oidc.RedirectURL)
+		}
+	}
+	for i := range oidc.GroupMappings {
+		mapping := &oidc.GroupMappings[i]
+		if mapping.Group == "" {
+			return fmt.Errorf("group_mappings[%d]: group must be set", i)
+		}
+		if len(mapping.Roles) == 0 {
+			return fmt.Errorf("group_mappings[%d]: roles must be set", i)
+		}
+		if _, err := validateGrant(mapping.Roles, mapping.Jails); err != nil {
+			return fmt.Errorf("group_mappings[%d]: %w", i, err)
+		}
+	}
+	for _, role := range oidc.DefaultRoles {
+		if !validRoles[role] {
+			return fmt.Errorf("invalid default role %q (must be stats, viewer, operator or admin)", role)
+		}
+	}
+	return nil
+}
+
+// GetLockoutDelays returns the first and longest lockout, and how long
+// failures are remembered
+func (c *Config) GetLockoutDelays() (base, max, resetAfter time.Duration, err error) {
+	if base, err = time.ParseDuration(c.Auth.Lockout.BaseDelay); err != nil {
+		return 0, 0, 0, err
+	}
+	if max, err = time.ParseDuration(c.Auth.Lockout.MaxDelay); err != nil {
+		return 0, 0, 0, err
+	}
+	resetAfter, err = time.ParseDuration(c.Auth.Lockout.ResetAfter)
+	return base, max, resetAfter, err
+}
+
+// GetClientAuth returns the TLS client certificate policy
+func (c *Config) GetClientAuth() tls.ClientAuthType {
+	switch c.Server.TLS.ClientAuth {
+	case "optional":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
 func (c *Config) GetTokenExpiry() (time.Duration, error) {
 	return time.ParseDuration(c.Auth.TokenExpiry)
 }
 
+// GetRefreshTokenExpiry returns how long refresh tokens stay valid (zero if
+// they are disabled)
+func (c *Config) GetRefreshTokenExpiry() (time.Duration, error) {
+	return time.ParseDuration(c.Auth.RefreshTokenExpiry)
+}
+
+// GetBanHistoryRetention returns how long records of ended bans are kept
+func (c *Config) GetBanHistoryRetention() (time.Duration, error) {
+	return time.ParseDuration(c.Storage.BanHistoryRetention)
+}
+
+// GetCommandTimeout returns the default deadline for fail2ban commands
+func (c *Config) GetCommandTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.Fail2ban.Timeout)
+}
+
+// GetFakeBanTime returns the bantime of the fake backend (zero if unset)
+func (c *Config) GetFakeBanTime() (time.Duration, error) {
+	if c.Fail2ban.FakeBanTime == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.Fail2ban.FakeBanTime)
+}
+
+// PrepareDataDir creates the data directory and checks that it is writable.
+// If the default directory is not, it switches to the fallback next to the
+// config file and reports that it did.
+func (c *Config) PrepareDataDir() (fellBack bool, err error) {
+	err = writableDir(c.Storage.DataDir)
+	if err == nil {
+		return false, nil
+	}
+	if c.Storage.fallbackDir == "" {
+		return false, fmt.Errorf("storage.data_dir %s is not usable: %w", c.Storage.DataDir, err)
+	}
+	if fallbackErr := writableDir(c.Storage.fallbackDir); fallbackErr != nil {
+		return false, fmt.Errorf("neither the default data directory (%v) nor %s (%v) is usable; set storage.data_dir to a writable directory",
+			err, c.Storage.fallbackDir, fallbackErr)
+	}
+	c.Storage.DataDir = c.Storage.fallbackDir
+	return true, nil
+}
+
+// writableDir creates dir if missing and checks that files can be created in it
+func writableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// GetAuditPath returns the audit log file
+func (c *Config) GetAuditPath() string {
+	if c.Audit.Path != "" {
+		return c.Audit.Path
+	}
+	return filepath.Join(c.Storage.DataDir, "audit.jsonl")
+}
+
 func (c *Config) GetAddress() string {
 	return fmt.Sprintf("%s:%d", c.Server.Host, c.Server.Port)
 }
-
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with an API key and the given extra YAML
+func writeConfig(t *testing.T, dir, extra string) string {
+	t.Helper()
+	return writeRawConfig(t, dir, "auth:\n  jwt_secret: \"test-secret-0123456789abcdef0123\"\n  api_keys: [\"0123456789abcdef\"]\n"+extra)
+}
+
+// writeRawConfig writes a config file with exactly data
+func writeRawConfig(t *testing.T, dir, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrepareDataDir(t *testing.T) {
+	dir := t.TempDir()
+	// A path below a regular file can never be created
+	blocked := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocked, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("explicit", func(t *testing.T) {
+		want := filepath.Join(dir, "state")
+		cfg, err := LoadConfig(writeConfig(t, dir, "storage:\n  data_dir: "+want+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fellBack, err := cfg.PrepareDataDir()
+		if err != nil || fellBack || cfg.Storage.DataDir != want {
+			t.Fatalf("PrepareDataDir() = %v, %v, dir %s", fellBack, err, cfg.Storage.DataDir)
+		}
+		if info, err := os.Stat(want); err != nil || !info.IsDir() {
+			t.Fatalf("data directory not created: %v", err)
+		}
+	})
+
+	t.Run("explicit unusable", func(t *testing.T) {
+		cfg, err := LoadConfig(writeConfig(t, dir, "storage:\n  data_dir: "+filepath.Join(blocked, "state")+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.PrepareDataDir(); err == nil || !strings.Contains(err.Error(), "storage.data_dir") {
+			t.Fatalf("PrepareDataDir() error = %v, want one naming storage.data_dir", err)
+		}
+	})
+
+	t.Run("default falls back", func(t *testing.T) {
+		cfg, err := LoadConfig(writeConfig(t, dir, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Storage.DataDir != DefaultDataDir {
+			t.Fatalf("DataDir = %s, want %s", cfg.Storage.DataDir, DefaultDataDir)
+		}
+		cfg.Storage.DataDir = filepath.Join(blocked, "state") // stands in for an unwritable default
+		fellBack, err := cfg.PrepareDataDir()
+		if err != nil || !fellBack {
+			t.Fatalf("PrepareDataDir() = %v, %v", fellBack, err)
+		}
+		if want := filepath.Join(dir, "data"); cfg.Storage.DataDir != want {
+			t.Errorf("DataDir = %s, want %s", cfg.Storage.DataDir, want)
+		}
+	})
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		proxies string
+		valid   bool
+	}{
+		{"[]", true},
+		{`["127.0.0.1", "10.0.0.0/8", "::1"]`, true},
+		{`["proxy.example.com"]`, false},
+		{`["10.0.0.0/33"]`, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		_, err := LoadConfig(writeConfig(t, dir, "server:\n  trusted_proxies: "+tt.proxies+"\n"))
+		if (err == nil) != tt.valid {
+			t.Errorf("trusted_proxies %s: error = %v, want valid %v", tt.proxies, err, tt.valid)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, t.TempDir(), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Audit.Enabled {
+		t.Error("audit log is enabled by default")
+	}
+	if cfg.Auth.TokenExpiry != "15m" {
+		t.Errorf("token_expiry = %s by default, want 15m", cfg.Auth.TokenExpiry)
+	}
+	if len(cfg.Server.TrustedProxies) != 0 {
+		t.Errorf("trusted proxies by default: %v", cfg.Server.TrustedProxies)
+	}
+}
+
+func TestAPIKeyNames(t *testing.T) {
+	const hash = "sha256:00:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		keys  string
+		valid bool
+	}{
+		{`[{id: "0c4c0be74bb5", hash: "` + hash + `", name: "deploy"}]`, true},
+		{`[{id: "0c4c0be74bb5", hash: "` + hash + `", name: "0c4c0be74bb5"}]`, false},
+		{`[{key: "plain-text-key", name: "a1b2c3d4e5f6"}]`, false},
+		{`[{id: "deploy", hash: "` + hash + `"}, {key: "plain-text-key", name: "deploy"}]`, false},
+		{`[{id: "0c4c0be74bb5", hash: "` + hash + `", name: "ci"}, {key: "plain-text-key", name: "ci"}]`, false},
+		{`[{id: "0c4c0be74bb5", hash: "` + hash + `", name: "ci"}, {key: "plain-text-key", name: "deploy"}]`, true},
+	}
+	for _, tt := range tests {
+		data := "auth:\n  jwt_secret: \"test-secret-0123456789abcdef0123\"\n  api_keys: " + tt.keys + "\n"
+		_, err := LoadConfig(writeRawConfig(t, t.TempDir(), data))
+		if (err == nil) != tt.valid {
+			t.Errorf("api_keys %s: error = %v, want valid %v", tt.keys, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateClientCert(t *testing.T) {
+	const fingerprint = "3b:8f:26:0a:91:4c:d2:7e:55:10:b8:e3:6f:c4:02:9d:a7:1e:68:f0:43:bd:99:2c:5e:81:d6:0f:7a:34:c5:e2"
+	tests := []struct {
+		cert  ClientCertConfig
+		valid bool
+		name  string
+	}{
+		{ClientCertConfig{Subject: "CN=deploy,O=Example"}, true, "CN=deploy,O=Example"},
+		{ClientCertConfig{CommonName: "deploy", Name: "ci"}, true, "ci"},
+		{ClientCertConfig{Fingerprint: fingerprint}, true, fingerprint},
+		{ClientCertConfig{Fingerprint: strings.ReplaceAll(fingerprint, ":", "")}, true, strings.ReplaceAll(fingerprint, ":", "")},
+		{ClientCertConfig{Fingerprint: fingerprint[3:]}, false, ""},
+		{ClientCertConfig{Fingerprint: "not a fingerprint"}, false, ""},
+		{ClientCertConfig{CommonName: "deploy", DNSName: "deploy.example.org"}, false, ""},
+		{ClientCertConfig{Name: "deploy"}, false, ""},
+	}
+	for _, tt := range tests {
+		cert := tt.cert
+		err := validateClientCert(&cert)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateClientCert(%+v) error = %v, want valid %v", tt.cert, err, tt.valid)
+		} else if tt.valid && cert.Name != tt.name {
+			t.Errorf("validateClientCert(%+v) name = %q, want %q", tt.cert, cert.Name, tt.name)
+		}
+	}
+}
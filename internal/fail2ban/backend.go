@@ -0,0 +1,53 @@
+package fail2ban
+
+import "context"
+
+// Backend is the set of fail2ban operations used by the API handlers
+type Backend interface {
+	GetStatus(ctx context.Context) (*Status, error)
+	GetJails(ctx context.Context) ([]string, error)
+	GetJailStatus(ctx context.Context, jailName string) (*JailStatus, error)
+	GetOverallStats(ctx context.Context) (*OverallStats, error)
+
+	GetBannedIPs(ctx context.Context, jailName string) ([]string, error)
+	BanIP(ctx context.Context, jailName, ip string) error
+	UnbanIP(ctx context.Context, jailName, ip string) error
+	GetBans(ctx context.Context, jailName string) ([]BanInfo, error)
+	BannedIn(ctx context.Context, ip string) ([]string, error)
+	UnbanIPEverywhere(ctx context.Context, ip string) (int, error)
+	UnbanAll(ctx context.Context) (int, error)
+
+	GetIgnoreIPs(ctx context.Context, jailName string) ([]string, error)
+	AddIgnoreIP(ctx context.Context, jailName, ip string) error
+	DelIgnoreIP(ctx context.Context, jailName, ip string) error
+
+	GetJailSettings(ctx context.Context, jailName string) (*JailSettings, error)
+	SetJailSettings(ctx context.Context, jailName string, update *JailSettingsUpdate) error
+
+	StartJail(ctx context.Context, jailName string) error
+	StopJail(ctx context.Context, jailName string) error
+	RestartJail(ctx context.Context, jailName string) error
+	ReloadJail(ctx context.Context, jailName string) error
+}
+
+// BatchBanner is implemented by backends that can ban or unban several IPs
+// with a single command
+type BatchBanner interface {
+	BanIPs(ctx context.Context, jailName string, ips []string) error
+	UnbanIPs(ctx context.Context, jailName string, ips []string) error
+}
+
+// TimedBanner is implemented by backends that may be able to ban an IP for
+// a bantime other than the jail's. A negative banTime (in seconds) bans
+// permanently. Servers that cannot return ErrUnsupported.
+type TimedBanner interface {
+	BanIPFor(ctx context.Context, jailName, ip string, banTime int) error
+}
+
+var (
+	_ Backend     = (*Client)(nil)
+	_ BatchBanner = (*Client)(nil)
+	_ TimedBanner = (*Client)(nil)
+	_ Backend     = (*FakeBackend)(nil)
+	_ TimedBanner = (*FakeBackend)(nil)
+)
@@ -0,0 +1,111 @@
+package fail2ban
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported is returned for commands the fail2ban server does not know,
+// typically because it is too old
+var ErrUnsupported = errors.New("command not supported by this fail2ban version")
+
+// BanInfo describes an active ban in a jail
+type BanInfo struct {
+	IP        string     `json:"ip"`
+	BannedAt  time.Time  `json:"banned_at"`
+	BanTime   int        `json:"bantime"`              // seconds, -1 for permanent bans
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil for permanent bans
+}
+
+// Permanent reports whether the ban never expires
+func (b *BanInfo) Permanent() bool {
+	return b.BanTime < 0
+}
+
+// unsupportedError converts the error fail2ban reports for unknown commands
+// into ErrUnsupported
+func unsupportedError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "Invalid command") {
+		return ErrUnsupported
+	}
+	return err
+}
+
+// banWithTime matches the entries of "get <jail> banip --with-time", e.g.
+// "192.0.2.1 	2024-01-01 12:00:00 + 600 = 2024-01-01 12:10:00"
+var banWithTime = regexp.MustCompile(`^(\S+)\s+(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d) \+ (-?\d+) = `)
+
+// parseBanList parses ban entries, skipping any it does not understand.
+// fail2ban reports times in the server's local time zone.
+func parseBanList(lines []string) []BanInfo {
+	bans := []BanInfo{}
+	for _, line := range lines {
+		m := banWithTime.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		bannedAt, err := time.ParseInLocation("2006-01-02 15:04:05", m[2], time.Local)
+		if err != nil {
+			continue
+		}
+		banTime, _ := strconv.Atoi(m[3])
+
+		ban := BanInfo{
+			IP:       m[1],
+			BannedAt: bannedAt,
+			BanTime:  banTime,
+		}
+		if banTime >= 0 {
+			expiresAt := bannedAt.Add(time.Duration(banTime) * time.Second)
+			ban.ExpiresAt = &expiresAt
+		}
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+// parseJailNames extracts jail names from the Python list printed by
+// fail2ban-client for "banned <ip>", e.g. "[['sshd', 'nginx-http-auth']]"
+func parseJailNames(output string) []string {
+	jails := []string{}
+	for _, m := range quotedName.FindAllStringSubmatch(output, -1) {
+		jails = append(jails, m[1])
+	}
+	return jails
+}
+
+var quotedName = regexp.MustCompile(`'([^']*)'`)
+
+// perTicketBanTimeVersion is the first fail2ban version whose banip command
+// takes a bantime for the ban
+var perTicketBanTimeVersion = []int{1, 1, 0}
+
+// fail2banVersion matches the version printed by "fail2ban-client version",
+// e.g. "1.0.2" or "Fail2Ban v0.10.6"
+var fail2banVersion = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseVersion extracts the major, minor and patch version from output
+func parseVersion(output string) ([]int, bool) {
+	m := fail2banVersion.FindStringSubmatch(output)
+	if m == nil {
+		return nil, false
+	}
+	version := make([]int, 3)
+	for i, part := range m[1:] {
+		version[i], _ = strconv.Atoi(part)
+	}
+	return version, true
+}
+
+// versionAtLeast reports whether version is min or later
+func versionAtLeast(version, min []int) bool {
+	for i := range min {
+		if version[i] != min[i] {
+			return version[i] > min[i]
+		}
+	}
+	return true
+}
@@ -2,171 +2,171 @@ package fail2ban
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Client struct {
 	clientPath string
 	useSudo    bool
+	socketPath string        // when set, commands go to the server socket
+	timeout    time.Duration // default deadline for every command
+
+	versionMu sync.Mutex
+	version   []int // server version, once read
 }
 
-func NewClient(clientPath string, useSudo bool) *Client {
+func NewClient(clientPath string, useSudo bool, timeout time.Duration) *Client {
 	return &Client{
 		clientPath: clientPath,
 		useSudo:    useSudo,
+		timeout:    timeout,
+	}
+}
+
+// withTimeout applies the default command timeout to ctx
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, c.timeout)
 }
 
-func (c *Client) executeCommand(args ...string) (string, error) {
+func (c *Client) executeCommand(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
 	var cmd *exec.Cmd
-	
+
+	if c.socketPath != "" {
+		args = append([]string{"-s", c.socketPath}, args...)
+	}
+
 	if c.useSudo {
 		// Use sudo to run fail2ban-client
-		cmd = exec.Command("sudo", append([]string{c.clientPath}, args...)...)
+		cmd = exec.CommandContext(ctx, "sudo", append([]string{c.clientPath}, args...)...)
 	} else {
-		cmd = exec.Command(c.clientPath, args...)
+		cmd = exec.CommandContext(ctx, c.clientPath, args...)
 	}
-	
+
+	// Ask the process to terminate first (sudo relays SIGTERM to its child),
+	// and kill it if it is still running shortly after
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 2 * time.Second
+
 	output, err := cmd.CombinedOutput()
 	if err != nil {
+		if ctxErr := contextError(ctx, args); ctxErr != nil {
+			return "", ctxErr
+		}
+
 		outputStr := strings.TrimSpace(string(output))
-		
+
 		if strings.Contains(outputStr, "Permission denied") || strings.Contains(outputStr, "you must be root") {
 			return "", fmt.Errorf("permission denied: fail2ban requires root privileges. Either run the server as root, or set 'use_sudo: true' in config and configure passwordless sudo for fail2ban-client. Error: %s", outputStr)
 		}
-		
+		if strings.Contains(outputStr, "Is fail2ban running?") {
+			return "", &UnavailableError{Err: errors.New(outputStr)}
+		}
+
 		return "", fmt.Errorf("fail2ban-client error: %w, output: %s", err, outputStr)
 	}
 	return strings.TrimSpace(string(output)), nil
 }
 
-// GetStatus returns the overall status of fail2ban
-func (c *Client) GetStatus() (map[string]interface{}, error) {
-	output, err := c.executeCommand("status")
-	if err != nil {
-		return nil, err
+// runCommand executes a command whose output is not needed
+func (c *Client) runCommand(ctx context.Context, args ...string) error {
+	if c.socketPath != "" {
+		_, err := c.transmit(ctx, args...)
+		return err
 	}
+	_, err := c.executeCommand(ctx, args...)
+	return err
+}
 
-	status := make(map[string]interface{})
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	
-	var currentSection string
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		if strings.HasPrefix(line, "Status for the jail:") {
-			currentSection = "jails"
-			if status["jails"] == nil {
-				status["jails"] = []string{}
-			}
-			continue
-		}
-
-		if strings.Contains(line, ":") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				status[key] = value
-			}
-		} else if currentSection == "jails" {
-			jails := status["jails"].([]string)
-			status["jails"] = append(jails, line)
+// query runs a command and returns its result as text
+func (c *Client) query(ctx context.Context, args ...string) (string, error) {
+	if c.socketPath != "" {
+		reply, err := c.transmit(ctx, args...)
+		if err != nil {
+			return "", err
 		}
+		return describeValue(reply), nil
 	}
+	return c.executeCommand(ctx, args...)
+}
 
-	return status, nil
+// GetStatus returns the overall status of fail2ban
+func (c *Client) GetStatus(ctx context.Context) (*Status, error) {
+	fields, err := c.statusFields(ctx, "status")
+	if err != nil {
+		return nil, err
+	}
+	return fields.status(), nil
 }
 
 // GetJailStatus returns detailed status for a specific jail
-func (c *Client) GetJailStatus(jailName string) (map[string]interface{}, error) {
-	output, err := c.executeCommand("status", jailName)
+func (c *Client) GetJailStatus(ctx context.Context, jailName string) (*JailStatus, error) {
+	fields, err := c.statusFields(ctx, "status", jailName)
 	if err != nil {
 		return nil, err
 	}
+	return fields.jailStatus(), nil
+}
 
-	status := make(map[string]interface{})
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		if strings.Contains(line, ":") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				
-				// Try to parse numbers
-				if strings.Contains(value, " ") {
-					status[key] = value
-				} else {
-					status[key] = value
-				}
-			}
+// statusFields runs a status command and collects the reported fields
+func (c *Client) statusFields(ctx context.Context, args ...string) (statusFields, error) {
+	if c.socketPath != "" {
+		reply, err := c.transmit(ctx, args...)
+		if err != nil {
+			return nil, err
 		}
+		return statusReplyFields(reply), nil
 	}
 
-	return status, nil
+	output, err := c.executeCommand(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatusOutput(output), nil
 }
 
 // GetJails returns a list of all configured jails
-func (c *Client) GetJails() ([]string, error) {
-	output, err := c.executeCommand("status")
+func (c *Client) GetJails(ctx context.Context) ([]string, error) {
+	status, err := c.GetStatus(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return status.Jails, nil
+}
 
-	var jails []string
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	inJailSection := false
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		
-		if strings.Contains(line, "Jail list:") || strings.Contains(line, "Status for the jail:") {
-			inJailSection = true
-			continue
-		}
-
-		if inJailSection && line != "" {
-			// Jails are listed one per line or comma-separated
-			if strings.Contains(line, ",") {
-				parts := strings.Split(line, ",")
-				for _, part := range parts {
-					jail := strings.TrimSpace(part)
-					if jail != "" {
-						jails = append(jails, jail)
-					}
-				}
-			} else {
-				jails = append(jails, line)
-			}
+// GetBannedIPs returns a list of banned IPs for a jail
+func (c *Client) GetBannedIPs(ctx context.Context, jailName string) ([]string, error) {
+	if c.socketPath != "" {
+		reply, err := c.transmit(ctx, "get", jailName, "banned")
+		if err != nil {
+			return nil, err
 		}
+		return replyStrings(reply), nil
 	}
 
-	return jails, nil
-}
-
-// GetBannedIPs returns a list of banned IPs for a jail
-func (c *Client) GetBannedIPs(jailName string) ([]string, error) {
-	output, err := c.executeCommand("get", jailName, "banned")
+	output, err := c.executeCommand(ctx, "get", jailName, "banned")
 	if err != nil {
 		return nil, err
 	}
 
 	var ips []string
 	scanner := bufio.NewScanner(strings.NewReader(output))
-	
+
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line != "" {
@@ -177,98 +177,211 @@ func (c *Client) GetBannedIPs(jailName string) ([]string, error) {
 	return ips, nil
 }
 
-// BanIP bans an IP address in a specific jail
-func (c *Client) BanIP(jailName, ip string) error {
-	_, err := c.executeCommand("set", jailName, "banip", ip)
-	return err
+// BanIPs bans several IP addresses in a jail with one command
+func (c *Client) BanIPs(ctx context.Context, jailName string, ips []string) error {
+	return c.runCommand(ctx, append([]string{"set", jailName, "banip"}, ips...)...)
 }
 
-// UnbanIP unbans an IP address in a specific jail
-func (c *Client) UnbanIP(jailName, ip string) error {
-	_, err := c.executeCommand("set", jailName, "unbanip", ip)
-	return err
+// UnbanIPs unbans several IP addresses in a jail with one command
+func (c *Client) UnbanIPs(ctx context.Context, jailName string, ips []string) error {
+	return c.runCommand(ctx, append([]string{"set", jailName, "unbanip"}, ips...)...)
 }
 
-// GetJailStats returns statistics for a jail
-func (c *Client) GetJailStats(jailName string) (map[string]interface{}, error) {
-	status, err := c.GetJailStatus(jailName)
+// GetIgnoreIPs returns the IPs and networks a jail never bans
+func (c *Client) GetIgnoreIPs(ctx context.Context, jailName string) ([]string, error) {
+	if c.socketPath != "" {
+		reply, err := c.transmit(ctx, "get", jailName, "ignoreip")
+		if err != nil {
+			return nil, err
+		}
+		return replyStrings(reply), nil
+	}
+
+	output, err := c.executeCommand(ctx, "get", jailName, "ignoreip")
 	if err != nil {
 		return nil, err
 	}
+	return parseListOutput(output), nil
+}
 
-	stats := make(map[string]interface{})
-	
-	// Extract relevant statistics from status
-	if filterList, ok := status["Filter"].(string); ok {
-		stats["filter"] = filterList
+// AddIgnoreIP adds an IP or network to a jail's ignore list
+func (c *Client) AddIgnoreIP(ctx context.Context, jailName, ip string) error {
+	return c.runCommand(ctx, "set", jailName, "addignoreip", ip)
+}
+
+// DelIgnoreIP removes an IP or network from a jail's ignore list
+func (c *Client) DelIgnoreIP(ctx context.Context, jailName, ip string) error {
+	return c.runCommand(ctx, "set", jailName, "delignoreip", ip)
+}
+
+// GetBans returns the active bans of a jail with their ban times. Requires
+// fail2ban 0.11 or later; older servers return ErrUnsupported.
+func (c *Client) GetBans(ctx context.Context, jailName string) ([]BanInfo, error) {
+	if c.socketPath != "" {
+		reply, err := c.transmit(ctx, "get", jailName, "banip", "--with-time")
+		if err != nil {
+			return nil, unsupportedError(err)
+		}
+		return parseBanList(replyStrings(reply)), nil
 	}
-	if currentlyBanned, ok := status["Currently banned"].(string); ok {
-		stats["currently_banned"] = currentlyBanned
+
+	output, err := c.executeCommand(ctx, "get", jailName, "banip", "--with-time")
+	if err != nil {
+		return nil, unsupportedError(err)
 	}
-	if totalBanned, ok := status["Total banned"].(string); ok {
-		stats["total_banned"] = totalBanned
+	return parseBanList(strings.Split(output, "\n")), nil
+}
+
+// BannedIn returns the jails in which an IP is currently banned. Requires
+// fail2ban 0.11 or later; older servers return ErrUnsupported.
+func (c *Client) BannedIn(ctx context.Context, ip string) ([]string, error) {
+	if c.socketPath != "" {
+		reply, err := c.transmit(ctx, "banned", ip)
+		if err != nil {
+			return nil, unsupportedError(err)
+		}
+		// One list of jails per queried IP
+		if lists, ok := reply.([]interface{}); ok && len(lists) == 1 {
+			return replyStrings(lists[0]), nil
+		}
+		return []string{}, nil
 	}
-	if bannedIPList, ok := status["Banned IP list"].(string); ok {
-		stats["banned_ips"] = strings.Fields(bannedIPList)
+
+	output, err := c.executeCommand(ctx, "banned", ip)
+	if err != nil {
+		return nil, unsupportedError(err)
 	}
+	return parseJailNames(output), nil
+}
 
-	return stats, nil
+// UnbanIPEverywhere removes an IP from every jail and returns the number of
+// bans released. Requires fail2ban 0.10 or later; older servers return
+// ErrUnsupported.
+func (c *Client) UnbanIPEverywhere(ctx context.Context, ip string) (int, error) {
+	return c.unbanCount(ctx, "unban", ip)
 }
 
-// GetOverallStats returns overall statistics
-func (c *Client) GetOverallStats() (map[string]interface{}, error) {
-	jails, err := c.GetJails()
+// UnbanAll removes every ban from every jail and returns the number of bans
+// released. Requires fail2ban 0.10 or later; older servers return
+// ErrUnsupported.
+func (c *Client) UnbanAll(ctx context.Context) (int, error) {
+	return c.unbanCount(ctx, "unban", "--all")
+}
+
+// unbanCount runs a top-level unban command, which replies with the number
+// of bans it released
+func (c *Client) unbanCount(ctx context.Context, args ...string) (int, error) {
+	output, err := c.query(ctx, args...)
 	if err != nil {
-		return nil, err
+		return 0, unsupportedError(err)
 	}
+	count, _ := strconv.Atoi(strings.TrimSpace(output))
+	return count, nil
+}
 
-	stats := make(map[string]interface{})
-	stats["jail_count"] = len(jails)
-	stats["jails"] = jails
-	
-	totalBanned := 0
-	jailStats := make(map[string]interface{})
-	
-	for _, jail := range jails {
-		jailStat, err := c.GetJailStats(jail)
-		if err == nil {
-			jailStats[jail] = jailStat
-			if banned, ok := jailStat["currently_banned"].(string); ok {
-				var count int
-				fmt.Sscanf(banned, "%d", &count)
-				totalBanned += count
-			}
-		}
+// BanIP bans an IP address in a specific jail
+func (c *Client) BanIP(ctx context.Context, jailName, ip string) error {
+	return c.runCommand(ctx, "set", jailName, "banip", ip)
+}
+
+// BanIPFor bans an IP with a bantime of its own (seconds, negative for
+// permanent) on servers that support per-ticket bantimes. Older servers
+// return ErrUnsupported without being sent the command, since they would
+// read the bantime as another IP to ban.
+func (c *Client) BanIPFor(ctx context.Context, jailName, ip string, banTime int) error {
+	version, err := c.serverVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if !versionAtLeast(version, perTicketBanTimeVersion) {
+		return ErrUnsupported
+	}
+	return unsupportedError(c.runCommand(ctx, "set", jailName, "banip", "--bantime", strconv.Itoa(banTime), ip))
+}
+
+// serverVersion returns the version of the fail2ban server, reading it once
+func (c *Client) serverVersion(ctx context.Context) ([]int, error) {
+	c.versionMu.Lock()
+	defer c.versionMu.Unlock()
+	if c.version != nil {
+		return c.version, nil
 	}
-	
-	stats["total_banned_ips"] = totalBanned
-	stats["jail_details"] = jailStats
-	stats["timestamp"] = time.Now().Unix()
 
-	return stats, nil
+	output, err := c.query(ctx, "version")
+	if err != nil {
+		return nil, err
+	}
+	version, ok := parseVersion(output)
+	if !ok {
+		return nil, fmt.Errorf("unexpected fail2ban version %q", strings.TrimSpace(output))
+	}
+	c.version = version
+	return version, nil
 }
 
-// StartJail starts a jail
-func (c *Client) StartJail(jailName string) error {
-	_, err := c.executeCommand("start", jailName)
+// UnbanIP unbans an IP address in a specific jail
+func (c *Client) UnbanIP(ctx context.Context, jailName, ip string) error {
+	return c.runCommand(ctx, "set", jailName, "unbanip", ip)
+}
+
+// GetOverallStats returns overall statistics
+func (c *Client) GetOverallStats(ctx context.Context) (*OverallStats, error) {
+	return overallStats(ctx, c)
+}
+
+// StartJail starts a jail. Starting, restarting and reloading need the jail
+// configuration read by fail2ban-client, so they always run through it.
+func (c *Client) StartJail(ctx context.Context, jailName string) error {
+	_, err := c.executeCommand(ctx, "start", jailName)
 	return err
 }
 
 // StopJail stops a jail
-func (c *Client) StopJail(jailName string) error {
-	_, err := c.executeCommand("stop", jailName)
-	return err
+func (c *Client) StopJail(ctx context.Context, jailName string) error {
+	return c.runCommand(ctx, "stop", jailName)
 }
 
 // RestartJail restarts a jail
-func (c *Client) RestartJail(jailName string) error {
-	_, err := c.executeCommand("restart", jailName)
+func (c *Client) RestartJail(ctx context.Context, jailName string) error {
+	_, err := c.executeCommand(ctx, "restart", jailName)
 	return err
 }
 
 // ReloadJail reloads a jail configuration
-func (c *Client) ReloadJail(jailName string) error {
-	_, err := c.executeCommand("reload", jailName)
+func (c *Client) ReloadJail(ctx context.Context, jailName string) error {
+	_, err := c.executeCommand(ctx, "reload", jailName)
 	return err
 }
 
+// GetJailSettings returns the runtime parameters of a jail
+func (c *Client) GetJailSettings(ctx context.Context, jailName string) (*JailSettings, error) {
+	values := make(map[string]string)
+	for _, param := range requiredSettings {
+		value, err := c.query(ctx, "get", jailName, param)
+		if err != nil {
+			return nil, err
+		}
+		values[param] = value
+	}
+	for _, param := range optionalSettings {
+		value, err := c.query(ctx, "get", jailName, param)
+		if errors.Is(unsupportedError(err), ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[param] = value
+	}
+	return parseJailSettings(values)
+}
+
+// SetJailSettings changes runtime parameters of a jail
+func (c *Client) SetJailSettings(ctx context.Context, jailName string, update *JailSettingsUpdate) error {
+	for _, param := range update.params() {
+		if err := c.runCommand(ctx, "set", jailName, param[0], param[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
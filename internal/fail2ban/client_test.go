@@ -0,0 +1,140 @@
+package fail2ban
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers commands on a unix socket like the fail2ban server,
+// with the pickled reply returned by respond, and records every command
+type fakeServer struct {
+	path    string
+	respond func(args []interface{}) []byte
+
+	mu       sync.Mutex
+	commands [][]interface{}
+}
+
+func startFakeServer(t *testing.T, respond func(args []interface{}) []byte) *fakeServer {
+	t.Helper()
+	s := &fakeServer{path: filepath.Join(t.TempDir(), "fail2ban.sock"), respond: respond}
+	ln, err := net.Listen("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var buf bytes.Buffer
+	chunk := make([]byte, 1024)
+	for !bytes.HasSuffix(buf.Bytes(), []byte(socketEndCommand)) {
+		n, err := conn.Read(chunk)
+		buf.Write(chunk[:n])
+		if err != nil {
+			return
+		}
+	}
+	cmd, _ := decodePickle(bytes.TrimSuffix(buf.Bytes(), []byte(socketEndCommand)))
+	args, _ := cmd.([]interface{})
+
+	s.mu.Lock()
+	s.commands = append(s.commands, args)
+	s.mu.Unlock()
+	conn.Write(append(s.respond(args), socketEndCommand...))
+}
+
+func (s *fakeServer) received() [][]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]interface{}(nil), s.commands...)
+}
+
+// Pickled (0, value) replies
+const (
+	replyNone       = "80049506000000000000004b004e86942e"
+	replyVersion110 = "8004950d000000000000004b008c05312e312e309486942e"
+	replyVersion102 = "8004950d000000000000004b008c05312e302e329486942e"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		output string
+		want   []int
+		newer  bool // at least perTicketBanTimeVersion
+	}{
+		{"1.1.0\n", []int{1, 1, 0}, true},
+		{"1.0.2", []int{1, 0, 2}, false},
+		{"Fail2Ban v0.10.6", []int{0, 10, 6}, false},
+		{"1.2", []int{1, 2, 0}, true},
+		{"2.0.0.dev1", []int{2, 0, 0}, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseVersion(tt.output)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseVersion(%q) = %v, %v; want %v", tt.output, got, ok, tt.want)
+			continue
+		}
+		if newer := versionAtLeast(got, perTicketBanTimeVersion); newer != tt.newer {
+			t.Errorf("versionAtLeast(%v) = %v, want %v", got, newer, tt.newer)
+		}
+	}
+	if _, ok := parseVersion("unknown"); ok {
+		t.Error("parseVersion() accepted output without a version")
+	}
+}
+
+func TestBanIPFor(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		version string
+		want    error
+		sent    []interface{} // the ban command, if sent
+	}{
+		{replyVersion110, nil, []interface{}{"set", "sshd", "banip", "--bantime", "7200", "192.0.2.1"}},
+		{replyVersion102, ErrUnsupported, nil},
+	}
+	for _, tt := range tests {
+		server := startFakeServer(t, func(args []interface{}) []byte {
+			if len(args) == 1 && args[0] == "version" {
+				return mustHex(t, tt.version)
+			}
+			return mustHex(t, replyNone)
+		})
+		client := NewSocketClient(server.path, "", false, time.Second)
+
+		// The version is read once
+		for i := 0; i < 2; i++ {
+			if err := client.BanIPFor(ctx, "sshd", "192.0.2.1", 7200); !errors.Is(err, tt.want) {
+				t.Fatalf("BanIPFor() = %v, want %v", err, tt.want)
+			}
+		}
+		commands := server.received()
+		want := [][]interface{}{{"version"}}
+		if tt.sent != nil {
+			want = append(want, tt.sent, tt.sent)
+		}
+		if !reflect.DeepEqual(commands, want) {
+			t.Errorf("server received %v, want %v", commands, want)
+		}
+	}
+}
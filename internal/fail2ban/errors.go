@@ -0,0 +1,56 @@
+package fail2ban
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TimeoutError is returned when a fail2ban command does not complete before
+// its deadline. The command is aborted when this happens.
+type TimeoutError struct {
+	Command string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("fail2ban command %q timed out", e.Command)
+}
+
+// IsTimeout reports whether err is (or wraps) a TimeoutError
+func IsTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// UnavailableError is returned when the fail2ban server cannot be reached,
+// usually because it is not running
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("fail2ban server unavailable: %v", e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// IsUnavailable reports whether err is (or wraps) an UnavailableError
+func IsUnavailable(err error) bool {
+	var unavailableErr *UnavailableError
+	return errors.As(err, &unavailableErr)
+}
+
+// contextError converts the failure of a command's context into the error
+// reported to the caller, or returns nil if the context is still live
+func contextError(ctx context.Context, args []string) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return &TimeoutError{Command: strings.Join(args, " ")}
+	case context.Canceled:
+		return fmt.Errorf("fail2ban command %q canceled: %w", strings.Join(args, " "), ctx.Err())
+	}
+	return nil
+}
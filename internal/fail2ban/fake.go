@@ -0,0 +1,437 @@
+package fail2ban
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultFakeJails are the jails simulated when none are configured
+var DefaultFakeJails = []string{"sshd", "nginx-http-auth", "recidive"}
+
+// FakeBackend is an in-memory fail2ban simulation for development and CI.
+// Bans expire after the jail's bantime just like on a real server. Like
+// fail2ban with its ban database, a stopped jail lifts its bans and restores
+// those that have not expired when it starts again.
+type FakeBackend struct {
+	mu    sync.Mutex
+	jails map[string]*fakeJail
+	order []string
+}
+
+type fakeJail struct {
+	running     bool
+	settings    JailSettings
+	bans        map[string]BanInfo // ip -> ban, kept while stopped
+	ignoreIPs   []string
+	totalBanned int
+}
+
+// NewFakeBackend creates a fake backend with the given jails. Bans last for
+// banTime (10 minutes if zero).
+func NewFakeBackend(jails []string, banTime time.Duration) *FakeBackend {
+	if len(jails) == 0 {
+		jails = DefaultFakeJails
+	}
+	if banTime <= 0 {
+		banTime = 10 * time.Minute
+	}
+
+	f := &FakeBackend{
+		jails: make(map[string]*fakeJail),
+	}
+	for _, name := range jails {
+		if _, exists := f.jails[name]; exists {
+			continue
+		}
+		f.jails[name] = &fakeJail{
+			running: true,
+			settings: JailSettings{
+				BanTime:    int(banTime / time.Second),
+				FindTime:   600,
+				MaxRetry:   5,
+				MaxMatches: intPtr(5),
+				UseDNS:     "warn",
+			},
+			bans:      make(map[string]BanInfo),
+			ignoreIPs: []string{"127.0.0.1/8", "::1"},
+		}
+		f.order = append(f.order, name)
+	}
+	return f
+}
+
+// jail returns a running jail with its expired bans removed. The caller must
+// hold f.mu.
+func (f *FakeBackend) jail(jailName string) (*fakeJail, error) {
+	j, exists := f.jails[jailName]
+	if !exists || !j.running {
+		return nil, fmt.Errorf("fail2ban-client error: jail %q does not exist", jailName)
+	}
+
+	now := time.Now()
+	for ip, ban := range j.bans {
+		if !ban.Permanent() && !now.Before(*ban.ExpiresAt) {
+			delete(j.bans, ip)
+		}
+	}
+	return j, nil
+}
+
+func (f *FakeBackend) runningJails() []string {
+	jails := []string{}
+	for _, name := range f.order {
+		if f.jails[name].running {
+			jails = append(jails, name)
+		}
+	}
+	return jails
+}
+
+// GetStatus returns the overall status of the simulated server
+func (f *FakeBackend) GetStatus(ctx context.Context) (*Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	jails := f.runningJails()
+	return &Status{
+		JailCount: len(jails),
+		Jails:     jails,
+	}, nil
+}
+
+// GetJails returns the running jails
+func (f *FakeBackend) GetJails(ctx context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.runningJails(), nil
+}
+
+// GetJailStatus returns the status of a jail
+func (f *FakeBackend) GetJailStatus(ctx context.Context, jailName string) (*JailStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return nil, err
+	}
+
+	bannedIPs := j.bannedIPs()
+	return &JailStatus{
+		Filter: FilterStatus{
+			FileList: []string{},
+		},
+		Actions: ActionsStatus{
+			CurrentlyBanned: len(bannedIPs),
+			TotalBanned:     j.totalBanned,
+			BannedIPs:       bannedIPs,
+		},
+	}, nil
+}
+
+// GetOverallStats returns overall statistics
+func (f *FakeBackend) GetOverallStats(ctx context.Context) (*OverallStats, error) {
+	return overallStats(ctx, f)
+}
+
+// GetBannedIPs returns the IPs currently banned in a jail
+func (f *FakeBackend) GetBannedIPs(ctx context.Context, jailName string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return nil, err
+	}
+	return j.bannedIPs(), nil
+}
+
+// GetBans returns the active bans of a jail
+func (f *FakeBackend) GetBans(ctx context.Context, jailName string) ([]BanInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return nil, err
+	}
+
+	bans := []BanInfo{}
+	for _, ip := range j.bannedIPs() {
+		bans = append(bans, j.bans[ip])
+	}
+	return bans, nil
+}
+
+// BannedIn returns the running jails in which an IP is banned
+func (f *FakeBackend) BannedIn(ctx context.Context, ip string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	jails := []string{}
+	for _, name := range f.runningJails() {
+		j, _ := f.jail(name)
+		if _, banned := j.bans[ip]; banned {
+			jails = append(jails, name)
+		}
+	}
+	return jails, nil
+}
+
+// BanIP bans an IP in a jail for the jail's bantime
+func (f *FakeBackend) BanIP(ctx context.Context, jailName, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	if _, banned := j.bans[ip]; !banned {
+		j.totalBanned++
+	}
+	j.bans[ip] = j.newBan(ip)
+	return nil
+}
+
+// BanIPFor bans an IP in a jail for banTime seconds, or permanently if
+// banTime is negative
+func (f *FakeBackend) BanIPFor(ctx context.Context, jailName, ip string, banTime int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	if _, banned := j.bans[ip]; !banned {
+		j.totalBanned++
+	}
+	j.bans[ip] = newBan(ip, banTime)
+	return nil
+}
+
+// UnbanIP removes a ban from a jail
+func (f *FakeBackend) UnbanIP(ctx context.Context, jailName, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	if _, banned := j.bans[ip]; !banned {
+		return fmt.Errorf("fail2ban-client error: %s is not banned", ip)
+	}
+	delete(j.bans, ip)
+	return nil
+}
+
+// UnbanIPEverywhere removes an IP from every running jail
+func (f *FakeBackend) UnbanIPEverywhere(ctx context.Context, ip string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, name := range f.runningJails() {
+		j, _ := f.jail(name)
+		if _, banned := j.bans[ip]; banned {
+			delete(j.bans, ip)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// UnbanAll removes every ban from every running jail
+func (f *FakeBackend) UnbanAll(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, name := range f.runningJails() {
+		j, _ := f.jail(name)
+		count += len(j.bans)
+		j.bans = make(map[string]BanInfo)
+	}
+	return count, nil
+}
+
+// GetIgnoreIPs returns the ignore list of a jail
+func (f *FakeBackend) GetIgnoreIPs(ctx context.Context, jailName string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, j.ignoreIPs...), nil
+}
+
+// AddIgnoreIP adds an IP or network to the ignore list of a jail
+func (f *FakeBackend) AddIgnoreIP(ctx context.Context, jailName, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	for _, existing := range j.ignoreIPs {
+		if existing == ip {
+			return nil
+		}
+	}
+	j.ignoreIPs = append(j.ignoreIPs, ip)
+	return nil
+}
+
+// DelIgnoreIP removes an IP or network from the ignore list of a jail
+func (f *FakeBackend) DelIgnoreIP(ctx context.Context, jailName, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	for i, existing := range j.ignoreIPs {
+		if existing == ip {
+			j.ignoreIPs = append(j.ignoreIPs[:i], j.ignoreIPs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// GetJailSettings returns the runtime parameters of a jail
+func (f *FakeBackend) GetJailSettings(ctx context.Context, jailName string) (*JailSettings, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return nil, err
+	}
+	settings := j.settings
+	if settings.MaxMatches != nil {
+		settings.MaxMatches = intPtr(*settings.MaxMatches)
+	}
+	return &settings, nil
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+// SetJailSettings changes runtime parameters of a jail
+func (f *FakeBackend) SetJailSettings(ctx context.Context, jailName string, update *JailSettingsUpdate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	if update.BanTime != nil {
+		j.settings.BanTime = *update.BanTime
+	}
+	if update.FindTime != nil {
+		j.settings.FindTime = *update.FindTime
+	}
+	if update.MaxRetry != nil {
+		j.settings.MaxRetry = *update.MaxRetry
+	}
+	if update.MaxMatches != nil {
+		j.settings.MaxMatches = intPtr(*update.MaxMatches)
+	}
+	if update.UseDNS != nil {
+		j.settings.UseDNS = *update.UseDNS
+	}
+	return nil
+}
+
+// StartJail starts a stopped jail, restoring its unexpired bans
+func (f *FakeBackend) StartJail(ctx context.Context, jailName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, exists := f.jails[jailName]
+	if !exists {
+		return fmt.Errorf("fail2ban-client error: jail %q is not configured", jailName)
+	}
+	if j.running {
+		return fmt.Errorf("fail2ban-client error: jail %q is already running", jailName)
+	}
+	j.running = true
+	return nil
+}
+
+// StopJail stops a jail, lifting its bans until it starts again
+func (f *FakeBackend) StopJail(ctx context.Context, jailName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, err := f.jail(jailName)
+	if err != nil {
+		return err
+	}
+	j.running = false
+	return nil
+}
+
+// RestartJail restarts a jail, or starts a stopped one, with its unexpired
+// bans
+func (f *FakeBackend) RestartJail(ctx context.Context, jailName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j, exists := f.jails[jailName]
+	if !exists {
+		return fmt.Errorf("fail2ban-client error: jail %q is not configured", jailName)
+	}
+	j.running = true
+	return nil
+}
+
+// ReloadJail reloads a jail
+func (f *FakeBackend) ReloadJail(ctx context.Context, jailName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err := f.jail(jailName)
+	return err
+}
+
+// newBan creates a ban starting now with the jail's bantime
+func (j *fakeJail) newBan(ip string) BanInfo {
+	return newBan(ip, j.settings.BanTime)
+}
+
+func newBan(ip string, banTime int) BanInfo {
+	now := time.Now()
+	ban := BanInfo{
+		IP:       ip,
+		BannedAt: now,
+		BanTime:  banTime,
+	}
+	if ban.BanTime >= 0 {
+		expiresAt := now.Add(time.Duration(ban.BanTime) * time.Second)
+		ban.ExpiresAt = &expiresAt
+	}
+	return ban
+}
+
+func (j *fakeJail) bannedIPs() []string {
+	ips := []string{}
+	for ip := range j.bans {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
@@ -0,0 +1,164 @@
+package fail2ban
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeBanExpiry(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeBackend([]string{"sshd"}, time.Minute)
+	f.BanIP(ctx, "sshd", "192.0.2.1")
+	f.BanIPFor(ctx, "sshd", "192.0.2.2", -1)
+	f.BanIPFor(ctx, "sshd", "192.0.2.3", 3600)
+
+	// Age the first and last bans: only the first is past its bantime
+	past := time.Now().Add(-2 * time.Minute)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.3"} {
+		ban := f.jails["sshd"].bans[ip]
+		expiresAt := past.Add(time.Duration(ban.BanTime) * time.Second)
+		ban.BannedAt, ban.ExpiresAt = past, &expiresAt
+		f.jails["sshd"].bans[ip] = ban
+	}
+
+	banned, err := f.GetBannedIPs(ctx, "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.2", "192.0.2.3"}; !reflect.DeepEqual(banned, want) {
+		t.Errorf("banned = %v, want %v", banned, want)
+	}
+	status, _ := f.GetJailStatus(ctx, "sshd")
+	if status.Actions.CurrentlyBanned != 2 || status.Actions.TotalBanned != 3 {
+		t.Errorf("status = %+v", status.Actions)
+	}
+}
+
+func TestFakeJailLifecycle(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeBackend([]string{"sshd", "nginx"}, time.Minute)
+	f.BanIP(ctx, "sshd", "192.0.2.1")
+
+	steps := []struct {
+		name    string
+		op      func() error
+		ok      bool
+		running []string
+		banned  bool // 192.0.2.1 in sshd, when running
+	}{
+		{"start a running jail", func() error { return f.StartJail(ctx, "sshd") }, false, []string{"sshd", "nginx"}, true},
+		{"restart a running jail", func() error { return f.RestartJail(ctx, "sshd") }, true, []string{"sshd", "nginx"}, true},
+		{"stop", func() error { return f.StopJail(ctx, "sshd") }, true, []string{"nginx"}, false},
+		{"stop a stopped jail", func() error { return f.StopJail(ctx, "sshd") }, false, []string{"nginx"}, false},
+		{"reload a stopped jail", func() error { return f.ReloadJail(ctx, "sshd") }, false, []string{"nginx"}, false},
+		{"start restores bans", func() error { return f.StartJail(ctx, "sshd") }, true, []string{"sshd", "nginx"}, true},
+		{"stop again", func() error { return f.StopJail(ctx, "sshd") }, true, []string{"nginx"}, false},
+		{"restart a stopped jail", func() error { return f.RestartJail(ctx, "sshd") }, true, []string{"sshd", "nginx"}, true},
+		{"start an unknown jail", func() error { return f.StartJail(ctx, "apache") }, false, []string{"sshd", "nginx"}, true},
+		{"restart an unknown jail", func() error { return f.RestartJail(ctx, "apache") }, false, []string{"sshd", "nginx"}, true},
+	}
+	for _, step := range steps {
+		if err := step.op(); (err == nil) != step.ok {
+			t.Errorf("%s: error = %v", step.name, err)
+		}
+		jails, _ := f.GetJails(ctx)
+		if !reflect.DeepEqual(jails, step.running) {
+			t.Errorf("%s: running jails = %v, want %v", step.name, jails, step.running)
+		}
+		banned, _ := f.BannedIn(ctx, "192.0.2.1")
+		if got := len(banned) == 1; got != step.banned {
+			t.Errorf("%s: banned in %v", step.name, banned)
+		}
+		if _, err := f.GetBannedIPs(ctx, "sshd"); (err == nil) != (len(jails) == 2) {
+			t.Errorf("%s: GetBannedIPs() error = %v", step.name, err)
+		}
+	}
+}
+
+func TestFakeUnban(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeBackend([]string{"sshd", "nginx", "recidive"}, time.Minute)
+	if err := f.UnbanIP(ctx, "sshd", "192.0.2.1"); err == nil {
+		t.Error("UnbanIP() of an IP that is not banned succeeded")
+	}
+	if err := f.UnbanIP(ctx, "apache", "192.0.2.1"); err == nil {
+		t.Error("UnbanIP() in an unknown jail succeeded")
+	}
+
+	for _, jail := range []string{"sshd", "nginx", "recidive"} {
+		f.BanIP(ctx, jail, "192.0.2.1")
+	}
+	f.BanIP(ctx, "sshd", "192.0.2.2")
+	f.BanIP(ctx, "nginx", "192.0.2.3")
+	f.StopJail(ctx, "recidive") // stopped jails are left alone
+
+	if err := f.UnbanIP(ctx, "sshd", "192.0.2.2"); err != nil {
+		t.Errorf("UnbanIP(): %v", err)
+	}
+	if err := f.UnbanIP(ctx, "sshd", "192.0.2.2"); err == nil {
+		t.Error("second UnbanIP() succeeded")
+	}
+
+	if n, err := f.UnbanIPEverywhere(ctx, "192.0.2.1"); err != nil || n != 2 {
+		t.Errorf("UnbanIPEverywhere() = %d, %v; want 2", n, err)
+	}
+	if n, _ := f.UnbanIPEverywhere(ctx, "192.0.2.1"); n != 0 {
+		t.Errorf("second UnbanIPEverywhere() = %d, want 0", n)
+	}
+	f.BanIP(ctx, "sshd", "192.0.2.4")
+	if n, err := f.UnbanAll(ctx); err != nil || n != 2 {
+		t.Errorf("UnbanAll() = %d, %v; want 2", n, err)
+	}
+	if n, _ := f.UnbanAll(ctx); n != 0 {
+		t.Errorf("second UnbanAll() = %d, want 0", n)
+	}
+
+	// The stopped jail keeps its ban for when it starts again
+	f.StartJail(ctx, "recidive")
+	if banned, _ := f.GetBannedIPs(ctx, "recidive"); len(banned) != 1 {
+		t.Errorf("recidive bans = %v, want the one made before it stopped", banned)
+	}
+}
+
+func TestFakeJailSettings(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeBackend([]string{"sshd"}, 10*time.Minute)
+	settings, err := f.GetJailSettings(ctx, "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.BanTime != 600 || settings.MaxMatches == nil || *settings.MaxMatches != 5 {
+		t.Errorf("default settings = %+v", settings)
+	}
+
+	// Returned settings are copies
+	*settings.MaxMatches = 99
+	settings.BanTime = 1
+	if again, _ := f.GetJailSettings(ctx, "sshd"); again.BanTime != 600 || *again.MaxMatches != 5 {
+		t.Errorf("changing returned settings changed the jail: %+v", again)
+	}
+
+	banTime, maxRetry, maxMatches, useDNS := 3600, 3, 10, "no"
+	update := &JailSettingsUpdate{BanTime: &banTime, MaxRetry: &maxRetry, MaxMatches: &maxMatches, UseDNS: &useDNS}
+	if err := f.SetJailSettings(ctx, "sshd", update); err != nil {
+		t.Fatal(err)
+	}
+	maxMatches = 1 // the update is copied, not kept
+	got, _ := f.GetJailSettings(ctx, "sshd")
+	want := JailSettings{BanTime: 3600, FindTime: 600, MaxRetry: 3, MaxMatches: intPtr(10), UseDNS: "no"}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("settings after update = %+v, want %+v", *got, want)
+	}
+
+	// New bans use the new bantime
+	f.BanIP(ctx, "sshd", "192.0.2.1")
+	if bans, _ := f.GetBans(ctx, "sshd"); len(bans) != 1 || bans[0].BanTime != 3600 {
+		t.Errorf("bans = %+v, want the new bantime", bans)
+	}
+
+	if err := f.SetJailSettings(ctx, "apache", update); err == nil {
+		t.Error("SetJailSettings() of an unknown jail succeeded")
+	}
+}
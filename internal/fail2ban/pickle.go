@@ -0,0 +1,597 @@
+package fail2ban
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+)
+
+// The fail2ban server speaks Python's pickle format over its socket. Only the
+// small subset needed to send a list of strings and to decode the replies
+// (lists, tuples, dicts, scalars and exception objects) is implemented here.
+
+// Pickle opcodes
+const (
+	opMark            = '('
+	opStop            = '.'
+	opPop             = '0'
+	opPopMark         = '1'
+	opDup             = '2'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opBinInt2         = 'M'
+	opNone            = 'N'
+	opBinUnicode      = 'X'
+	opAppend          = 'a'
+	opBuild           = 'b'
+	opGlobal          = 'c'
+	opDict            = 'd'
+	opEmptyDict       = '}'
+	opAppends         = 'e'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opList            = 'l'
+	opEmptyList       = ']'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opSetItem         = 's'
+	opTuple           = 't'
+	opEmptyTuple      = ')'
+	opSetItems        = 'u'
+	opBinFloat        = 'G'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opReduce          = 'R'
+	opProto           = '\x80'
+	opNewObj          = '\x81'
+	opTuple1          = '\x85'
+	opTuple2          = '\x86'
+	opTuple3          = '\x87'
+	opNewTrue         = '\x88'
+	opNewFalse        = '\x89'
+	opLong1           = '\x8a'
+	opLong4           = '\x8b'
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opShortBinUnicode = '\x8c'
+	opBinUnicode8     = '\x8d'
+	opBinBytes8       = '\x8e'
+	opEmptySet        = '\x8f'
+	opAddItems        = '\x90'
+	opFrozenSet       = '\x91'
+	opNewObjEx        = '\x92'
+	opStackGlobal     = '\x93'
+	opMemoize         = '\x94'
+	opFrame           = '\x95'
+)
+
+// pyGlobal is a reference to a Python class or function
+type pyGlobal struct {
+	Module string
+	Name   string
+}
+
+// pyObject is an instance reconstructed from a class reference and its
+// constructor arguments, e.g. an exception raised by the fail2ban server
+type pyObject struct {
+	Class pyGlobal
+	Args  []interface{}
+	State interface{}
+}
+
+// encodeCommand pickles a command as a list of strings (protocol 2)
+func encodeCommand(args []string) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{opProto, 2, opEmptyList, opMark})
+	for _, arg := range args {
+		buf.WriteByte(opBinUnicode)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(arg)))
+		buf.WriteString(arg)
+	}
+	buf.Write([]byte{opAppends, opStop})
+	return buf.Bytes()
+}
+
+// markObject is pushed on the stack by the MARK opcode
+type markObject struct{}
+
+// pyList is a mutable list or set under construction. Lists can be memoized
+// before their items are appended, so they are shared by pointer while
+// decoding and flattened into []interface{} once decoding is complete.
+type pyList struct {
+	items []interface{}
+}
+
+type unpickler struct {
+	r     *bytes.Reader
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// decodePickle decodes a pickled reply from the fail2ban server. Lists and
+// tuples both decode to []interface{}, integers to int64, strings to string.
+func decodePickle(data []byte) (interface{}, error) {
+	u := &unpickler{
+		r:    bytes.NewReader(data),
+		memo: make(map[int]interface{}),
+	}
+	return u.load()
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("pickle: stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("pickle: stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops every item pushed since the last MARK
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(markObject); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("pickle: mark not found")
+}
+
+func (u *unpickler) readN(n uint64) ([]byte, error) {
+	if n > uint64(u.r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(u.r, b)
+	return b, err
+}
+
+func (u *unpickler) readUint(size int) (uint64, error) {
+	b, err := u.readN(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := u.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("pickle: %w", io.ErrUnexpectedEOF)
+		}
+
+		switch op {
+		case opProto:
+			if _, err := u.r.ReadByte(); err != nil {
+				return nil, err
+			}
+		case opFrame:
+			if _, err := u.readN(8); err != nil {
+				return nil, err
+			}
+		case opStop:
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			f := &flattener{budget: maxPickleValuesPerByte * int(u.r.Size())}
+			return f.flatten(v, 0)
+		case opMark:
+			u.push(markObject{})
+		case opPop:
+			if _, err := u.pop(); err != nil {
+				return nil, err
+			}
+		case opPopMark:
+			if _, err := u.popMark(); err != nil {
+				return nil, err
+			}
+		case opDup:
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+		case opNone:
+			u.push(nil)
+		case opNewTrue:
+			u.push(true)
+		case opNewFalse:
+			u.push(false)
+		case opBinInt:
+			v, err := u.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(int32(v)))
+		case opBinInt1:
+			v, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(v))
+		case opBinInt2:
+			v, err := u.readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(v))
+		case opLong1, opLong4:
+			size := 1
+			if op == opLong4 {
+				size = 4
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			b, err := u.readN(n)
+			if err != nil {
+				return nil, err
+			}
+			u.push(decodeLong(b))
+		case opBinFloat:
+			b, err := u.readN(8)
+			if err != nil {
+				return nil, err
+			}
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case opShortBinUnicode, opBinUnicode, opBinUnicode8,
+			opShortBinString, opBinString:
+			size := 4
+			switch op {
+			case opShortBinUnicode, opShortBinString:
+				size = 1
+			case opBinUnicode8:
+				size = 8
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			b, err := u.readN(n)
+			if err != nil {
+				return nil, err
+			}
+			u.push(string(b))
+		case opShortBinBytes, opBinBytes, opBinBytes8:
+			size := 4
+			switch op {
+			case opShortBinBytes:
+				size = 1
+			case opBinBytes8:
+				size = 8
+			}
+			n, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			b, err := u.readN(n)
+			if err != nil {
+				return nil, err
+			}
+			u.push(b)
+		case opEmptyList, opEmptySet:
+			u.push(&pyList{})
+		case opEmptyTuple:
+			u.push([]interface{}{})
+		case opEmptyDict:
+			u.push(map[string]interface{}{})
+		case opList:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(&pyList{items: items})
+		case opTuple, opFrozenSet:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(items)
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(u.stack) < n {
+				return nil, errors.New("pickle: stack underflow")
+			}
+			items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(items)
+		case opDict:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			d := make(map[string]interface{})
+			for i := 0; i+1 < len(items); i += 2 {
+				d[fmt.Sprint(items[i])] = items[i+1]
+			}
+			u.push(d)
+		case opAppend:
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.extendTop([]interface{}{v}); err != nil {
+				return nil, err
+			}
+		case opAppends, opAddItems:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.extendTop(items); err != nil {
+				return nil, err
+			}
+		case opSetItem:
+			value, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			key, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.setItems([]interface{}{key, value}); err != nil {
+				return nil, err
+			}
+		case opSetItems:
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.setItems(items); err != nil {
+				return nil, err
+			}
+		case opBinPut, opLongBinPut:
+			size := 1
+			if op == opLongBinPut {
+				size = 4
+			}
+			idx, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.memo[int(idx)] = v
+		case opMemoize:
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.memo[len(u.memo)] = v
+		case opBinGet, opLongBinGet:
+			size := 1
+			if op == opLongBinGet {
+				size = 4
+			}
+			idx, err := u.readUint(size)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := u.memo[int(idx)]
+			if !ok {
+				return nil, fmt.Errorf("pickle: memo key %d not found", idx)
+			}
+			u.push(v)
+		case opGlobal:
+			module, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			name, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			u.push(pyGlobal{Module: module, Name: name})
+		case opStackGlobal:
+			name, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			module, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			u.push(pyGlobal{Module: fmt.Sprint(module), Name: fmt.Sprint(name)})
+		case opReduce, opNewObj:
+			args, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			class, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			u.push(newPyObject(class, args))
+		case opNewObjEx:
+			if _, err := u.pop(); err != nil { // kwargs
+				return nil, err
+			}
+			args, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			class, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			u.push(newPyObject(class, args))
+		case opBuild:
+			state, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			obj, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			if obj, ok := obj.(*pyObject); ok {
+				obj.State = state
+			}
+		default:
+			return nil, fmt.Errorf("pickle: unsupported opcode 0x%02x", op)
+		}
+	}
+}
+
+// extendTop appends items to the list or set on top of the stack
+func (u *unpickler) extendTop(items []interface{}) error {
+	top, err := u.top()
+	if err != nil {
+		return err
+	}
+	list, ok := top.(*pyList)
+	if !ok {
+		return fmt.Errorf("pickle: cannot append to %T", top)
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) setItems(items []interface{}) error {
+	top, err := u.top()
+	if err != nil {
+		return err
+	}
+	d, ok := top.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("pickle: cannot set item on %T", top)
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		d[fmt.Sprint(items[i])] = items[i+1]
+	}
+	return nil
+}
+
+// Limits on decoded values. Memoized objects may be shared or even contain
+// themselves, so a malformed reply could otherwise expand without bound.
+const (
+	maxPickleDepth         = 100
+	maxPickleValuesPerByte = 16
+)
+
+// flattener replaces every *pyList in a decoded value with a plain slice
+type flattener struct {
+	budget int // values left to produce
+}
+
+func (f *flattener) flatten(v interface{}, depth int) (interface{}, error) {
+	if depth > maxPickleDepth {
+		return nil, errors.New("pickle: value nested too deeply")
+	}
+	if f.budget--; f.budget < 0 {
+		return nil, errors.New("pickle: value too large for its encoding")
+	}
+
+	switch val := v.(type) {
+	case *pyList:
+		return f.flatten(val.items, depth)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			flat, err := f.flatten(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = flat
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			flat, err := f.flatten(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = flat
+		}
+		return out, nil
+	case *pyObject:
+		args, err := f.flatten(val.Args, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		state, err := f.flatten(val.State, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return &pyObject{Class: val.Class, Args: args.([]interface{}), State: state}, nil
+	}
+	return v, nil
+}
+
+func newPyObject(class, args interface{}) *pyObject {
+	obj := &pyObject{}
+	if g, ok := class.(pyGlobal); ok {
+		obj.Class = g
+	}
+	if a, ok := args.([]interface{}); ok {
+		obj.Args = a
+	}
+	return obj
+}
+
+// decodeLong decodes a little-endian two's complement integer
+func decodeLong(b []byte) interface{} {
+	if len(b) == 0 {
+		return int64(0)
+	}
+	if len(b) <= 8 {
+		var v uint64
+		for i := len(b) - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		shift := uint(64 - 8*len(b))
+		return int64(v<<shift) >> shift
+	}
+
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	n := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	return n.String()
+}
@@ -0,0 +1,352 @@
+package fail2ban
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replies pickled by CPython's pickle.dumps at each protocol fail2ban may use
+var pickledReplies = []struct {
+	name     string
+	protocol int
+	hex      string
+}{
+	{"pong", 2, "80024b005804000000706f6e6771008671012e"},
+	{"pong", 4, "8004950c000000000000004b008c04706f6e679486942e"},
+	{"pong", 5, "8005950c000000000000004b008c04706f6e679486942e"},
+	{"status", 2, "80024b005d710028580e0000004e756d626572206f66206a61696c71014b0286710258090000004a61696c206c6973747103580b000000737368642c206e67696e787104867105658671062e"},
+	{"status", 4, "8004953a000000000000004b005d94288c0e4e756d626572206f66206a61696c944b0286948c094a61696c206c697374948c0b737368642c206e67696e789486946586942e"},
+	{"jail", 3, "80034b005d710028580600000046696c74657271015d710228581000000043757272656e746c79206661696c656471034b01867104580c000000546f74616c206661696c656471054b07867106580900000046696c65206c69737471075d710858110000002f7661722f6c6f672f617574682e6c6f6771096186710a6586710b5807000000416374696f6e73710c5d710d28581000000043757272656e746c792062616e6e6564710e4b0286710f580c000000546f74616c2062616e6e656471104b09867111580e00000042616e6e6564204950206c69737471125d71132858090000003139322e302e322e317114580b000000323030313a6462383a3a3171156586711665867117658671182e"},
+	{"jail", 4, "800495d2000000000000004b005d94288c0646696c746572945d94288c1043757272656e746c79206661696c6564944b0186948c0c546f74616c206661696c6564944b0786948c0946696c65206c697374945d948c112f7661722f6c6f672f617574682e6c6f67946186946586948c07416374696f6e73945d94288c1043757272656e746c792062616e6e6564944b0286948c0c546f74616c2062616e6e6564944b0986948c0e42616e6e6564204950206c697374945d94288c093139322e302e322e31948c0b323030313a6462383a3a31946586946586946586942e"},
+}
+
+// jailReply is the decoded form of the "jail" replies above; the last of
+// them is also served by the fake socket in TestSocketClient
+var jailReply = []interface{}{int64(0), []interface{}{
+	[]interface{}{"Filter", []interface{}{
+		[]interface{}{"Currently failed", int64(1)},
+		[]interface{}{"Total failed", int64(7)},
+		[]interface{}{"File list", []interface{}{"/var/log/auth.log"}},
+	}},
+	[]interface{}{"Actions", []interface{}{
+		[]interface{}{"Currently banned", int64(2)},
+		[]interface{}{"Total banned", int64(9)},
+		[]interface{}{"Banned IP list", []interface{}{"192.0.2.1", "2001:db8::1"}},
+	}},
+}}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodePickleReplies(t *testing.T) {
+	want := map[string]interface{}{
+		"pong":   []interface{}{int64(0), "pong"},
+		"status": []interface{}{int64(0), []interface{}{[]interface{}{"Number of jail", int64(2)}, []interface{}{"Jail list", "sshd, nginx"}}},
+		"jail":   jailReply,
+	}
+	for _, tt := range pickledReplies {
+		got, err := decodePickle(mustHex(t, tt.hex))
+		if err != nil {
+			t.Errorf("%s (protocol %d): %v", tt.name, tt.protocol, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want[tt.name]) {
+			t.Errorf("%s (protocol %d) = %#v, want %#v", tt.name, tt.protocol, got, want[tt.name])
+		}
+	}
+}
+
+func TestDecodePickleValues(t *testing.T) {
+	// (0, [None, True, False, -1, 255, 65535, -70000, 2**40, 2**70, -2**70,
+	//      1.5, b'raw', 'café', {'a': 1}]) at protocol 4
+	data := mustHex(t, "80049559000000000000004b005d94284e88894affffffff4bff4dffff4a90eefeff8a060000000000018a090000000000000000408a090000000000000000c0473ff80000000000004303726177948c05636166c3a9947d948c0161944b01736586942e")
+	got, err := decodePickle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{int64(0), []interface{}{
+		nil, true, false, int64(-1), int64(255), int64(65535), int64(-70000),
+		int64(1 << 40), "1180591620717411303424", "-1180591620717411303424",
+		1.5, []byte("raw"), "café", map[string]interface{}{"a": int64(1)},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decodePickle() = %#v, want %#v", got, want)
+	}
+
+	// Memoized objects are shared: (0, [shared, shared]) with shared = ['same']
+	got, err = decodePickle(mustHex(t, "80049515000000000000004b005d94285d948c0473616d65946168016586942e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []interface{}{int64(0), []interface{}{[]interface{}{"same"}, []interface{}{"same"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("memoized decodePickle() = %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodePickleException(t *testing.T) {
+	for _, s := range []string{
+		// Protocol 2 references exceptions.Exception, protocol 4 builtins.Exception
+		"80024b0163657863657074696f6e730a457863657074696f6e0a71005836000000496e76616c696420636f6d6d616e6420286e6f2067657420616374696f6e206f72206e6f742079657420696d706c656d656e7465642971018571025271038671042e",
+		"8004955b000000000000004b018c086275696c74696e73948c09457863657074696f6e9493948c36496e76616c696420636f6d6d616e6420286e6f2067657420616374696f6e206f72206e6f742079657420696d706c656d656e74656429948594529486942e",
+	} {
+		got, err := decodePickle(mustHex(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := got.([]interface{})
+		if reply[0] != int64(1) {
+			t.Errorf("code = %v, want 1", reply[0])
+		}
+		if desc := describeValue(reply[1]); desc != "Exception: Invalid command (no get action or not yet implemented)" {
+			t.Errorf("describeValue() = %q", desc)
+		}
+	}
+}
+
+func TestDecodePickleInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"8002",                   // no STOP
+		"80025d652e",             // APPENDS without MARK
+		"8002680f2e",             // BINGET of an unknown memo slot
+		"8002ff2e",               // unknown opcode
+		"80025804000000706f2e",   // string shorter than its length
+		"8002302e",               // POP of an empty stack
+		"8002312e",               // POP_MARK without MARK
+		"8002322e",               // DUP of an empty stack
+		"8002612e",               // APPEND to nothing
+		"80024e4b01612e",         // APPEND to None
+		"80024b01732e",           // SETITEM with one item
+		"80025d4b014b02732e",     // SETITEM on a list
+		"80027100",               // BINPUT of an empty stack
+		"8002942e",               // MEMOIZE of an empty stack
+		"8002852e",               // TUPLE1 of an empty stack
+		"80024b0187",             // TUPLE3 of one item
+		"8002932e",               // STACK_GLOBAL of an empty stack
+		"8002522e",               // REDUCE of an empty stack
+		"80024e812e",             // NEWOBJ with one item
+		"80024e4e922e",           // NEWOBJ_EX with two items
+		"8002622e",               // BUILD of an empty stack
+		"80024e622e",             // BUILD with nothing to build
+		"80024a0100",             // BININT cut short
+		"80028c",                 // SHORT_BINUNICODE without its length
+		"80028a05ff",             // LONG1 shorter than its length
+		"800263627569",           // GLOBAL without a newline
+		"80025d7100680061682e",   // list containing itself
+		"80027d71004b016800732e", // dict containing itself
+	} {
+		if _, err := decodePickle(mustHex(t, s)); err == nil {
+			t.Errorf("decodePickle(%s) succeeded", s)
+		}
+	}
+
+	// Doubling a memoized list 40 times describes 2^40 values in a few
+	// hundred bytes
+	var bomb bytes.Buffer
+	bomb.Write([]byte{opProto, 4, opEmptyList, opBinPut, 0})
+	for i := 0; i < 40; i++ {
+		bomb.Write([]byte{opMark, opBinGet, byte(i), opBinGet, byte(i), opList, opBinPut, byte(i + 1)})
+	}
+	bomb.WriteByte(opStop)
+	if _, err := decodePickle(bomb.Bytes()); err == nil {
+		t.Error("decodePickle() of an exponentially shared list succeeded")
+	}
+}
+
+// Replies cut short anywhere fail to decode instead of panicking
+func TestDecodePickleTruncated(t *testing.T) {
+	for _, tt := range pickledReplies {
+		data := mustHex(t, tt.hex)
+		for n := 0; n < len(data); n++ {
+			if _, err := decodePickle(data[:n]); err == nil {
+				t.Errorf("%s (protocol %d) cut to %d bytes: decoded", tt.name, tt.protocol, n)
+			}
+		}
+	}
+}
+
+func FuzzDecodePickle(f *testing.F) {
+	for _, tt := range pickledReplies {
+		b, _ := hex.DecodeString(tt.hex)
+		f.Add(b)
+	}
+	f.Add(encodeCommand([]string{"set", "sshd", "banip", "192.0.2.1"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := decodePickle(data)
+		if err == nil {
+			describeValue(v)
+		}
+	})
+}
+
+func TestEncodeCommandRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"ping"},
+		{"status", "sshd"},
+		{"set", "sshd", "banip", "192.0.2.1", "2001:db8::/64"},
+		{"set", "sshd", "addignoreip", "café", ""},
+		{},
+	}
+	for _, args := range tests {
+		data := encodeCommand(args)
+		if !bytes.HasPrefix(data, []byte{opProto, 2}) {
+			t.Errorf("encodeCommand(%q) is not protocol 2", args)
+		}
+		got, err := decodePickle(data)
+		if err != nil {
+			t.Errorf("decodePickle(encodeCommand(%q)): %v", args, err)
+			continue
+		}
+		want := make([]interface{}, len(args))
+		for i, arg := range args {
+			want[i] = arg
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip of %q = %#v", args, got)
+		}
+	}
+}
+
+func TestStatusReplyFields(t *testing.T) {
+	status := statusReplyFields(jailReply[1]).jailStatus()
+	want := &JailStatus{
+		Filter:  FilterStatus{CurrentlyFailed: 1, TotalFailed: 7, FileList: []string{"/var/log/auth.log"}},
+		Actions: ActionsStatus{CurrentlyBanned: 2, TotalBanned: 9, BannedIPs: []string{"192.0.2.1", "2001:db8::1"}},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("jailStatus() = %+v, want %+v", status, want)
+	}
+}
+
+func TestParseStatusOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   interface{}
+	}{
+		{
+			name: "server",
+			output: "Status\n" +
+				"|- Number of jail:\t2\n" +
+				"`- Jail list:\tsshd, nginx\n",
+			want: &Status{JailCount: 2, Jails: []string{"sshd", "nginx"}},
+		},
+		{
+			name: "jail",
+			output: "Status for the jail: sshd\n" +
+				"|- Filter\n" +
+				"|  |- Currently failed:\t1\n" +
+				"|  |- Total failed:\t7\n" +
+				"|  `- File list:\t/var/log/auth.log\n" +
+				"`- Actions\n" +
+				"   |- Currently banned:\t2\n" +
+				"   |- Total banned:\t9\n" +
+				"   `- Banned IP list:\t192.0.2.1 2001:db8::1\n",
+			want: &JailStatus{
+				Filter:  FilterStatus{CurrentlyFailed: 1, TotalFailed: 7, FileList: []string{"/var/log/auth.log"}},
+				Actions: ActionsStatus{CurrentlyBanned: 2, TotalBanned: 9, BannedIPs: []string{"192.0.2.1", "2001:db8::1"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		fields := parseStatusOutput(tt.output)
+		var got interface{}
+		if tt.name == "server" {
+			got = fields.status()
+		} else {
+			got = fields.jailStatus()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseListOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   []string
+	}{
+		{"These IP addresses/networks are ignored:\n|- 127.0.0.0/8\n`- ::1\n", []string{"127.0.0.0/8", "::1"}},
+		{"No IP address/network is ignored\n", []string{}},
+	}
+	for _, tt := range tests {
+		if got := parseListOutput(tt.output); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListOutput(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+// serveSocket answers every command on a unix socket with the given pickled
+// reply, recording the commands it received
+func serveSocket(t *testing.T, reply []byte) (string, <-chan []interface{}) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fail2ban.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	commands := make(chan []interface{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var buf bytes.Buffer
+		chunk := make([]byte, 1024)
+		for !bytes.HasSuffix(buf.Bytes(), []byte(socketEndCommand)) {
+			n, err := conn.Read(chunk)
+			buf.Write(chunk[:n])
+			if err != nil {
+				return
+			}
+		}
+		cmd, _ := decodePickle(bytes.TrimSuffix(buf.Bytes(), []byte(socketEndCommand)))
+		args, _ := cmd.([]interface{})
+		commands <- args
+		conn.Write(append(reply, socketEndCommand...))
+	}()
+	return path, commands
+}
+
+func TestSocketClient(t *testing.T) {
+	ctx := context.Background()
+
+	path, commands := serveSocket(t, mustHex(t, pickledReplies[len(pickledReplies)-1].hex))
+	client := NewSocketClient(path, "", false, time.Second)
+	status, err := client.GetJailStatus(ctx, "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-commands; !reflect.DeepEqual(got, []interface{}{"status", "sshd"}) {
+		t.Errorf("server received %#v", got)
+	}
+	if status.Actions.CurrentlyBanned != 2 || len(status.Actions.BannedIPs) != 2 {
+		t.Errorf("GetJailStatus() = %+v", status)
+	}
+
+	// Exceptions raised by the server become errors
+	path, _ = serveSocket(t, mustHex(t, "8004955b000000000000004b018c086275696c74696e73948c09457863657074696f6e9493948c36496e76616c696420636f6d6d616e6420286e6f2067657420616374696f6e206f72206e6f742079657420696d706c656d656e74656429948594529486942e"))
+	client = NewSocketClient(path, "", false, time.Second)
+	_, err = client.GetJailStatus(ctx, "sshd")
+	if err == nil || !strings.Contains(err.Error(), "Invalid command") {
+		t.Errorf("error = %v, want the server exception", err)
+	}
+}
@@ -0,0 +1,131 @@
+package fail2ban
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JailSettings holds the runtime parameters of a jail. Parameters the
+// fail2ban server does not support are left out.
+type JailSettings struct {
+	BanTime    int    `json:"bantime"`  // seconds, -1 bans permanently
+	FindTime   int    `json:"findtime"` // seconds
+	MaxRetry   int    `json:"maxretry"`
+	MaxMatches *int   `json:"maxmatches,omitempty"` // fail2ban 0.10 and later
+	UseDNS     string `json:"usedns,omitempty"`
+}
+
+// requiredSettings are the jail parameters every fail2ban version supports;
+// optionalSettings may be unknown to older servers
+var (
+	requiredSettings = []string{"bantime", "findtime", "maxretry"}
+	optionalSettings = []string{"maxmatches", "usedns"}
+)
+
+// JailSettingsUpdate lists the parameters to change on a jail. Nil fields are
+// left untouched.
+type JailSettingsUpdate struct {
+	BanTime    *int
+	FindTime   *int
+	MaxRetry   *int
+	MaxMatches *int
+	UseDNS     *string
+}
+
+// UseDNSModes are the values accepted for the usedns parameter
+var UseDNSModes = []string{"yes", "warn", "no", "raw"}
+
+// params returns the fail2ban parameter names and values to set, in order
+func (u *JailSettingsUpdate) params() [][2]string {
+	var params [][2]string
+	if u.BanTime != nil {
+		params = append(params, [2]string{"bantime", strconv.Itoa(*u.BanTime)})
+	}
+	if u.FindTime != nil {
+		params = append(params, [2]string{"findtime", strconv.Itoa(*u.FindTime)})
+	}
+	if u.MaxRetry != nil {
+		params = append(params, [2]string{"maxretry", strconv.Itoa(*u.MaxRetry)})
+	}
+	if u.MaxMatches != nil {
+		params = append(params, [2]string{"maxmatches", strconv.Itoa(*u.MaxMatches)})
+	}
+	if u.UseDNS != nil {
+		params = append(params, [2]string{"usedns", *u.UseDNS})
+	}
+	return params
+}
+
+// parseJailSettings converts the values returned by "get <jail> <param>".
+// Optional parameters missing from values are left out.
+func parseJailSettings(values map[string]string) (*JailSettings, error) {
+	settings := &JailSettings{
+		UseDNS: strings.TrimSpace(values["usedns"]),
+	}
+	for param, target := range map[string]*int{
+		"bantime":  &settings.BanTime,
+		"findtime": &settings.FindTime,
+		"maxretry": &settings.MaxRetry,
+	} {
+		n, err := strconv.Atoi(strings.TrimSpace(values[param]))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected %s value %q", param, values[param])
+		}
+		*target = n
+	}
+	if value, ok := values["maxmatches"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected maxmatches value %q", value)
+		}
+		settings.MaxMatches = &n
+	}
+	return settings, nil
+}
+
+var durationPart = regexp.MustCompile(`(\d+)\s*([a-z]*)`)
+
+var durationUnits = map[string]time.Duration{
+	"":  time.Second, // a number without a unit, as in "1h30"
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// ParseDuration parses a time span the way fail2ban does: a plain number of
+// seconds ("600") or a combination of units ("1h30m", "7d", "2w"), in which
+// numbers without a unit are seconds ("1h30" is 1h0m30s).
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	var total time.Duration
+	rest := s
+	for _, match := range durationPart.FindAllStringSubmatchIndex(s, -1) {
+		n, err := strconv.Atoi(s[match[2]:match[3]])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		unit := s[match[4]:match[5]]
+		mult, ok := durationUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q: unknown unit %q", s, unit)
+		}
+		total += time.Duration(n) * mult
+		rest = strings.Replace(rest, s[match[0]:match[1]], "", 1)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return total, nil
+}
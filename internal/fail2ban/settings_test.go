@@ -0,0 +1,46 @@
+package fail2ban
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"600", 10 * time.Minute, true},
+		{" 600 ", 10 * time.Minute, true},
+		{"-1", -time.Second, true}, // fail2ban's permanent ban time
+		{"10m", 10 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"1h 30m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"1 week 2 days", 9 * 24 * time.Hour, true},
+		{"45sec", 45 * time.Second, true},
+		{"3 Hours", 3 * time.Hour, true},
+		{"1h30", time.Hour + 30*time.Second, true},
+		{"1h 30", time.Hour + 30*time.Second, true},
+		{"10m5s30", 10*time.Minute + 35*time.Second, true},
+		{"", 0, false},
+		{"permanent", 0, false},
+		{"5y", 0, false},
+		{"10m!", 0, false},
+		{"1.5h", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("ParseDuration(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package fail2ban
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Markers framing every message on the fail2ban server socket
+const (
+	socketEndCommand   = "<F2B_END_COMMAND>"
+	socketCloseCommand = "<F2B_CLOSE_COMMAND>"
+)
+
+// DefaultSocketPath is where fail2ban-server listens by default
+const DefaultSocketPath = "/var/run/fail2ban/fail2ban.sock"
+
+// NewSocketClient creates a client that talks directly to the fail2ban server
+// socket instead of running fail2ban-client. The client path is still needed
+// for commands that require fail2ban-client to read the jail configuration.
+func NewSocketClient(socketPath, clientPath string, useSudo bool, timeout time.Duration) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Client{
+		clientPath: clientPath,
+		useSudo:    useSudo,
+		socketPath: socketPath,
+		timeout:    timeout,
+	}
+}
+
+// transmit sends one command to the fail2ban server and returns its reply
+func (c *Client) transmit(ctx context.Context, args ...string) (interface{}, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		if ctxErr := contextError(ctx, args); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("permission denied: cannot access fail2ban socket %s. Run the server as root or grant this user access to the socket. Error: %v", c.socketPath, err)
+		}
+		return nil, &UnavailableError{Err: err}
+	}
+	defer conn.Close()
+
+	// Unblock pending reads and writes as soon as the context is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(append(encodeCommand(args), socketEndCommand...)); err != nil {
+		if ctxErr := contextError(ctx, args); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("fail2ban socket error: %w", err)
+	}
+
+	var reply bytes.Buffer
+	buf := make([]byte, 4096)
+	for !bytes.HasSuffix(reply.Bytes(), []byte(socketEndCommand)) {
+		n, err := conn.Read(buf)
+		reply.Write(buf[:n])
+		if err != nil {
+			if bytes.HasSuffix(reply.Bytes(), []byte(socketEndCommand)) {
+				break
+			}
+			if ctxErr := contextError(ctx, args); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, fmt.Errorf("fail2ban socket error: %w", err)
+		}
+	}
+
+	// Let the server release the connection
+	conn.Write([]byte(socketCloseCommand + socketEndCommand))
+
+	data := bytes.TrimSuffix(reply.Bytes(), []byte(socketEndCommand))
+	decoded, err := decodePickle(data)
+	if err != nil {
+		return nil, fmt.Errorf("fail2ban socket error: invalid reply: %w", err)
+	}
+
+	// Replies are (code, value) where a non-zero code carries an exception
+	ack, ok := decoded.([]interface{})
+	if !ok || len(ack) != 2 {
+		return nil, fmt.Errorf("fail2ban socket error: unexpected reply %v", decoded)
+	}
+	if code, _ := ack[0].(int64); code != 0 {
+		return nil, fmt.Errorf("fail2ban server error: %s", describeValue(ack[1]))
+	}
+
+	return ack[1], nil
+}
+
+// describeValue renders a reply value the way fail2ban-client prints it
+func describeValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case []interface{}:
+		parts := make([]string, 0, len(val))
+		for _, item := range val {
+			parts = append(parts, describeValue(item))
+		}
+		return strings.Join(parts, " ")
+	case *pyObject:
+		if len(val.Args) > 0 {
+			return fmt.Sprintf("%s: %s", val.Class.Name, describeValue(val.Args))
+		}
+		return val.Class.Name
+	}
+	return fmt.Sprint(v)
+}
+
+// replyStrings converts a list reply into a slice of strings
+func replyStrings(v interface{}) []string {
+	items, ok := v.([]interface{})
+	if !ok {
+		if s := describeValue(v); s != "" {
+			return strings.Fields(s)
+		}
+		return nil
+	}
+	var out []string
+	for _, item := range items {
+		if s := describeValue(item); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
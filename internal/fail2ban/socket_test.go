@@ -0,0 +1,174 @@
+package fail2ban
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startStallingServer listens like a fail2ban server that accepts commands
+// but never answers. Each connection's end is reported on the returned
+// channel once the client closes it.
+func startStallingServer(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fail2ban.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	closed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						closed <- struct{}{}
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return path, closed
+}
+
+func TestSocketAborted(t *testing.T) {
+	path, closed := startStallingServer(t)
+
+	tests := []struct {
+		name     string
+		timeout  time.Duration // of the client
+		ctx      func() (context.Context, context.CancelFunc)
+		timedOut bool
+	}{
+		{
+			name:    "request canceled",
+			timeout: time.Minute,
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+		},
+		{
+			name:    "request deadline",
+			timeout: time.Minute,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 50*time.Millisecond)
+			},
+			timedOut: true,
+		},
+		{
+			name:    "client timeout",
+			timeout: 50 * time.Millisecond,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			timedOut: true,
+		},
+	}
+	for _, tt := range tests {
+		client := NewSocketClient(path, "", false, tt.timeout)
+		ctx, cancel := tt.ctx()
+		start := time.Now()
+		_, err := client.GetJails(ctx)
+		cancel()
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: returned after %v", tt.name, elapsed)
+		}
+		if IsTimeout(err) != tt.timedOut || IsUnavailable(err) {
+			t.Errorf("%s: error = %v, want timeout %v", tt.name, err, tt.timedOut)
+		}
+		if !tt.timedOut && !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: error = %v, want one wrapping context.Canceled", tt.name, err)
+		}
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: connection to the server left open", tt.name)
+		}
+	}
+}
+
+func TestSocketUnavailable(t *testing.T) {
+	client := NewSocketClient(filepath.Join(t.TempDir(), "fail2ban.sock"), "", false, time.Minute)
+	_, err := client.GetJails(context.Background())
+	if !IsUnavailable(err) || IsTimeout(err) {
+		t.Errorf("error = %v, want an UnavailableError", err)
+	}
+}
+
+// fakeClientScript writes a stand-in for fail2ban-client
+func fakeClientScript(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fail2ban-client")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecAborted(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	hung := fakeClientScript(t, "exec sleep 60")
+
+	// The client timeout kills the process
+	start := time.Now()
+	_, err := NewClient(hung, false, 50*time.Millisecond).GetJails(context.Background())
+	if !IsTimeout(err) {
+		t.Errorf("client timeout: error = %v, want a TimeoutError", err)
+	}
+
+	// So does canceling the request
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = NewClient(hung, false, time.Minute).GetJails(ctx)
+	if IsTimeout(err) || !errors.Is(err, context.Canceled) {
+		t.Errorf("request canceled: error = %v, want one wrapping context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("hung fail2ban-client not killed, returned after %v", elapsed)
+	}
+
+	notRunning := fakeClientScript(t, `echo "ERROR  Failed to access socket path: /var/run/fail2ban/fail2ban.sock. Is fail2ban running?"; exit 255`)
+	_, err = NewClient(notRunning, false, time.Minute).GetJails(context.Background())
+	if !IsUnavailable(err) {
+		t.Errorf("server not running: error = %v, want an UnavailableError", err)
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	timeout := &TimeoutError{Command: "status"}
+	if err := contextError(context.Background(), []string{"status"}); err != nil {
+		t.Errorf("contextError() of a live context = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := contextError(ctx, []string{"status"}); !IsTimeout(err) || err.Error() != timeout.Error() {
+		t.Errorf("contextError() after the deadline = %v, want %v", err, timeout)
+	}
+
+	wrapped := errors.Join(errors.New("status failed"), timeout)
+	if !IsTimeout(wrapped) || IsUnavailable(wrapped) {
+		t.Errorf("IsTimeout(%v) = false", wrapped)
+	}
+	unavailable := &UnavailableError{Err: os.ErrNotExist}
+	if !IsUnavailable(unavailable) || IsTimeout(unavailable) || !errors.Is(unavailable, os.ErrNotExist) {
+		t.Errorf("UnavailableError %v not recognized", unavailable)
+	}
+}
@@ -0,0 +1,241 @@
+package fail2ban
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Status is the overall status of the fail2ban server
+type Status struct {
+	JailCount int      `json:"jail_count"`
+	Jails     []string `json:"jails"`
+}
+
+// JailStatus is the status of a single jail
+type JailStatus struct {
+	Filter  FilterStatus  `json:"filter"`
+	Actions ActionsStatus `json:"actions"`
+}
+
+// FilterStatus holds the failure counters of a jail's filter
+type FilterStatus struct {
+	CurrentlyFailed int      `json:"currently_failed"`
+	TotalFailed     int      `json:"total_failed"`
+	FileList        []string `json:"file_list"`
+	JournalMatches  []string `json:"journal_matches,omitempty"` // systemd backend only
+}
+
+// ActionsStatus holds the ban counters of a jail's actions
+type ActionsStatus struct {
+	CurrentlyBanned int      `json:"currently_banned"`
+	TotalBanned     int      `json:"total_banned"`
+	BannedIPs       []string `json:"banned_ips"`
+}
+
+// OverallStats aggregates the status of every jail
+type OverallStats struct {
+	JailCount      int                    `json:"jail_count"`
+	Jails          []string               `json:"jails"`
+	TotalBannedIPs int                    `json:"total_banned_ips"`
+	JailDetails    map[string]*JailStatus `json:"jail_details"`
+}
+
+// statusFields maps the labels reported by fail2ban ("Currently banned",
+// "Jail list", ...) to their values. Values parsed from fail2ban-client output
+// are strings; values decoded from the socket keep their native types.
+type statusFields map[string]interface{}
+
+// parseStatusOutput parses the tree printed by "fail2ban-client status", e.g.
+//
+//	|- Filter
+//	|  |- Currently failed:	0
+//	|  `- File list:	/var/log/auth.log
+//	`- Actions
+//	   `- Banned IP list:	1.2.3.4 5.6.7.8
+func parseStatusOutput(output string) statusFields {
+	fields := make(statusFields)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+
+	for scanner.Scan() {
+		// Strip the tree-drawing prefix ("|  |- ", "   `- ")
+		line := strings.TrimLeft(scanner.Text(), "|`- \t")
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		if key == "" || strings.HasPrefix(key, "Status for the jail") {
+			continue
+		}
+		fields[key] = strings.TrimSpace(parts[1])
+	}
+
+	return fields
+}
+
+// parseListOutput parses a list printed by fail2ban-client, e.g.
+//
+//	These IP addresses/networks are ignored:
+//	|- 127.0.0.0/8
+//	`- ::1
+//
+// Lines that do not start with a tree prefix (headers, or "No IP
+// address/network is ignored") are skipped.
+func parseListOutput(output string) []string {
+	items := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "|-") && !strings.HasPrefix(line, "`-") {
+			continue
+		}
+		if item := strings.TrimSpace(line[2:]); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// statusReplyFields flattens a socket reply made of nested (label, value)
+// tuples, such as [("Filter", [("Currently failed", 0), ...]), ...]
+func statusReplyFields(reply interface{}) statusFields {
+	fields := make(statusFields)
+	collectReplyPairs(reply, fields)
+	return fields
+}
+
+func collectReplyPairs(v interface{}, fields statusFields) {
+	items, ok := v.([]interface{})
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		key, ok := pair[0].(string)
+		if !ok {
+			continue
+		}
+		if isPairList(pair[1]) {
+			collectReplyPairs(pair[1], fields)
+			continue
+		}
+		fields[key] = pair[1]
+	}
+}
+
+func isPairList(v interface{}) bool {
+	items, ok := v.([]interface{})
+	if !ok || len(items) == 0 {
+		return false
+	}
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return false
+		}
+		if _, ok := pair[0].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (f statusFields) int(key string) int {
+	switch v := f[key].(type) {
+	case int64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(strings.TrimSpace(v))
+		return n
+	}
+	return 0
+}
+
+// list returns a list value. Text output separates items with sep.
+func (f statusFields) list(key, sep string) []string {
+	items := []string{}
+	switch v := f[key].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s := strings.TrimSpace(fmt.Sprint(item)); s != "" {
+				items = append(items, s)
+			}
+		}
+	case string:
+		var parts []string
+		if sep == " " {
+			parts = strings.Fields(v)
+		} else {
+			parts = strings.Split(v, sep)
+		}
+		for _, part := range parts {
+			if s := strings.TrimSpace(part); s != "" {
+				items = append(items, s)
+			}
+		}
+	}
+	return items
+}
+
+func (f statusFields) status() *Status {
+	jails := f.list("Jail list", ",")
+	return &Status{
+		JailCount: len(jails),
+		Jails:     jails,
+	}
+}
+
+func (f statusFields) jailStatus() *JailStatus {
+	status := &JailStatus{
+		Filter: FilterStatus{
+			CurrentlyFailed: f.int("Currently failed"),
+			TotalFailed:     f.int("Total failed"),
+			FileList:        f.list("File list", " "),
+		},
+		Actions: ActionsStatus{
+			CurrentlyBanned: f.int("Currently banned"),
+			TotalBanned:     f.int("Total banned"),
+			BannedIPs:       f.list("Banned IP list", " "),
+		},
+	}
+	if _, ok := f["Journal matches"]; ok {
+		status.Filter.JournalMatches = f.list("Journal matches", "+")
+	}
+	return status
+}
+
+// overallStats aggregates the status of every jail
+func overallStats(ctx context.Context, b Backend) (*OverallStats, error) {
+	jails, err := b.GetJails(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &OverallStats{
+		JailCount:   len(jails),
+		Jails:       jails,
+		JailDetails: make(map[string]*JailStatus),
+	}
+
+	for _, jail := range jails {
+		status, err := b.GetJailStatus(ctx, jail)
+		if err != nil {
+			// A jail may vanish between listing and querying it, but a
+			// timeout or cancellation aborts the whole aggregation
+			if ctx.Err() != nil || IsTimeout(err) {
+				return nil, err
+			}
+			continue
+		}
+		stats.JailDetails[jail] = status
+		stats.TotalBannedIPs += status.Actions.CurrentlyBanned
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/fail2rest/v2/internal/auth"
+	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+type AdminHandler struct {
+	authService *auth.AuthService
+}
+
+func NewAdminHandler(authService *auth.AuthService) *AdminHandler {
+	return &AdminHandler{
+		authService: authService,
+	}
+}
+
+// ListAPIKeys returns the accepted API keys with their last use
+func (h *AdminHandler) ListAPIKeys(c *gin.Context) {
+	keys := []models.APIKeyInfo{}
+	for _, key := range h.authService.APIKeys() {
+		keys = append(keys, h.apiKeyInfo(key))
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    keys,
+	})
+}
+
+// GetAPIKey returns a generated API key by its ID
+func (h *AdminHandler) GetAPIKey(c *gin.Context) {
+	key, exists := h.authService.GetAPIKey(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "API key " + c.Param("id") + " not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    h.apiKeyInfo(key),
+	})
+}
+
+// CreateAPIKey generates an API key. The key is returned only in this
+// response.
+func (h *AdminHandler) CreateAPIKey(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	secret, key, err := h.authService.CreateAPIKey(auth.APIKeySpec{
+		Name:         req.Name,
+		Label:        req.Label,
+		Scope:        auth.Scope{Roles: req.Roles, Jails: req.Jails},
+		ExpiresAt:    req.ExpiresAt,
+		AllowedCIDRs: req.AllowedCIDRs,
+	}, auth.PrincipalFromContext(c))
+	if err != nil {
+		accountError(c, "Failed to create API key", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Message: "Created API key " + key.Principal() + "; store the key now, it is not shown again",
+		Data:    models.CreatedAPIKey{Key: secret, APIKeyInfo: h.apiKeyInfo(key)},
+	})
+}
+
+// UpdateAPIKey changes an API key created through the API
+func (h *AdminHandler) UpdateAPIKey(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	var req models.UpdateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	key, err := h.authService.UpdateAPIKey(c.Param("id"), auth.APIKeyUpdate{
+		Label:        req.Label,
+		Roles:        req.Roles,
+		Jails:        req.Jails,
+		AllowedCIDRs: req.AllowedCIDRs,
+		ExpiresAt:    req.ExpiresAt,
+		NeverExpires: req.NeverExpires,
+	}, auth.PrincipalFromContext(c))
+	if err != nil {
+		accountError(c, "Failed to update API key", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Updated API key " + key.Principal(),
+		Data:    h.apiKeyInfo(key),
+	})
+}
+
+// DeleteAPIKey removes an API key created through the API and revokes the
+// tokens obtained with it
+func (h *AdminHandler) DeleteAPIKey(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	id := c.Param("id")
+	if err := h.authService.DeleteAPIKey(id); err != nil {
+		accountError(c, "Failed to delete API key", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Deleted API key " + id,
+		Data:    gin.H{"id": id},
+	})
+}
+
+// ListUsers returns the users that can log in with a password
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	users := []models.UserInfo{}
+	for _, user := range h.authService.Users() {
+		users = append(users, h.userInfo(user))
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    users,
+	})
+}
+
+// GetUser returns a user
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	user, exists := h.authService.GetUser(c.Param("username"))
+	if !exists {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "User " + c.Param("username") + " not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    h.userInfo(user),
+	})
+}
+
+// CreateUser adds a user
+func (h *AdminHandler) CreateUser(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	var req models.CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	user, err := h.authService.CreateUser(req.Username, req.Password,
+		auth.Scope{Roles: req.Roles, Jails: req.Jails}, auth.PrincipalFromContext(c))
+	if err != nil {
+		accountError(c, "Failed to create user", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.APIResponse{
+		Success: true,
+		Message: "Created user " + user.Username,
+		Data:    h.userInfo(user),
+	})
+}
+
+// UpdateUser changes the password or permissions of a user created through
+// the API, revoking the tokens issued to it
+func (h *AdminHandler) UpdateUser(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	user, err := h.authService.UpdateUser(c.Param("username"), auth.UserUpdate{
+		Password: req.Password,
+		Roles:    req.Roles,
+		Jails:    req.Jails,
+	}, auth.PrincipalFromContext(c))
+	if err != nil {
+		accountError(c, "Failed to update user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Updated user " + user.Username,
+		Data:    h.userInfo(user),
+	})
+}
+
+// DeleteUser removes a user created through the API and revokes the tokens
+// issued to it
+func (h *AdminHandler) DeleteUser(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	username := c.Param("username")
+	if err := h.authService.DeleteUser(username); err != nil {
+		accountError(c, "Failed to delete user", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Deleted user " + username,
+		Data:    gin.H{"username": username},
+	})
+}
+
+// EnrollTOTP gives a user created through the API a new TOTP secret and
+// recovery codes, which are returned only in this response
+func (h *AdminHandler) EnrollTOTP(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	username := c.Param("username")
+	enrollment, err := h.authService.EnrollTOTP(username, auth.PrincipalFromContext(c))
+	if err != nil {
+		accountError(c, "Failed to enroll TOTP", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Enrolled user " + username + " in TOTP; the secret and recovery codes are not shown again",
+		Data: models.TOTPEnrollment{
+			Secret:        enrollment.Secret,
+			URI:           enrollment.URI,
+			RecoveryCodes: enrollment.RecoveryCodes,
+		},
+	})
+}
+
+// DisableTOTP removes TOTP from a user created through the API
+func (h *AdminHandler) DisableTOTP(c *gin.Context) {
+	if !canManageAccounts(c) {
+		return
+	}
+
+	username := c.Param("username")
+	if err := h.authService.DisableTOTP(username, auth.PrincipalFromContext(c)); err != nil {
+		accountError(c, "Failed to disable TOTP", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Disabled TOTP for user " + username,
+		Data:    gin.H{"username": username},
+	})
+}
+
+// ListLockouts returns the users and API keys with recent failed logins,
+// locked ones first
+func (h *AdminHandler) ListLockouts(c *gin.Context) {
+	lockouts := []models.LockoutInfo{}
+	for _, entry := range h.authService.Lockouts() {
+		lockouts = append(lockouts, models.LockoutInfo{
+			Principal:     entry.Principal,
+			Failures:      entry.Failures,
+			Locked:        entry.LockedUntil != nil,
+			LockedUntil:   entry.LockedUntil,
+			LastFailureAt: entry.LastFailureAt,
+			LastIP:        entry.LastIP,
+		})
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    lockouts,
+	})
+}
+
+// Unlock clears the failed logins and lockout of a user or API key
+func (h *AdminHandler) Unlock(c *gin.Context) {
+	principal := c.Param("principal")
+	if !h.authService.Unlock(principal) {
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "No failed logins recorded for " + principal,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Unlocked " + principal,
+		Data:    gin.H{"principal": principal},
+	})
+}
+
+// canManageAccounts refuses admins restricted to some jails, who could
+// otherwise grant themselves every jail. It writes the error response and
+// returns false if the caller may not manage accounts.
+func canManageAccounts(c *gin.Context) bool {
+	if auth.ScopeFromContext(c).AllJails() {
+		return true
+	}
+	c.JSON(http.StatusForbidden, models.APIResponse{
+		Success: false,
+		Error:   "Managing users and API keys requires access to every jail",
+	})
+	return false
+}
+
+// accountError writes the response for an error managing a user or API key
+func accountError(c *gin.Context, message string, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, auth.ErrAccountInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, auth.ErrAccountNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, auth.ErrAccountExists), errors.Is(err, auth.ErrAccountStatic):
+		status = http.StatusConflict
+	}
+
+	c.JSON(status, models.APIResponse{
+		Success: false,
+		Error:   message + ": " + err.Error(),
+	})
+}
+
+func (h *AdminHandler) apiKeyInfo(key *auth.APIKey) models.APIKeyInfo {
+	info := models.APIKeyInfo{
+		ID:           key.ID,
+		Principal:    key.Principal(),
+		Label:        key.Label,
+		Hashed:       key.Hashed(),
+		Roles:        key.Scope.Roles,
+		Jails:        key.Scope.Jails,
+		ExpiresAt:    key.ExpiresAt,
+		Expired:      key.Expired(time.Now()),
+		AllowedCIDRs: key.AllowedCIDRs,
+		Source:       accountSource(key.Managed),
+		CreatedAt:    key.CreatedAt,
+		CreatedBy:    key.CreatedBy,
+		UpdatedAt:    key.UpdatedAt,
+	}
+	if usage, ok := h.authService.KeyUsage(key.Principal()); ok {
+		lastUsed := usage.LastUsedAt
+		info.LastUsedAt = &lastUsed
+		info.LastUsedIP = usage.LastUsedIP
+	}
+	return info
+}
+
+func (h *AdminHandler) userInfo(user auth.User) models.UserInfo {
+	info := models.UserInfo{
+		Username:    user.Username,
+		Roles:       user.Scope.Roles,
+		Jails:       user.Scope.Jails,
+		Source:      accountSource(user.Managed),
+		CreatedAt:   user.CreatedAt,
+		CreatedBy:   user.CreatedBy,
+		UpdatedAt:   user.UpdatedAt,
+		TOTPEnabled: user.TOTPEnabled(),
+	}
+	if info.TOTPEnabled {
+		info.RecoveryCodesLeft = h.authService.RecoveryCodesLeft(user.Username)
+	}
+	return info
+}
+
+func accountSource(managed bool) string {
+	if managed {
+		return "api"
+	}
+	return "config"
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fail2rest/v2/internal/audit"
+	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Number of audit records returned by default and at most
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type AuditHandler struct {
+	auditLog *audit.Log
+}
+
+func NewAuditHandler(auditLog *audit.Log) *AuditHandler {
+	return &AuditHandler{
+		auditLog: auditLog,
+	}
+}
+
+// GetAuditLog returns the audit records matching the query filters, newest
+// first
+func (h *AuditHandler) GetAuditLog(c *gin.Context) {
+	filter := audit.Filter{
+		Principal: c.Query("actor"),
+		Action:    c.Query("action"),
+		Jail:      c.Query("jail"),
+		IP:        c.Query("ip"),
+		Limit:     defaultAuditLimit,
+	}
+
+	for param, dest := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "Invalid " + param + ": must be an RFC 3339 time such as 2024-01-01T00:00:00Z",
+			})
+			return
+		}
+		*dest = t
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "Invalid limit: must be between 1 and " + strconv.Itoa(maxAuditLimit),
+			})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	records, err := h.auditLog.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to read audit log: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: models.AuditResponse{
+			Records: records,
+			Count:   len(records),
+		},
+	})
+}
+
+// VerifyAuditLog checks that no audit record was altered or removed
+func (h *AuditHandler) VerifyAuditLog(c *gin.Context) {
+	result, err := h.auditLog.Verify()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to read audit log: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    result,
+	})
+}
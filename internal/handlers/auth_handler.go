@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
 
 	"github.com/fail2rest/v2/internal/auth"
@@ -41,25 +43,60 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	// Validate credentials - try API key first, then username/password
 	authenticated := false
+	var identity auth.Identity
 
 	if req.APIKey != "" {
-		authenticated = h.authService.ValidateAPIKey(req.APIKey)
-		if !authenticated {
-			c.JSON(http.StatusUnauthorized, models.APIResponse{
+		key, err := h.authService.AuthorizeAPIKey(req.APIKey, c.ClientIP())
+		if err != nil {
+			c.Set(auth.ContextPrincipal, h.authService.KeyPrincipal(req.APIKey))
+			auth.SetRetryAfter(c, err)
+			c.JSON(auth.APIKeyErrorStatus(err), models.APIResponse{
 				Success: false,
-				Error:   "Invalid API key",
+				Error:   auth.APIKeyErrorMessage(err),
 			})
 			return
 		}
+		authenticated = true
+		identity = auth.Identity{
+			Principal: key.Principal(),
+			Method:    auth.MethodAPIKey,
+			KeyID:     key.Ref(),
+			Roles:     key.Scope.Roles,
+			Jails:     key.Scope.Jails,
+		}
+		c.Set(auth.ContextPrincipal, identity.Principal)
 	} else if req.Username != "" && req.Password != "" {
-		authenticated = h.authService.ValidateCredentials(req.Username, req.Password)
-		if !authenticated {
-			c.JSON(http.StatusUnauthorized, models.APIResponse{
+		identity = auth.Identity{
+			Principal: "user:" + req.Username,
+			Method:    auth.MethodPassword,
+		}
+		c.Set(auth.ContextPrincipal, identity.Principal)
+
+		// The TOTP code is checked only once the password is right, so the
+		// response does not reveal which users have TOTP
+		scope, err := h.authService.AuthenticateUser(req.Username, req.Password, req.TOTP, c.ClientIP())
+		if err != nil {
+			status, message := http.StatusUnauthorized, "Invalid username or password"
+			switch {
+			case errors.Is(err, auth.ErrLockedOut):
+				status, message = http.StatusTooManyRequests, "Too many failed attempts, try again later"
+				auth.SetRetryAfter(c, err)
+			case errors.Is(err, auth.ErrTOTPRequired):
+				message = "TOTP code required"
+			case errors.Is(err, auth.ErrTOTPInvalid):
+				message = "Invalid TOTP or recovery code"
+			case !errors.Is(err, auth.ErrInvalidCredentials):
+				status, message = http.StatusInternalServerError, "Failed to check credentials"
+			}
+			c.JSON(status, models.APIResponse{
 				Success: false,
-				Error:   "Invalid username or password",
+				Error:   message,
 			})
 			return
 		}
+		authenticated = true
+		identity.Roles = scope.Roles
+		identity.Jails = scope.Jails
 	} else {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
@@ -77,7 +114,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	}
 
 	// Generate JWT token
-	token, expiresAt, err := h.authService.GenerateToken()
+	tokens, err := h.authService.IssueTokens(identity)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.APIResponse{
 			Success: false,
@@ -88,9 +125,227 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
-		Data: models.LoginResponse{
-			Token:     token,
-			ExpiresAt: expiresAt,
-		},
+		Data:    loginResponse(tokens),
+	})
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token. Each refresh token can be used once.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	tokens, err := h.authService.Refresh(req.RefreshToken)
+	switch {
+	case errors.Is(err, auth.ErrRefreshReused):
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "Refresh token was already used; the session has been revoked, please log in again",
+		})
+		return
+	case errors.Is(err, auth.ErrRefreshInvalid):
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "Invalid or expired refresh token",
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to refresh token",
+		})
+		return
+	}
+
+	c.Set(auth.ContextPrincipal, tokens.Identity.Principal)
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    loginResponse(tokens),
+	})
+}
+
+// OIDCLogin starts a browser login through the OpenID Connect provider,
+// redirecting to it
+func (h *AuthHandler) OIDCLogin(c *gin.Context) {
+	url, err := h.authService.OIDCLoginURL(c.Request.Context())
+	switch {
+	case errors.Is(err, auth.ErrOIDCDisabled):
+		c.JSON(http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Error:   "OpenID Connect login is not enabled",
+		})
+		return
+	case err != nil:
+		log.Printf("OpenID Connect login failed: %v", err)
+		c.JSON(http.StatusBadGateway, models.APIResponse{
+			Success: false,
+			Error:   "Identity provider is unavailable",
+		})
+		return
+	}
+
+	c.Redirect(http.StatusFound, url)
+}
+
+// OIDCCallback completes a browser login, redeeming the authorization code
+// the provider redirected back with, and returns tokens like Login
+func (h *AuthHandler) OIDCCallback(c *gin.Context) {
+	if errorCode := c.Query("error"); errorCode != "" {
+		message := "Identity provider refused the login: " + errorCode
+		if description := c.Query("error_description"); description != "" {
+			message += " (" + description + ")"
+		}
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Both 'state' and 'code' must be provided",
+		})
+		return
+	}
+
+	tokens, err := h.authService.OIDCCallback(c.Request.Context(), state, code)
+	if err != nil {
+		status, message := http.StatusUnauthorized, "OpenID Connect login failed"
+		switch {
+		case errors.Is(err, auth.ErrOIDCDisabled):
+			status, message = http.StatusNotFound, "OpenID Connect login is not enabled"
+		case errors.Is(err, auth.ErrOIDCState):
+			status, message = http.StatusBadRequest, "Unknown or expired login, please start again"
+		case errors.Is(err, auth.ErrOIDCNoRole):
+			status, message = http.StatusForbidden, "No role is mapped to your groups"
+		default:
+			log.Printf("OpenID Connect login failed: %v", err)
+		}
+		c.JSON(status, models.APIResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+
+	c.Set(auth.ContextPrincipal, tokens.Identity.Principal)
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    loginResponse(tokens),
+	})
+}
+
+func loginResponse(tokens *auth.Tokens) models.LoginResponse {
+	resp := models.LoginResponse{
+		Token:     tokens.AccessToken,
+		ExpiresAt: *tokens.Identity.ExpiresAt,
+	}
+	if tokens.RefreshToken != "" {
+		resp.RefreshToken = tokens.RefreshToken
+		resp.RefreshExpiresAt = &tokens.RefreshExpiresAt
+	}
+	return resp
+}
+
+// JWKS returns the public keys tokens are verified with as a JSON Web Key
+// Set. It is empty while tokens are signed with the shared JWT secret.
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	set, err := h.authService.JWKS()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to encode signing keys: " + err.Error(),
+		})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
+
+// Me returns the identity of the caller, as carried in its token
+func (h *AuthHandler) Me(c *gin.Context) {
+	identity, ok := auth.IdentityFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "Not authenticated",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    identity,
+	})
+}
+
+// Logout revokes the caller's token and ends its session, so its refresh
+// token can no longer be used
+func (h *AuthHandler) Logout(c *gin.Context) {
+	identity, ok := auth.IdentityFromContext(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Error:   "Not authenticated",
+		})
+		return
+	}
+
+	if identity.TokenID == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Requests authenticated with an API key or client certificate have no token to revoke",
+		})
+		return
+	}
+
+	if err := h.authService.Logout(identity); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to revoke token: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Logged out",
+	})
+}
+
+// RevokeTokens revokes every token issued so far to a user or API key, e.g.
+// after a key leaked. New logins with valid credentials still succeed.
+func (h *AuthHandler) RevokeTokens(c *gin.Context) {
+	var req models.RevokeTokensRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	if err := h.authService.RevokePrincipal(req.Principal); err != nil {
+		c.JSON(http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Error:   "Failed to revoke tokens: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Revoked all tokens of " + req.Principal,
+		Data:    gin.H{"principal": req.Principal},
 	})
 }
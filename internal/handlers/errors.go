@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/fail2rest/v2/internal/fail2ban"
+)
+
+// backendErrorStatus returns the HTTP status for a failed fail2ban call.
+// Timeouts are reported as 504 Gateway Timeout, an unreachable server as
+// 503 Service Unavailable, anything else as fallback.
+func backendErrorStatus(err error, fallback int) int {
+	switch {
+	case fail2ban.IsTimeout(err):
+		return http.StatusGatewayTimeout
+	case fail2ban.IsUnavailable(err):
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
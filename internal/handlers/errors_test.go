@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fail2rest/v2/internal/fail2ban"
+	"github.com/gin-gonic/gin"
+)
+
+func TestBackendErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&fail2ban.TimeoutError{Command: "status"}, http.StatusGatewayTimeout},
+		{fmt.Errorf("get jails: %w", &fail2ban.TimeoutError{Command: "status"}), http.StatusGatewayTimeout},
+		{&fail2ban.UnavailableError{Err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{fmt.Errorf("fail2ban command %q canceled: %w", "status", context.Canceled), http.StatusNotFound},
+		{errors.New("fail2ban-client error: exit status 255"), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := backendErrorStatus(tt.err, http.StatusNotFound); got != tt.want {
+			t.Errorf("backendErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+// A fail2ban server that stops answering makes requests fail with 504 once
+// the client timeout passes, and one that is not running with 503
+func TestBackendFailureStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "fail2ban.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // read nothing, answer nothing
+		}
+	}()
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"stalled", path, http.StatusGatewayTimeout},
+		{"not running", filepath.Join(t.TempDir(), "missing.sock"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		handler := NewStatusHandler(fail2ban.NewSocketClient(tt.path, "", false, 50*time.Millisecond))
+		router := gin.New()
+		router.GET("/status", handler.GetStatus)
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.want)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: answered after %v", tt.name, elapsed)
+		}
+	}
+}
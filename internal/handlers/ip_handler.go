@@ -1,21 +1,36 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/fail2rest/v2/internal/auth"
+	"github.com/fail2rest/v2/internal/bans"
 	"github.com/fail2rest/v2/internal/fail2ban"
 	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
 )
 
 type IPHandler struct {
-	f2bClient *fail2ban.Client
+	f2bClient fail2ban.Backend
+	policy    BanPolicy
+	scheduler *bans.Scheduler     // expiry of timed bans the backend cannot set itself
+	metadata  *bans.MetadataStore // who banned an IP through the API and why
 }
 
-func NewIPHandler(f2bClient *fail2ban.Client) *IPHandler {
+func NewIPHandler(f2bClient fail2ban.Backend, policy BanPolicy, scheduler *bans.Scheduler, metadata *bans.MetadataStore) *IPHandler {
 	return &IPHandler{
 		f2bClient: f2bClient,
+		policy:    policy,
+		scheduler: scheduler,
+		metadata:  metadata,
 	}
 }
 
@@ -30,22 +45,73 @@ func (h *IPHandler) GetBannedIPs(c *gin.Context) {
 		return
 	}
 
-	ips, err := h.f2bClient.GetBannedIPs(jailName)
+	ctx := c.Request.Context()
+
+	ips, err := h.f2bClient.GetBannedIPs(ctx, jailName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to get banned IPs: " + err.Error(),
 		})
 		return
 	}
 
+	// Ban times need fail2ban 0.11+; without them only the IPs are listed
+	infos := make(map[string]fail2ban.BanInfo)
+	if len(ips) > 0 {
+		list, err := h.f2bClient.GetBans(ctx, jailName)
+		if err != nil && fail2ban.IsTimeout(err) {
+			c.JSON(http.StatusGatewayTimeout, models.APIResponse{
+				Success: false,
+				Error:   "Failed to get banned IPs: " + err.Error(),
+			})
+			return
+		}
+		for _, info := range list {
+			infos[info.IP] = info
+		}
+	}
+
+	resp := models.BannedIPsResponse{
+		Jail:      jailName,
+		BannedIPs: ips,
+		Bans:      make([]models.BannedIP, 0, len(ips)),
+	}
+	for _, ip := range ips {
+		ban := models.BannedIP{IP: ip, Source: "fail2ban"}
+		if info, ok := infos[ip]; ok {
+			bannedAt := info.BannedAt
+			ban.BannedAt = &bannedAt
+			ban.ExpiresAt = info.ExpiresAt
+			ban.Permanent = info.Permanent()
+		}
+		// A scheduled expiry overrides the jail's bantime
+		if entry, ok := h.scheduler.Lookup(jailName, ip); ok {
+			ban.BannedAt = &entry.BannedAt
+			ban.ExpiresAt = entry.ExpiresAt
+			ban.Permanent = entry.Permanent()
+		}
+		if meta, ok := h.metadata.Get(jailName, ip); ok {
+			ban.Source = "api"
+			ban.BannedBy = meta.Principal
+			ban.Reason = meta.Reason
+			ban.Ticket = meta.Ticket
+			ban.Tags = meta.Tags
+			if ban.BannedAt == nil {
+				ban.BannedAt = &meta.BannedAt
+				ban.ExpiresAt = meta.ExpiresAt
+			}
+		}
+		resp.Bans = append(resp.Bans, ban)
+	}
+
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
-		Data:    gin.H{"jail": jailName, "banned_ips": ips},
+		Data:    resp,
 	})
 }
 
-// BanIP bans an IP address in a jail
+// BanIP bans an IP address or CIDR network in a jail
 func (h *IPHandler) BanIP(c *gin.Context) {
 	jailName := c.Param("name")
 	if jailName == "" {
@@ -65,31 +131,181 @@ func (h *IPHandler) BanIP(c *gin.Context) {
 		return
 	}
 
-	// Validate IP address
-	if net.ParseIP(req.IP) == nil {
+	// Validate IP address or network
+	network, err := h.policy.banTarget(req.IP)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
-			Error:   "Invalid IP address",
+			Error:   "Invalid IP address or network",
 		})
 		return
 	}
+	if h.policy.tooBroad(network) && !h.policy.allowBroad(c) {
+		c.JSON(http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Error:   "Network " + network.String() + " is too broad to ban without elevated permission",
+		})
+		return
+	}
+	target := formatNetwork(network)
+
+	banTime := 0 // jail default
+	if req.Duration != "" {
+		if banTime, err = parseBanTime(req.Duration); err != nil {
+			c.JSON(http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Error:   "Invalid duration: must be a positive duration such as 2h or 7d, or permanent",
+			})
+			return
+		}
+	}
 
-	if err := h.f2bClient.BanIP(jailName, req.IP); err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+	bannedAt := time.Now()
+	expiresAt, warning, err := h.ban(c.Request.Context(), jailName, target, banTime)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to ban IP: " + err.Error(),
 		})
 		return
 	}
+	h.recordBan(c, bans.Metadata{
+		Jail:      jailName,
+		IP:        target,
+		Reason:    req.Reason,
+		Ticket:    req.Ticket,
+		Tags:      req.Tags,
+		BannedAt:  bannedAt,
+		ExpiresAt: expiresAt,
+	})
+
+	data := gin.H{"jail": jailName, "ip": req.IP, "banned": target}
+	if banTime < 0 && warning == "" {
+		data["permanent"] = true
+	} else if expiresAt != nil {
+		data["expires_at"] = expiresAt
+	}
+	if warning != "" {
+		data["warning"] = warning
+	}
 
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
 		Message: "IP banned successfully",
-		Data:    gin.H{"jail": jailName, "ip": req.IP},
+		Data:    data,
 	})
 }
 
-// UnbanIP unbans an IP address in a jail
+// ban bans target in a jail for banTime seconds (-1 permanent, 0 the jail's
+// bantime) and returns when the ban expires, if known. The bantime is set on
+// the ban itself where the server supports it; otherwise the ban gets the
+// jail's bantime and the scheduler enforces its expiry. If the expiry cannot
+// be scheduled, the ban stays in effect with the jail's bantime and a warning
+// says so.
+func (h *IPHandler) ban(ctx context.Context, jailName, target string, banTime int) (expiresAt *time.Time, warning string, err error) {
+	now := time.Now()
+
+	if banTime == 0 {
+		if err := h.f2bClient.BanIP(ctx, jailName, target); err != nil {
+			return nil, "", err
+		}
+		h.cancelSchedule(jailName, target)
+		return h.bannedUntil(ctx, jailName, target, now), "", nil
+	}
+
+	if banTime > 0 {
+		t := now.Add(time.Duration(banTime) * time.Second)
+		expiresAt = &t
+	}
+
+	if timed, ok := h.f2bClient.(fail2ban.TimedBanner); ok {
+		err := timed.BanIPFor(ctx, jailName, target, banTime)
+		if err == nil {
+			h.cancelSchedule(jailName, target)
+			return expiresAt, "", nil
+		}
+		if !errors.Is(err, fail2ban.ErrUnsupported) {
+			return nil, "", err
+		}
+	}
+
+	if err := h.f2bClient.BanIP(ctx, jailName, target); err != nil {
+		return nil, "", err
+	}
+	if err := h.scheduler.Schedule(jailName, target, now, expiresAt); err != nil {
+		log.Printf("Failed to schedule expiry of %s in %s: %v", target, jailName, err)
+		return h.bannedUntil(ctx, jailName, target, now), "Banned with the jail's bantime: the requested duration could not be scheduled", nil
+	}
+	return expiresAt, "", nil
+}
+
+// bannedUntil returns when a ban made at bannedAt with the jail's bantime
+// expires: as fail2ban reports it, or else from the jail's bantime
+func (h *IPHandler) bannedUntil(ctx context.Context, jailName, target string, bannedAt time.Time) *time.Time {
+	if infos, err := h.f2bClient.GetBans(ctx, jailName); err == nil {
+		for _, info := range infos {
+			if info.IP == target {
+				return info.ExpiresAt
+			}
+		}
+	}
+	return h.jailBanExpiry(ctx, jailName, bannedAt)
+}
+
+// jailBanExpiry returns when a ban made at bannedAt with the jail's bantime
+// expires, or nil if it is permanent or the bantime cannot be read
+func (h *IPHandler) jailBanExpiry(ctx context.Context, jailName string, bannedAt time.Time) *time.Time {
+	settings, err := h.f2bClient.GetJailSettings(ctx, jailName)
+	if err != nil || settings.BanTime < 0 {
+		return nil
+	}
+	expiresAt := bannedAt.Add(time.Duration(settings.BanTime) * time.Second)
+	return &expiresAt
+}
+
+// cancelSchedule forgets the scheduled expiry of a ban that was lifted or
+// replaced
+func (h *IPHandler) cancelSchedule(jailName, target string) {
+	if err := h.scheduler.Cancel(jailName, target); err != nil {
+		log.Printf("Failed to cancel scheduled expiry of %s in %s: %v", target, jailName, err)
+	}
+}
+
+// suspendSchedule cancels the scheduled expiry of a ban about to be lifted,
+// so the scheduler cannot renew it while it is being unbanned. The returned
+// function restores the schedule if the unban fails.
+func (h *IPHandler) suspendSchedule(jailName, target string) (restore func()) {
+	entry, scheduled := h.scheduler.Lookup(jailName, target)
+	if !scheduled {
+		return func() {}
+	}
+	h.cancelSchedule(jailName, target)
+	return func() {
+		if err := h.scheduler.Schedule(jailName, target, entry.BannedAt, entry.ExpiresAt); err != nil {
+			log.Printf("Failed to restore scheduled expiry of %s in %s: %v", target, jailName, err)
+		}
+	}
+}
+
+// recordBan stores who made a ban and why. A failure is logged rather than
+// reported, since the ban itself is already in place.
+func (h *IPHandler) recordBan(c *gin.Context, meta bans.Metadata) {
+	meta.Principal = auth.PrincipalFromContext(c)
+	if err := h.metadata.Put(meta); err != nil {
+		log.Printf("Failed to record metadata of ban of %s in %s: %v", meta.IP, meta.Jail, err)
+	}
+}
+
+// endBan drops the schedule of a ban that was lifted and records in its
+// metadata who lifted it
+func (h *IPHandler) endBan(c *gin.Context, jailName, target string) {
+	h.cancelSchedule(jailName, target)
+	if err := h.metadata.End(jailName, target, auth.PrincipalFromContext(c)); err != nil {
+		log.Printf("Failed to record end of ban of %s in %s: %v", target, jailName, err)
+	}
+}
+
+// UnbanIP unbans an IP address or CIDR network in a jail
 func (h *IPHandler) UnbanIP(c *gin.Context) {
 	jailName := c.Param("name")
 	if jailName == "" {
@@ -109,27 +325,857 @@ func (h *IPHandler) UnbanIP(c *gin.Context) {
 		return
 	}
 
-	// Validate IP address
-	if net.ParseIP(req.IP) == nil {
+	// Validate IP address or network. Single IPv6 addresses map to the same
+	// prefix they were banned as, or to themselves if fail2ban banned them.
+	targets, err := h.policy.unbanTargets(req.IP)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, models.APIResponse{
 			Success: false,
-			Error:   "Invalid IP address",
+			Error:   "Invalid IP address or network",
 		})
 		return
 	}
 
-	if err := h.f2bClient.UnbanIP(jailName, req.IP); err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+	var target string
+	for i, candidate := range targets {
+		restore := h.suspendSchedule(jailName, candidate)
+		unbanErr := h.f2bClient.UnbanIP(c.Request.Context(), jailName, candidate)
+		if unbanErr == nil {
+			target, err = candidate, nil
+			break
+		}
+		restore()
+		if i == 0 {
+			err = unbanErr
+		}
+	}
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to unban IP: " + err.Error(),
 		})
 		return
 	}
+	h.endBan(c, jailName, target)
 
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
 		Message: "IP unbanned successfully",
-		Data:    gin.H{"jail": jailName, "ip": req.IP},
+		Data:    gin.H{"jail": jailName, "ip": req.IP, "unbanned": target},
+	})
+}
+
+// LookupIP reports every jail that currently bans an IP, with ban times
+// where available, and every jail whose ignore list covers it
+func (h *IPHandler) LookupIP(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid IP address",
+		})
+		return
+	}
+	ctx := c.Request.Context()
+
+	jails, err := h.f2bClient.GetJails(ctx)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to get jails: " + err.Error(),
+		})
+		return
+	}
+	scope := auth.ScopeFromContext(c)
+	jails = scope.FilterJails(jails)
+
+	banned, err := h.bannedIn(ctx, ip, jails)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to look up IP: " + err.Error(),
+		})
+		return
+	}
+
+	resp := models.IPLookupResponse{
+		IP:        ip.String(),
+		Bans:      []models.IPBan{},
+		IgnoredBy: []models.IgnoreMatch{},
+		History:   h.banHistory(ip, jails),
+	}
+	now := time.Now()
+
+	for _, jail := range jails {
+		target, ok := banned[jail]
+		if !ok {
+			continue
+		}
+		ban := models.IPBan{Jail: jail, Target: target}
+
+		// Ban times need fail2ban 0.11+; without them the ban is still listed
+		if infos, err := h.f2bClient.GetBans(ctx, jail); err == nil {
+			for _, info := range infos {
+				if info.IP != target {
+					continue
+				}
+				bannedAt := info.BannedAt
+				ban.BannedAt = &bannedAt
+				ban.ExpiresAt = info.ExpiresAt
+				ban.Permanent = info.Permanent()
+				if info.ExpiresAt != nil {
+					remaining := int64(info.ExpiresAt.Sub(now).Seconds())
+					if remaining < 0 {
+						remaining = 0
+					}
+					ban.RemainingSeconds = &remaining
+				}
+				break
+			}
+		} else if fail2ban.IsTimeout(err) {
+			c.JSON(http.StatusGatewayTimeout, models.APIResponse{
+				Success: false,
+				Error:   "Failed to look up IP: " + err.Error(),
+			})
+			return
+		}
+
+		resp.Bans = append(resp.Bans, ban)
+	}
+	resp.Banned = len(resp.Bans) > 0
+
+	for _, jail := range jails {
+		entries, err := h.f2bClient.GetIgnoreIPs(ctx, jail)
+		if err != nil {
+			if fail2ban.IsTimeout(err) {
+				c.JSON(http.StatusGatewayTimeout, models.APIResponse{
+					Success: false,
+					Error:   "Failed to look up IP: " + err.Error(),
+				})
+				return
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if entryContains(entry, ip) {
+				resp.IgnoredBy = append(resp.IgnoredBy, models.IgnoreMatch{Jail: jail, Entry: entry})
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    resp,
+	})
+}
+
+// banHistory returns the records of bans of ip, or of the network it is
+// banned as, made through the API in any of jails
+func (h *IPHandler) banHistory(ip net.IP, jails []string) []models.BanRecord {
+	inScope := make(map[string]bool)
+	for _, jail := range jails {
+		inScope[jail] = true
+	}
+	targets := []string{ip.String()}
+	if network, err := h.policy.banTarget(ip.String()); err == nil {
+		if target := formatNetwork(network); target != targets[0] {
+			targets = append(targets, target)
+		}
+	}
+
+	var records []bans.Metadata
+	for _, target := range targets {
+		records = append(records, h.metadata.History(target)...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].BannedAt.After(records[j].BannedAt)
+	})
+
+	history := []models.BanRecord{}
+	for _, m := range records {
+		if !inScope[m.Jail] {
+			continue
+		}
+		history = append(history, models.BanRecord{
+			Jail:       m.Jail,
+			Target:     m.IP,
+			BannedBy:   m.Principal,
+			Reason:     m.Reason,
+			Ticket:     m.Ticket,
+			Tags:       m.Tags,
+			BannedAt:   m.BannedAt,
+			ExpiresAt:  m.ExpiresAt,
+			EndedAt:    m.EndedAt,
+			UnbannedBy: m.UnbannedBy,
+		})
+	}
+	return history
+}
+
+// bannedIn returns the jails banning ip, mapped to the banned address or
+// network. It asks fail2ban directly where supported, checking both the
+// address and the network it would be banned as; older servers are handled
+// by scanning the banned list of every jail.
+func (h *IPHandler) bannedIn(ctx context.Context, ip net.IP, jails []string) (map[string]string, error) {
+	banned := make(map[string]string)
+
+	candidates := []string{ip.String()}
+	if network, err := h.policy.banTarget(ip.String()); err == nil {
+		if target := formatNetwork(network); target != candidates[0] {
+			candidates = append(candidates, target)
+		}
+	}
+
+	for _, candidate := range candidates {
+		inJails, err := h.f2bClient.BannedIn(ctx, candidate)
+		if errors.Is(err, fail2ban.ErrUnsupported) {
+			return h.scanBanned(ctx, ip, jails)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, jail := range inJails {
+			if _, found := banned[jail]; !found {
+				banned[jail] = candidate
+			}
+		}
+	}
+	return banned, nil
+}
+
+// scanBanned finds the jails banning ip, or a network containing it, from
+// their banned lists
+func (h *IPHandler) scanBanned(ctx context.Context, ip net.IP, jails []string) (map[string]string, error) {
+	banned := make(map[string]string)
+	for _, jail := range jails {
+		entries, err := h.f2bClient.GetBannedIPs(ctx, jail)
+		if err != nil {
+			if fail2ban.IsTimeout(err) || ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if entryContains(entry, ip) {
+				banned[jail] = entry
+				break
+			}
+		}
+	}
+	return banned, nil
+}
+
+// UnbanEverywhere removes an IP from every jail that bans it, including
+// jails that ban it as part of a network
+func (h *IPHandler) UnbanEverywhere(c *gin.Context) {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid IP address",
+		})
+		return
+	}
+	ctx := c.Request.Context()
+
+	jails, err := h.f2bClient.GetJails(ctx)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to get jails: " + err.Error(),
+		})
+		return
+	}
+	scope := auth.ScopeFromContext(c)
+	jails = scope.FilterJails(jails)
+
+	banned, err := h.bannedIn(ctx, ip, jails)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to unban IP: " + err.Error(),
+		})
+		return
+	}
+
+	// Group the jails by what they ban so each target is released once
+	byTarget := make(map[string][]string)
+	var targets []string
+	for _, jail := range jails {
+		target, ok := banned[jail]
+		if !ok {
+			continue
+		}
+		if _, seen := byTarget[target]; !seen {
+			targets = append(targets, target)
+		}
+		byTarget[target] = append(byTarget[target], jail)
+	}
+
+	report := models.UnbanReport{IP: ip.String(), Released: []models.ReleasedBans{}}
+	released := make(map[string][]string)
+	for _, target := range targets {
+		// Unbanning everywhere would reach jails outside a restricted scope
+		err := fail2ban.ErrUnsupported
+		if scope.AllJails() {
+			_, err = h.f2bClient.UnbanIPEverywhere(ctx, target)
+		}
+		if err == nil {
+			for _, jail := range byTarget[target] {
+				released[jail] = append(released[jail], target)
+			}
+			continue
+		}
+		if !errors.Is(err, fail2ban.ErrUnsupported) {
+			c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+				Success: false,
+				Error:   "Failed to unban IP: " + err.Error(),
+			})
+			return
+		}
+
+		// Older servers can only unban one jail at a time
+		for _, jail := range byTarget[target] {
+			if err := h.f2bClient.UnbanIP(ctx, jail, target); err != nil {
+				if fail2ban.IsTimeout(err) {
+					c.JSON(http.StatusGatewayTimeout, models.APIResponse{
+						Success: false,
+						Error:   "Failed to unban IP: " + err.Error(),
+					})
+					return
+				}
+				report.Failed++
+				continue
+			}
+			released[jail] = append(released[jail], target)
+		}
+	}
+
+	for _, jail := range jails {
+		if ips, ok := released[jail]; ok {
+			report.Released = append(report.Released, models.ReleasedBans{Jail: jail, IPs: ips})
+			report.Total += len(ips)
+		}
+	}
+
+	h.endReleased(c, report)
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: unbanMessage(report),
+		Data:    report,
+	})
+}
+
+// UnbanAllInJail removes every ban from a jail
+func (h *IPHandler) UnbanAllInJail(c *gin.Context) {
+	jailName := c.Param("name")
+	if jailName == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Jail name is required",
+		})
+		return
+	}
+	ctx := c.Request.Context()
+
+	ips, err := h.f2bClient.GetBannedIPs(ctx, jailName)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to get banned IPs: " + err.Error(),
+		})
+		return
+	}
+
+	report := models.UnbanReport{Released: []models.ReleasedBans{}}
+	if err := h.releaseJail(ctx, &report, jailName, ips); err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to unban IPs: " + err.Error(),
+		})
+		return
+	}
+
+	h.endReleased(c, report)
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: unbanMessage(report),
+		Data:    report,
 	})
 }
 
+// UnbanAll removes every ban from every jail. The banned lists are read
+// first so the response can say what was released.
+func (h *IPHandler) UnbanAll(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	jails, err := h.f2bClient.GetJails(ctx)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to get jails: " + err.Error(),
+		})
+		return
+	}
+	scope := auth.ScopeFromContext(c)
+	jails = scope.FilterJails(jails)
+
+	banned := make(map[string][]string)
+	for _, jail := range jails {
+		ips, err := h.f2bClient.GetBannedIPs(ctx, jail)
+		if err != nil {
+			c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+				Success: false,
+				Error:   "Failed to get banned IPs: " + err.Error(),
+			})
+			return
+		}
+		banned[jail] = ips
+	}
+
+	report := models.UnbanReport{Released: []models.ReleasedBans{}}
+	// Unbanning all would reach jails outside a restricted scope
+	count, err := 0, fail2ban.ErrUnsupported
+	if scope.AllJails() {
+		count, err = h.f2bClient.UnbanAll(ctx)
+	}
+	switch {
+	case err == nil:
+		for _, jail := range jails {
+			if len(banned[jail]) > 0 {
+				report.Released = append(report.Released, models.ReleasedBans{Jail: jail, IPs: banned[jail]})
+			}
+		}
+		report.Total = count
+	case errors.Is(err, fail2ban.ErrUnsupported):
+		// Older servers, and restricted scopes, unban one jail at a time
+		for _, jail := range jails {
+			if err := h.releaseJail(ctx, &report, jail, banned[jail]); err != nil {
+				c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+					Success: false,
+					Error:   "Failed to unban IPs: " + err.Error(),
+				})
+				return
+			}
+		}
+	default:
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to unban IPs: " + err.Error(),
+		})
+		return
+	}
+
+	h.endReleased(c, report)
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: unbanMessage(report),
+		Data:    report,
+	})
+}
+
+// releaseJail unbans ips in a jail and adds the outcome to report. Only a
+// timeout or cancelled request is returned as an error; other failures are
+// counted in the report.
+func (h *IPHandler) releaseJail(ctx context.Context, report *models.UnbanReport, jailName string, ips []string) error {
+	errs := h.applyBulk(ctx, jailName, ips, false)
+
+	var released []string
+	for _, ip := range ips {
+		if err, failed := errs[ip]; failed {
+			if fail2ban.IsTimeout(err) || ctx.Err() != nil {
+				return err
+			}
+			report.Failed++
+			continue
+		}
+		released = append(released, ip)
+	}
+
+	if len(released) > 0 {
+		report.Released = append(report.Released, models.ReleasedBans{Jail: jailName, IPs: released})
+		report.Total += len(released)
+	}
+	return nil
+}
+
+// endReleased ends every ban in report
+func (h *IPHandler) endReleased(c *gin.Context, report models.UnbanReport) {
+	for _, released := range report.Released {
+		for _, ip := range released.IPs {
+			h.endBan(c, released.Jail, ip)
+		}
+	}
+}
+
+// unbanMessage summarises an unban report
+func unbanMessage(report models.UnbanReport) string {
+	if report.Total == 0 && report.Failed == 0 {
+		return "Nothing to unban"
+	}
+	msg := fmt.Sprintf("Released %d ban(s) in %d jail(s)", report.Total, len(report.Released))
+	if report.Failed > 0 {
+		msg += fmt.Sprintf(", %d failed", report.Failed)
+	}
+	return msg
+}
+
+// maxBulkItems limits the number of IPs in one bulk request
+const maxBulkItems = 1000
+
+// BulkBanIP bans many IP addresses or CIDR networks in a jail
+func (h *IPHandler) BulkBanIP(c *gin.Context) {
+	h.bulkApply(c, true)
+}
+
+// BulkUnbanIP unbans many IP addresses or CIDR networks in a jail
+func (h *IPHandler) BulkUnbanIP(c *gin.Context) {
+	h.bulkApply(c, false)
+}
+
+func (h *IPHandler) bulkApply(c *gin.Context, ban bool) {
+	jailName := c.Param("name")
+	if jailName == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Jail name is required",
+		})
+		return
+	}
+
+	var req models.BulkIPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+	if len(req.IPs) > maxBulkItems {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Too many IPs: at most %d per request", maxBulkItems),
+		})
+		return
+	}
+
+	// Validate every item first; only valid, distinct targets are applied
+	results := make([]models.BulkIPResult, len(req.IPs))
+	var targets []string
+	pending := make(map[string][]int) // target -> indexes of results
+	literals := make(map[int]string)  // index -> address to unban if its widened target is not banned
+	for i, ip := range req.IPs {
+		results[i].IP = ip
+
+		network, err := h.policy.banTarget(ip)
+		if err != nil {
+			results[i].Error = "Invalid IP address or network"
+			continue
+		}
+		if !ban {
+			if candidates, _ := h.policy.unbanTargets(ip); len(candidates) > 1 {
+				literals[i] = candidates[1]
+			}
+		}
+		if ban && h.policy.tooBroad(network) && !h.policy.allowBroad(c) {
+			results[i].Error = "Network " + network.String() + " is too broad to ban without elevated permission"
+			continue
+		}
+
+		target := formatNetwork(network)
+		results[i].Target = target
+		if _, seen := pending[target]; !seen {
+			targets = append(targets, target)
+		}
+		pending[target] = append(pending[target], i)
+	}
+
+	if req.DryRun {
+		for _, indexes := range pending {
+			for _, i := range indexes {
+				results[i].Success = true
+			}
+		}
+	} else {
+		ctx := c.Request.Context()
+		bannedAt := time.Now()
+		var errs map[string]error
+		if ban {
+			errs = h.applyBulk(ctx, jailName, targets, true)
+		} else {
+			errs = h.unbanBulk(ctx, jailName, targets)
+		}
+
+		var expiresAt *time.Time
+		if ban && len(errs) < len(targets) {
+			expiresAt = h.jailBanExpiry(ctx, jailName, bannedAt)
+		}
+
+		for _, target := range targets {
+			for _, i := range pending[target] {
+				if err := errs[target]; err != nil {
+					results[i].Error = err.Error()
+				} else {
+					results[i].Success = true
+				}
+			}
+			if errs[target] != nil {
+				continue
+			}
+
+			// A ban with the jail's bantime replaces any scheduled expiry
+			if ban {
+				h.cancelSchedule(jailName, target)
+				h.recordBan(c, bans.Metadata{
+					Jail:      jailName,
+					IP:        target,
+					Reason:    req.Reason,
+					Ticket:    req.Ticket,
+					Tags:      req.Tags,
+					BannedAt:  bannedAt,
+					ExpiresAt: expiresAt,
+				})
+			} else {
+				h.endBan(c, jailName, target)
+			}
+		}
+
+		// Unban the literal addresses of widened targets that failed
+		var retry []string
+		queued := make(map[string]bool)
+		for i, literal := range literals {
+			if errs[results[i].Target] != nil && !queued[literal] {
+				queued[literal] = true
+				retry = append(retry, literal)
+			}
+		}
+		retryErrs := h.unbanBulk(ctx, jailName, retry)
+		for i, literal := range literals {
+			if !queued[literal] || errs[results[i].Target] == nil || retryErrs[literal] != nil {
+				continue
+			}
+			results[i].Target = literal
+			results[i].Error = ""
+			results[i].Success = true
+			h.endBan(c, jailName, literal)
+		}
+	}
+
+	resp := models.BulkIPResponse{
+		Jail:    jailName,
+		DryRun:  req.DryRun,
+		Results: results,
+	}
+	for _, result := range results {
+		if result.Success {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	verb := "Unbanned"
+	if ban {
+		verb = "Banned"
+	}
+	if req.DryRun {
+		verb = "Validated"
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s %d of %d IPs", verb, resp.Succeeded, len(results)),
+		Data:    resp,
+	})
+}
+
+// unbanBulk unbans targets with applyBulk, suspending their schedules
+// meanwhile
+func (h *IPHandler) unbanBulk(ctx context.Context, jailName string, targets []string) map[string]error {
+	restore := make(map[string]func(), len(targets))
+	for _, target := range targets {
+		restore[target] = h.suspendSchedule(jailName, target)
+	}
+	errs := h.applyBulk(ctx, jailName, targets, false)
+	for target := range errs {
+		restore[target]()
+	}
+	return errs
+}
+
+// applyBulk bans or unbans targets and returns the error for each target
+// that failed. Backends that support it get a single batched command; if the
+// batch fails, targets are retried one by one to find the culprits.
+func (h *IPHandler) applyBulk(ctx context.Context, jailName string, targets []string, ban bool) map[string]error {
+	errs := make(map[string]error)
+	if len(targets) == 0 {
+		return errs
+	}
+
+	if batcher, ok := h.f2bClient.(fail2ban.BatchBanner); ok && len(targets) > 1 {
+		batch := targets
+		if !ban {
+			// fail2ban aborts a batched unban at the first address that is
+			// not banned, after releasing the ones before it, so only send
+			// addresses that are currently banned
+			if banned, err := h.f2bClient.GetBannedIPs(ctx, jailName); err == nil {
+				isBanned := make(map[string]bool)
+				for _, ip := range banned {
+					isBanned[ip] = true
+				}
+				batch = nil
+				for _, target := range targets {
+					if isBanned[target] {
+						batch = append(batch, target)
+					} else {
+						errs[target] = fmt.Errorf("%s is not banned", target)
+					}
+				}
+			}
+		}
+		if len(batch) == 0 {
+			return errs
+		}
+
+		var err error
+		if ban {
+			err = batcher.BanIPs(ctx, jailName, batch)
+		} else {
+			err = batcher.UnbanIPs(ctx, jailName, batch)
+		}
+		if err == nil {
+			return errs
+		}
+		if fail2ban.IsTimeout(err) || ctx.Err() != nil {
+			for _, target := range batch {
+				errs[target] = err
+			}
+			return errs
+		}
+		targets = batch
+	}
+
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			errs[target] = err
+			continue
+		}
+
+		var err error
+		if ban {
+			err = h.f2bClient.BanIP(ctx, jailName, target)
+		} else {
+			err = h.f2bClient.UnbanIP(ctx, jailName, target)
+		}
+		if err != nil {
+			errs[target] = err
+		}
+	}
+	return errs
+}
+
+// GetIgnoreIPs returns the IPs and networks a jail never bans
+func (h *IPHandler) GetIgnoreIPs(c *gin.Context) {
+	jailName := c.Param("name")
+	if jailName == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Jail name is required",
+		})
+		return
+	}
+
+	ips, err := h.f2bClient.GetIgnoreIPs(c.Request.Context(), jailName)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to get ignored IPs: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    gin.H{"jail": jailName, "ignore_ips": ips},
+	})
+}
+
+// AddIgnoreIP adds an IP or CIDR network to a jail's ignore list
+func (h *IPHandler) AddIgnoreIP(c *gin.Context) {
+	h.updateIgnoreIP(c, true)
+}
+
+// DeleteIgnoreIP removes an IP or CIDR network from a jail's ignore list.
+// The address may be given in the request body or as the "ip" query parameter.
+func (h *IPHandler) DeleteIgnoreIP(c *gin.Context) {
+	h.updateIgnoreIP(c, false)
+}
+
+func (h *IPHandler) updateIgnoreIP(c *gin.Context, add bool) {
+	jailName := c.Param("name")
+	if jailName == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Jail name is required",
+		})
+		return
+	}
+
+	var req models.IgnoreIPRequest
+	if ip := c.Query("ip"); ip != "" && !add {
+		req.IP = ip
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	ip, err := parseIPOrNetwork(req.IP)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid IP address or network",
+		})
+		return
+	}
+	if !add {
+		// fail2ban matches entries literally, so remove exactly what was listed
+		ip = strings.TrimSpace(req.IP)
+	}
+
+	action, verb := "added to", "add"
+	if add {
+		err = h.f2bClient.AddIgnoreIP(c.Request.Context(), jailName, ip)
+	} else {
+		action, verb = "removed from", "remove"
+		err = h.f2bClient.DelIgnoreIP(c.Request.Context(), jailName, ip)
+	}
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to " + verb + " ignored IP: " + err.Error(),
+		})
+		return
+	}
+
+	ips, err := h.f2bClient.GetIgnoreIPs(c.Request.Context(), jailName)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to get ignored IPs: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "IP " + action + " ignore list successfully",
+		Data:    gin.H{"jail": jailName, "ip": ip, "ignore_ips": ips},
+	})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fail2rest/v2/internal/bans"
+	"github.com/fail2rest/v2/internal/fail2ban"
+)
+
+// legacyBackend is a fake server too old to set a bantime per ban
+type legacyBackend struct {
+	*fail2ban.FakeBackend
+}
+
+func (legacyBackend) BanIPFor(ctx context.Context, jailName, ip string, banTime int) error {
+	return fail2ban.ErrUnsupported
+}
+
+func newTestIPHandler(t *testing.T, backend fail2ban.Backend) *IPHandler {
+	t.Helper()
+	dir := t.TempDir()
+	scheduler, err := bans.NewScheduler(backend, filepath.Join(dir, "scheduled_bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := bans.NewMetadataStore(filepath.Join(dir, "ban_metadata.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIPHandler(backend, BanPolicy{}, scheduler, metadata)
+}
+
+func banTimeOf(t *testing.T, backend fail2ban.Backend, ip string) int {
+	t.Helper()
+	infos, err := backend.GetBans(context.Background(), "sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.IP == ip {
+			return info.BanTime
+		}
+	}
+	t.Fatalf("%s is not banned", ip)
+	return 0
+}
+
+func TestBanDuration(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		legacy    bool
+		banTime   int
+		bantime   int // as reported by the backend
+		scheduled bool
+	}{
+		{"per-ticket bantime", false, 7200, 7200, false},
+		{"per-ticket permanent", false, -1, -1, false},
+		{"scheduled on older servers", true, 7200, 600, true},
+		{"scheduled permanent on older servers", true, -1, 600, true},
+		{"jail's bantime", false, 0, 600, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backend fail2ban.Backend = fail2ban.NewFakeBackend([]string{"sshd"}, 10*time.Minute)
+			if tt.legacy {
+				backend = legacyBackend{backend.(*fail2ban.FakeBackend)}
+			}
+			h := newTestIPHandler(t, backend)
+
+			expiresAt, warning, err := h.ban(ctx, "sshd", "192.0.2.1", tt.banTime)
+			if err != nil || warning != "" {
+				t.Fatalf("ban() = %q, %v", warning, err)
+			}
+			if got := banTimeOf(t, backend, "192.0.2.1"); got != tt.bantime {
+				t.Errorf("bantime = %d, want %d", got, tt.bantime)
+			}
+			if _, scheduled := h.scheduler.Lookup("sshd", "192.0.2.1"); scheduled != tt.scheduled {
+				t.Errorf("scheduled = %v, want %v", scheduled, tt.scheduled)
+			}
+
+			want := 600
+			if tt.banTime != 0 {
+				want = tt.banTime
+			}
+			if want < 0 {
+				if expiresAt != nil {
+					t.Errorf("permanent ban expires at %v", expiresAt)
+				}
+			} else if expiresAt == nil || time.Until(*expiresAt).Round(time.Minute) != time.Duration(want)*time.Second {
+				t.Errorf("expires at %v, want in %ds", expiresAt, want)
+			}
+		})
+	}
+}
+
+func TestBanScheduleFailure(t *testing.T) {
+	backend := legacyBackend{fail2ban.NewFakeBackend([]string{"sshd"}, 10*time.Minute)}
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, err := bans.NewScheduler(backend, filepath.Join(dir, "scheduled_bans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewIPHandler(backend, BanPolicy{}, scheduler, nil)
+	os.RemoveAll(dir) // schedules can no longer be saved
+
+	// The ban stays in effect, reported with the jail's bantime
+	expiresAt, warning, err := h.ban(context.Background(), "sshd", "192.0.2.1", 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warning == "" {
+		t.Error("no warning that the duration was not applied")
+	}
+	if got := banTimeOf(t, backend, "192.0.2.1"); got != 600 {
+		t.Errorf("bantime = %d, want the jail's 600", got)
+	}
+	if expiresAt == nil || time.Until(*expiresAt).Round(time.Minute) != 10*time.Minute {
+		t.Errorf("expires at %v, want the jail's bantime from now", expiresAt)
+	}
+}
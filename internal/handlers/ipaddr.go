@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BanPolicy controls which addresses and networks may be banned
+type BanPolicy struct {
+	// IPv6Prefix widens single IPv6 addresses to their network of this size
+	// (e.g. 64), since one host usually controls a whole prefix. 128 or 0
+	// bans single addresses.
+	IPv6Prefix int
+
+	// Networks broader than these prefixes require elevated permission
+	MinIPv4Prefix int
+	MinIPv6Prefix int
+
+	// AllowBroad reports whether the caller holds the elevated permission to
+	// ban networks broader than the minimum prefixes. Nil denies everyone.
+	AllowBroad func(c *gin.Context) bool
+}
+
+// parseIPOrNetwork validates a single IP address or a CIDR network and
+// returns it in canonical form (host bits of a network are cleared)
+func parseIPOrNetwork(s string) (string, error) {
+	network, err := parseNetwork(s)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(s, "/") {
+		return network.String(), nil
+	}
+	return network.IP.String(), nil
+}
+
+// parseNetwork parses an IP address (as a single-host network) or a CIDR
+// network
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// banTarget returns the exact network to ban or unban for a requested IP or
+// CIDR network. Bare IPv6 addresses are widened to the IPv6 prefix; explicit
+// CIDR networks, /128 included, are used as given.
+func (p *BanPolicy) banTarget(s string) (*net.IPNet, error) {
+	network, err := parseNetwork(s)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits == 128 && ones == 128 && !strings.Contains(s, "/") && p.IPv6Prefix > 0 && p.IPv6Prefix < 128 {
+		mask := net.CIDRMask(p.IPv6Prefix, 128)
+		network = &net.IPNet{IP: network.IP.Mask(mask), Mask: mask}
+	}
+	return network, nil
+}
+
+// unbanTargets returns the entries to try, in order, to unban a requested IP
+// or CIDR network: the ban target and, for a widened IPv6 address, the
+// address itself, which fail2ban's own filters ban
+func (p *BanPolicy) unbanTargets(s string) ([]string, error) {
+	network, err := p.banTarget(s)
+	if err != nil {
+		return nil, err
+	}
+	targets := []string{formatNetwork(network)}
+	if literal, _ := parseNetwork(s); formatNetwork(literal) != targets[0] {
+		targets = append(targets, formatNetwork(literal))
+	}
+	return targets, nil
+}
+
+// tooBroad reports whether banning network requires elevated permission
+func (p *BanPolicy) tooBroad(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		return ones < p.MinIPv4Prefix
+	}
+	return ones < p.MinIPv6Prefix
+}
+
+// allowBroad reports whether the caller may ban networks that are too broad
+func (p *BanPolicy) allowBroad(c *gin.Context) bool {
+	return p.AllowBroad != nil && p.AllowBroad(c)
+}
+
+// formatNetwork renders a network the way fail2ban expects it: single hosts
+// as plain addresses, anything else in CIDR notation
+func formatNetwork(network *net.IPNet) string {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+// entryContains reports whether a banned or ignored entry (an address or
+// CIDR network) covers ip. Entries that are neither, such as host names,
+// never match.
+func entryContains(entry string, ip net.IP) bool {
+	network, err := parseNetwork(entry)
+	if err != nil {
+		return false
+	}
+	return network.Contains(ip)
+}
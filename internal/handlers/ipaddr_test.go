@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBanTarget(t *testing.T) {
+	policy := &BanPolicy{IPv6Prefix: 64}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.0/24", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::/64"},
+		{"2001:db8::1/128", "2001:db8::1"},
+		{"2001:db8::1/48", "2001:db8::/48"},
+	}
+	for _, tt := range tests {
+		network, err := policy.banTarget(tt.in)
+		if err != nil {
+			t.Fatalf("banTarget(%q): %v", tt.in, err)
+		}
+		if got := formatNetwork(network); got != tt.want {
+			t.Errorf("banTarget(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := policy.banTarget("not-an-ip"); err == nil {
+		t.Error("banTarget accepted an invalid address")
+	}
+}
+
+func TestUnbanTargets(t *testing.T) {
+	tests := []struct {
+		prefix int
+		in     string
+		want   []string
+	}{
+		{64, "2001:db8::1", []string{"2001:db8::/64", "2001:db8::1"}},
+		{64, "2001:db8::1/128", []string{"2001:db8::1"}},
+		{64, "192.0.2.1", []string{"192.0.2.1"}},
+		{128, "2001:db8::1", []string{"2001:db8::1"}},
+		{0, "2001:db8::1", []string{"2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		policy := &BanPolicy{IPv6Prefix: tt.prefix}
+		got, err := policy.unbanTargets(tt.in)
+		if err != nil {
+			t.Fatalf("unbanTargets(%q): %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unbanTargets(%q) with prefix %d = %v, want %v", tt.in, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -1,18 +1,22 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/fail2rest/v2/internal/auth"
 	"github.com/fail2rest/v2/internal/fail2ban"
 	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
 )
 
 type JailHandler struct {
-	f2bClient *fail2ban.Client
+	f2bClient fail2ban.Backend
 }
 
-func NewJailHandler(f2bClient *fail2ban.Client) *JailHandler {
+func NewJailHandler(f2bClient fail2ban.Backend) *JailHandler {
 	return &JailHandler{
 		f2bClient: f2bClient,
 	}
@@ -20,9 +24,9 @@ func NewJailHandler(f2bClient *fail2ban.Client) *JailHandler {
 
 // GetJails returns a list of all jails
 func (h *JailHandler) GetJails(c *gin.Context) {
-	jails, err := h.f2bClient.GetJails()
+	jails, err := h.f2bClient.GetJails(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to get jails: " + err.Error(),
 		})
@@ -30,7 +34,7 @@ func (h *JailHandler) GetJails(c *gin.Context) {
 	}
 
 	var jailInfos []models.JailInfo
-	for _, jail := range jails {
+	for _, jail := range auth.ScopeFromContext(c).FilterJails(jails) {
 		jailInfos = append(jailInfos, models.JailInfo{
 			Name: jail,
 		})
@@ -53,9 +57,9 @@ func (h *JailHandler) GetJail(c *gin.Context) {
 		return
 	}
 
-	status, err := h.f2bClient.GetJailStatus(jailName)
+	status, err := h.f2bClient.GetJailStatus(c.Request.Context(), jailName)
 	if err != nil {
-		c.JSON(http.StatusNotFound, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusNotFound), models.APIResponse{
 			Success: false,
 			Error:   "Jail not found or error: " + err.Error(),
 		})
@@ -84,9 +88,9 @@ func (h *JailHandler) GetJailStatus(c *gin.Context) {
 		return
 	}
 
-	status, err := h.f2bClient.GetJailStatus(jailName)
+	status, err := h.f2bClient.GetJailStatus(c.Request.Context(), jailName)
 	if err != nil {
-		c.JSON(http.StatusNotFound, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusNotFound), models.APIResponse{
 			Success: false,
 			Error:   "Jail not found or error: " + err.Error(),
 		})
@@ -110,8 +114,8 @@ func (h *JailHandler) StartJail(c *gin.Context) {
 		return
 	}
 
-	if err := h.f2bClient.StartJail(jailName); err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+	if err := h.f2bClient.StartJail(c.Request.Context(), jailName); err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to start jail: " + err.Error(),
 		})
@@ -135,8 +139,8 @@ func (h *JailHandler) StopJail(c *gin.Context) {
 		return
 	}
 
-	if err := h.f2bClient.StopJail(jailName); err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+	if err := h.f2bClient.StopJail(c.Request.Context(), jailName); err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to stop jail: " + err.Error(),
 		})
@@ -160,8 +164,8 @@ func (h *JailHandler) RestartJail(c *gin.Context) {
 		return
 	}
 
-	if err := h.f2bClient.RestartJail(jailName); err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+	if err := h.f2bClient.RestartJail(c.Request.Context(), jailName); err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to restart jail: " + err.Error(),
 		})
@@ -185,8 +189,8 @@ func (h *JailHandler) ReloadJail(c *gin.Context) {
 		return
 	}
 
-	if err := h.f2bClient.ReloadJail(jailName); err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+	if err := h.f2bClient.ReloadJail(c.Request.Context(), jailName); err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to reload jail: " + err.Error(),
 		})
@@ -199,3 +203,151 @@ func (h *JailHandler) ReloadJail(c *gin.Context) {
 	})
 }
 
+// GetJailSettings returns the runtime parameters of a jail
+func (h *JailHandler) GetJailSettings(c *gin.Context) {
+	jailName := c.Param("name")
+	if jailName == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Jail name is required",
+		})
+		return
+	}
+
+	settings, err := h.f2bClient.GetJailSettings(c.Request.Context(), jailName)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusNotFound), models.APIResponse{
+			Success: false,
+			Error:   "Jail not found or error: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    gin.H{"jail": jailName, "settings": settings},
+	})
+}
+
+// UpdateJailSettings changes runtime parameters of a jail and returns the
+// effective values
+func (h *JailHandler) UpdateJailSettings(c *gin.Context) {
+	jailName := c.Param("name")
+	if jailName == "" {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Jail name is required",
+		})
+		return
+	}
+
+	var req models.JailSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	update, err := parseJailSettingsRequest(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Error:   "Invalid settings: " + err.Error(),
+		})
+		return
+	}
+
+	if err := h.f2bClient.SetJailSettings(c.Request.Context(), jailName, update); err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Failed to update jail settings: " + err.Error(),
+		})
+		return
+	}
+
+	settings, err := h.f2bClient.GetJailSettings(c.Request.Context(), jailName)
+	if err != nil {
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
+			Success: false,
+			Error:   "Settings updated, but failed to read them back: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Jail settings updated successfully",
+		Data:    gin.H{"jail": jailName, "settings": settings},
+	})
+}
+
+// parseBanTime converts a bantime ("600", "2h", "7d", "-1" or "permanent")
+// to seconds, -1 meaning permanent
+func parseBanTime(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "-1" || value == "permanent" {
+		return -1, nil
+	}
+	d, err := fail2ban.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("bantime must be at least one second")
+	}
+	return int(d / time.Second), nil
+}
+
+// parseJailSettingsRequest validates a settings request
+func parseJailSettingsRequest(req *models.JailSettingsRequest) (*fail2ban.JailSettingsUpdate, error) {
+	update := &fail2ban.JailSettingsUpdate{
+		MaxRetry:   req.MaxRetry,
+		MaxMatches: req.MaxMatches,
+	}
+
+	if req.BanTime == nil && req.FindTime == nil && req.MaxRetry == nil && req.MaxMatches == nil && req.UseDNS == nil {
+		return nil, fmt.Errorf("no settings provided")
+	}
+
+	if req.BanTime != nil {
+		banTime, err := parseBanTime(*req.BanTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bantime %q: must be a positive duration, -1 or permanent", *req.BanTime)
+		}
+		update.BanTime = &banTime
+	}
+
+	if req.FindTime != nil {
+		d, err := fail2ban.ParseDuration(*req.FindTime)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid findtime %q: must be a positive duration", *req.FindTime)
+		}
+		findTime := int(d / time.Second)
+		update.FindTime = &findTime
+	}
+
+	if req.MaxRetry != nil && *req.MaxRetry < 1 {
+		return nil, fmt.Errorf("invalid maxretry %d: must be at least 1", *req.MaxRetry)
+	}
+	if req.MaxMatches != nil && *req.MaxMatches < 0 {
+		return nil, fmt.Errorf("invalid maxmatches %d: must not be negative", *req.MaxMatches)
+	}
+
+	if req.UseDNS != nil {
+		mode := strings.ToLower(strings.TrimSpace(*req.UseDNS))
+		valid := false
+		for _, m := range fail2ban.UseDNSModes {
+			if mode == m {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid usedns %q: must be one of %s", *req.UseDNS, strings.Join(fail2ban.UseDNSModes, ", "))
+		}
+		update.UseDNS = &mode
+	}
+
+	return update, nil
+}
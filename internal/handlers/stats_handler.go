@@ -4,16 +4,17 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/fail2rest/v2/internal/auth"
 	"github.com/fail2rest/v2/internal/fail2ban"
 	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
 )
 
 type StatsHandler struct {
-	f2bClient *fail2ban.Client
+	f2bClient fail2ban.Backend
 }
 
-func NewStatsHandler(f2bClient *fail2ban.Client) *StatsHandler {
+func NewStatsHandler(f2bClient fail2ban.Backend) *StatsHandler {
 	return &StatsHandler{
 		f2bClient: f2bClient,
 	}
@@ -21,15 +22,21 @@ func NewStatsHandler(f2bClient *fail2ban.Client) *StatsHandler {
 
 // GetStats returns overall statistics
 func (h *StatsHandler) GetStats(c *gin.Context) {
-	stats, err := h.f2bClient.GetOverallStats()
+	stats, err := h.f2bClient.GetOverallStats(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to get statistics: " + err.Error(),
 		})
 		return
 	}
 
+	scope := auth.ScopeFromContext(c)
+	stats = scopeStats(stats, scope)
+	if !scope.HasRole(auth.RoleViewer) {
+		stats = statsWithoutBannedIPs(stats)
+	}
+
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
 		Data: models.StatsResponse{
@@ -50,21 +57,62 @@ func (h *StatsHandler) GetJailStats(c *gin.Context) {
 		return
 	}
 
-	stats, err := h.f2bClient.GetJailStats(jailName)
+	stats, err := h.f2bClient.GetJailStatus(c.Request.Context(), jailName)
 	if err != nil {
-		c.JSON(http.StatusNotFound, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusNotFound), models.APIResponse{
 			Success: false,
 			Error:   "Jail not found or error: " + err.Error(),
 		})
 		return
 	}
+	if !auth.ScopeFromContext(c).HasRole(auth.RoleViewer) {
+		stats = withoutBannedIPs(stats)
+	}
 
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
-		Data: models.StatsResponse{
+		Data: models.JailStatsResponse{
+			Jail:      jailName,
 			Stats:     stats,
 			Timestamp: time.Now().Unix(),
 		},
 	})
 }
 
+// scopeStats restricts stats to the jails the caller may see
+func scopeStats(stats *fail2ban.OverallStats, scope auth.Scope) *fail2ban.OverallStats {
+	if scope.AllJails() {
+		return stats
+	}
+
+	scoped := &fail2ban.OverallStats{
+		Jails:       scope.FilterJails(stats.Jails),
+		JailDetails: make(map[string]*fail2ban.JailStatus),
+	}
+	scoped.JailCount = len(scoped.Jails)
+	for _, jail := range scoped.Jails {
+		if status, ok := stats.JailDetails[jail]; ok {
+			scoped.JailDetails[jail] = status
+			scoped.TotalBannedIPs += status.Actions.CurrentlyBanned
+		}
+	}
+	return scoped
+}
+
+// statsWithoutBannedIPs copies stats without the banned addresses, for
+// callers with only the stats role
+func statsWithoutBannedIPs(stats *fail2ban.OverallStats) *fail2ban.OverallStats {
+	stripped := *stats
+	stripped.JailDetails = make(map[string]*fail2ban.JailStatus, len(stats.JailDetails))
+	for jail, status := range stats.JailDetails {
+		stripped.JailDetails[jail] = withoutBannedIPs(status)
+	}
+	return &stripped
+}
+
+// withoutBannedIPs copies a jail status without the banned addresses
+func withoutBannedIPs(status *fail2ban.JailStatus) *fail2ban.JailStatus {
+	stripped := *status
+	stripped.Actions.BannedIPs = []string{}
+	return &stripped
+}
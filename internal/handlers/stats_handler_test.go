@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fail2rest/v2/internal/auth"
+	"github.com/fail2rest/v2/internal/fail2ban"
+	"github.com/gin-gonic/gin"
+)
+
+// Callers with only the stats role get counts but no addresses
+func TestStatsWithoutBannedIPs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	backend := fail2ban.NewFakeBackend([]string{"sshd", "nginx"}, time.Minute)
+	backend.BanIP(context.Background(), "sshd", "192.0.2.1")
+	handler := NewStatsHandler(backend)
+
+	for _, role := range []string{auth.RoleStats, auth.RoleViewer} {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set(auth.ContextScope, auth.Scope{Roles: []string{role}})
+		})
+		router.GET("/stats", handler.GetStats)
+		router.GET("/jails/:name/stats", handler.GetJailStats)
+
+		var overall struct {
+			Data struct {
+				Stats fail2ban.OverallStats `json:"stats"`
+			} `json:"data"`
+		}
+		get(t, router, "/stats", &overall)
+		var jail struct {
+			Data struct {
+				Stats fail2ban.JailStatus `json:"stats"`
+			} `json:"data"`
+		}
+		get(t, router, "/jails/sshd/stats", &jail)
+
+		wantIPs := 0
+		if role == auth.RoleViewer {
+			wantIPs = 1
+		}
+		sshd := overall.Data.Stats.JailDetails["sshd"]
+		if overall.Data.Stats.TotalBannedIPs != 1 || sshd == nil || sshd.Actions.CurrentlyBanned != 1 || len(sshd.Actions.BannedIPs) != wantIPs {
+			t.Errorf("%s: /stats = %+v, sshd %+v", role, overall.Data.Stats, sshd)
+		}
+		if jail.Data.Stats.Actions.CurrentlyBanned != 1 || len(jail.Data.Stats.Actions.BannedIPs) != wantIPs {
+			t.Errorf("%s: /jails/sshd/stats = %+v", role, jail.Data.Stats)
+		}
+	}
+
+	// The backend's own state is left alone
+	if banned, _ := backend.GetBannedIPs(context.Background(), "sshd"); len(banned) != 1 {
+		t.Errorf("banned IPs = %v", banned)
+	}
+}
+
+func get(t *testing.T, router *gin.Engine, path string, v interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", path, w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,16 +4,17 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/fail2rest/v2/internal/auth"
 	"github.com/fail2rest/v2/internal/fail2ban"
 	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
 )
 
 type StatusHandler struct {
-	f2bClient *fail2ban.Client
+	f2bClient fail2ban.Backend
 }
 
-func NewStatusHandler(f2bClient *fail2ban.Client) *StatusHandler {
+func NewStatusHandler(f2bClient fail2ban.Backend) *StatusHandler {
 	return &StatusHandler{
 		f2bClient: f2bClient,
 	}
@@ -21,15 +22,21 @@ func NewStatusHandler(f2bClient *fail2ban.Client) *StatusHandler {
 
 // GetStatus returns the overall status of fail2ban
 func (h *StatusHandler) GetStatus(c *gin.Context) {
-	status, err := h.f2bClient.GetStatus()
+	status, err := h.f2bClient.GetStatus(c.Request.Context())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.APIResponse{
+		c.JSON(backendErrorStatus(err, http.StatusInternalServerError), models.APIResponse{
 			Success: false,
 			Error:   "Failed to get status: " + err.Error(),
 		})
 		return
 	}
 
+	// Only list the jails the caller may see
+	if scope := auth.ScopeFromContext(c); !scope.AllJails() {
+		status.Jails = scope.FilterJails(status.Jails)
+		status.JailCount = len(status.Jails)
+	}
+
 	c.JSON(http.StatusOK, models.APIResponse{
 		Success: true,
 		Data: models.StatusResponse{
@@ -38,4 +45,3 @@ func (h *StatusHandler) GetStatus(c *gin.Context) {
 		},
 	})
 }
-
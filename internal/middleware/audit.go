@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fail2rest/v2/internal/audit"
+	"github.com/fail2rest/v2/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// auditActions names the audited routes; other routes are recorded as
+// "<method> <route>"
+var auditActions = map[string]string{
+	"POST /api/v1/auth/login":                   "auth.login",
+	"POST /api/v1/auth/refresh":                 "auth.refresh",
+	"GET /api/v1/auth/oidc/callback":            "auth.oidc_login",
+	"POST /api/v1/auth/logout":                  "auth.logout",
+	"POST /api/v1/auth/revoke":                  "auth.revoke",
+	"POST /api/v1/jails/:name/start":            "jail.start",
+	"POST /api/v1/jails/:name/stop":             "jail.stop",
+	"POST /api/v1/jails/:name/restart":          "jail.restart",
+	"POST /api/v1/jails/:name/reload":           "jail.reload",
+	"PATCH /api/v1/jails/:name/settings":        "jail.settings",
+	"POST /api/v1/jails/:name/ban":              "ip.ban",
+	"POST /api/v1/jails/:name/unban":            "ip.unban",
+	"POST /api/v1/jails/:name/ban/bulk":         "ip.ban_bulk",
+	"POST /api/v1/jails/:name/unban/bulk":       "ip.unban_bulk",
+	"POST /api/v1/ips/:ip/unban":                "ip.unban_everywhere",
+	"POST /api/v1/jails/:name/unban-all":        "ip.unban_all",
+	"POST /api/v1/unban-all":                    "ip.unban_all",
+	"POST /api/v1/jails/:name/ignoreip":         "ignoreip.add",
+	"DELETE /api/v1/jails/:name/ignoreip":       "ignoreip.delete",
+	"POST /api/v1/admin/users":                  "user.create",
+	"PATCH /api/v1/admin/users/:username":       "user.update",
+	"DELETE /api/v1/admin/users/:username":      "user.delete",
+	"POST /api/v1/admin/users/:username/totp":   "user.totp_enroll",
+	"DELETE /api/v1/admin/users/:username/totp": "user.totp_disable",
+	"DELETE /api/v1/admin/lockouts/:principal":  "auth.unlock",
+	"POST /api/v1/admin/api-keys":               "api_key.create",
+	"PATCH /api/v1/admin/api-keys/:id":          "api_key.update",
+	"DELETE /api/v1/admin/api-keys/:id":         "api_key.delete",
+}
+
+// Limits keeping request summaries in the audit log small
+const (
+	auditMaxString = 200
+	auditMaxItems  = 20
+	auditMaxError  = 4096
+)
+
+// Audit records every mutating request in the audit log once it has been
+// handled, and reads named in auditActions (logins completed by redirect).
+// Requests to unknown routes are not recorded.
+func Audit(auditLog *audit.Log) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if _, named := auditActions[c.Request.Method+" "+c.FullPath()]; !named {
+				c.Next()
+				return
+			}
+		}
+		if c.FullPath() == "" {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		writer := &auditWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		route := c.Request.Method + " " + c.FullPath()
+		action, ok := auditActions[route]
+		if !ok {
+			action = route
+		}
+
+		record := audit.Record{
+			Time:      start,
+			Principal: auth.PrincipalFromContext(c),
+			SourceIP:  c.ClientIP(),
+			RequestID: c.GetString("request_id"),
+			Action:    action,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Jail:      c.Param("name"),
+			IP:        auditTargetIP(c, body),
+			Request:   summarizeBody(body),
+			Status:    writer.Status(),
+			Outcome:   "success",
+		}
+		if record.Status >= 400 {
+			record.Outcome = "failure"
+			record.Error = writer.errorMessage()
+		}
+
+		if err := auditLog.Append(record); err != nil {
+			log.Printf("[%s] %v", record.RequestID, err)
+		}
+	}
+}
+
+// auditWriter keeps the start of error responses so their message can be
+// recorded
+type auditWriter struct {
+	gin.ResponseWriter
+	errBody bytes.Buffer
+}
+
+func (w *auditWriter) Write(data []byte) (int, error) {
+	if w.Status() >= 400 && w.errBody.Len() < auditMaxError {
+		w.errBody.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	if w.Status() >= 400 && w.errBody.Len() < auditMaxError {
+		w.errBody.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// errorMessage returns the error of an APIResponse written as the response
+func (w *auditWriter) errorMessage() string {
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.errBody.Bytes(), &resp); err != nil {
+		return ""
+	}
+	return truncate(resp.Error)
+}
+
+// auditTargetIP returns the IP or network a request acts on, if any
+func auditTargetIP(c *gin.Context, body []byte) string {
+	if ip := c.Param("ip"); ip != "" {
+		return ip
+	}
+	if ip := c.Query("ip"); ip != "" {
+		return ip
+	}
+	var req struct {
+		IP string `json:"ip"`
+	}
+	if json.Unmarshal(body, &req) == nil {
+		return req.IP
+	}
+	return ""
+}
+
+// summarizeBody returns a JSON request body with secrets redacted and long
+// values shortened, or nil if the body is not a JSON object
+func summarizeBody(body []byte) json.RawMessage {
+	var fields map[string]interface{}
+	if len(body) == 0 || json.Unmarshal(body, &fields) != nil || len(fields) == 0 {
+		return nil
+	}
+
+	for key, value := range fields {
+		if isSecretField(key) {
+			fields[key] = "[redacted]"
+			continue
+		}
+		fields[key] = summarizeValue(value)
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func summarizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return truncate(v)
+	case []interface{}:
+		items := v
+		if len(items) > auditMaxItems {
+			items = append(items[:auditMaxItems:auditMaxItems], "...")
+		}
+		for i, item := range items {
+			items[i] = summarizeValue(item)
+		}
+		return items
+	case map[string]interface{}:
+		for key, item := range v {
+			if isSecretField(key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = summarizeValue(item)
+			}
+		}
+		return v
+	}
+	return value
+}
+
+// isSecretField reports whether a request field holds a credential
+func isSecretField(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range []string{"password", "secret", "token", "key", "code", "totp"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string) string {
+	if len(s) <= auditMaxString {
+		return s
+	}
+	s = s[:auditMaxString]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "..."
+}
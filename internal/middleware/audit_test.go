@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fail2rest/v2/internal/audit"
+	"github.com/fail2rest/v2/internal/auth"
+	"github.com/fail2rest/v2/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+func newAuditRouter(t *testing.T) (*gin.Engine, *audit.Log) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+
+	router := gin.New()
+	router.Use(Audit(auditLog))
+	router.POST("/api/v1/auth/login", func(c *gin.Context) {
+		c.Set(auth.ContextPrincipal, "user:alice")
+		c.JSON(http.StatusUnauthorized, models.APIResponse{Success: false, Error: "Invalid username or password"})
+	})
+	router.POST("/api/v1/jails/:name/ban", func(c *gin.Context) {
+		c.JSON(http.StatusOK, models.APIResponse{Success: true})
+	})
+	router.GET("/api/v1/jails/:name", func(c *gin.Context) {
+		c.JSON(http.StatusOK, models.APIResponse{Success: true})
+	})
+	return router, auditLog
+}
+
+func TestAuditRedactsSecrets(t *testing.T) {
+	router, auditLog := newAuditRouter(t)
+	body := `{
+		"username": "alice",
+		"password": "hunter2",
+		"api_key": "f2r_0c4c0be74bb5_secret",
+		"totp": "123456",
+		"refresh_token": "opaque",
+		"client_secret": "s3cret",
+		"settings": {"new_password": "hunter3", "roles": ["viewer"]},
+		"note": "` + strings.Repeat("x", 300) + `"
+	}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", strings.NewReader(body)))
+
+	records, err := auditLog.Query(audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("recorded %d requests, want 1", len(records))
+	}
+	r := records[0]
+	if r.Action != "auth.login" || r.Principal != "user:alice" || r.Outcome != "failure" || r.Error != "Invalid username or password" {
+		t.Errorf("record = %+v", r)
+	}
+
+	for _, secret := range []string{"hunter2", "hunter3", "f2r_0c4c0be74bb5_secret", "123456", "opaque", "s3cret"} {
+		if strings.Contains(string(r.Request), secret) {
+			t.Errorf("request summary leaks %q: %s", secret, r.Request)
+		}
+	}
+	var summary struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Settings struct {
+			NewPassword string   `json:"new_password"`
+			Roles       []string `json:"roles"`
+		} `json:"settings"`
+		Note string `json:"note"`
+	}
+	if err := json.Unmarshal(r.Request, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Username != "alice" || summary.Password != "[redacted]" || summary.Settings.NewPassword != "[redacted]" || len(summary.Settings.Roles) != 1 {
+		t.Errorf("request summary = %s", r.Request)
+	}
+	if len(summary.Note) != auditMaxString+len("...") {
+		t.Errorf("long value kept %d bytes", len(summary.Note))
+	}
+}
+
+func TestAuditRecordsMutations(t *testing.T) {
+	router, auditLog := newAuditRouter(t)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/v1/jails/sshd", nil),
+		httptest.NewRequest(http.MethodPost, "/api/v1/jails/sshd/ban", strings.NewReader(`{"ip": "192.0.2.1"}`)),
+		httptest.NewRequest(http.MethodPost, "/api/v1/unknown", nil),
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	records, err := auditLog.Query(audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("recorded %d requests, want only the ban", len(records))
+	}
+	if r := records[0]; r.Action != "ip.ban" || r.Jail != "sshd" || r.IP != "192.0.2.1" || r.Outcome != "success" {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestIsSecretField(t *testing.T) {
+	tests := map[string]bool{
+		"password":      true,
+		"Password":      true,
+		"api_key":       true,
+		"token":         true,
+		"refresh_token": true,
+		"totp":          true,
+		"recovery_code": true,
+		"jwt_secret":    true,
+		"ip":            false,
+		"username":      false,
+		"roles":         false,
+		"duration":      false,
+	}
+	for field, want := range tests {
+		if got := isSecretField(field); got != want {
+			t.Errorf("isSecretField(%q) = %v, want %v", field, got, want)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/fail2rest/v2/internal/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/ulule/limiter/v3"
 	"github.com/ulule/limiter/v3/drivers/store/memory"
@@ -48,13 +49,13 @@ func SecurityHeaders() gin.HandlerFunc {
 // RateLimiter creates a rate limiter middleware
 func RateLimiter(rate string) gin.HandlerFunc {
 	store := memory.NewStore()
-	
+
 	// Default rate: 80 requests per minute
 	defaultRate := limiter.Rate{
 		Period: 1 * time.Minute,
 		Limit:  80,
 	}
-	
+
 	// Parse custom rate if provided
 	if rate != "" {
 		parsed, err := limiter.NewRateFromFormatted(rate)
@@ -62,7 +63,7 @@ func RateLimiter(rate string) gin.HandlerFunc {
 			defaultRate = parsed
 		}
 	}
-	
+
 	instance := limiter.New(store, defaultRate)
 
 	return func(c *gin.Context) {
@@ -115,13 +116,19 @@ func RequestLogger() gin.HandlerFunc {
 			path = path + "?" + raw
 		}
 
-		log.Printf("[%s] %s %s %d %v %s",
+		principal := auth.PrincipalFromContext(c)
+		if principal == "" {
+			principal = "-"
+		}
+
+		log.Printf("[%s] %s %s %d %v %s %s",
 			requestID,
 			method,
 			path,
 			statusCode,
 			latency,
 			clientIP,
+			principal,
 		)
 	}
 }
@@ -168,4 +175,3 @@ func BodySizeLimit(maxSize int64) gin.HandlerFunc {
 		c.Next()
 	}
 }
-
@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/fail2rest/v2/internal/audit"
+	"github.com/fail2rest/v2/internal/fail2ban"
+)
 
 // APIResponse is the standard API response structure
 type APIResponse struct {
@@ -19,40 +24,289 @@ type LoginRequest struct {
 	// Username/Password authentication
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+	TOTP     string `json:"totp,omitempty"` // TOTP or recovery code, for users with two-factor authentication
 }
 
 // LoginResponse represents a login response
 type LoginResponse struct {
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
+	Token            string     `json:"token"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RefreshToken     string     `json:"refresh_token,omitempty"` // single use; redeem at /auth/refresh
+	RefreshExpiresAt *time.Time `json:"refresh_expires_at,omitempty"`
+}
+
+// RefreshRequest exchanges a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RevokeTokensRequest revokes every token issued to a principal
+type RevokeTokensRequest struct {
+	Principal string `json:"principal" binding:"required"` // e.g. "user:alice" or "api-key:monitoring"
+}
+
+// APIKeyInfo describes a configured API key without revealing it
+type APIKeyInfo struct {
+	ID           string     `json:"id,omitempty"` // public ID of generated keys
+	Principal    string     `json:"principal"`
+	Label        string     `json:"label,omitempty"`
+	Hashed       bool       `json:"hashed"` // false for plain text keys
+	Roles        []string   `json:"roles"`
+	Jails        []string   `json:"jails,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Expired      bool       `json:"expired"`
+	AllowedCIDRs []string   `json:"allowed_cidrs,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP   string     `json:"last_used_ip,omitempty"`
+	Source       string     `json:"source"` // "config" or "api"
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+// CreatedAPIKey is an API key just created, with the key itself, which is
+// not shown again
+type CreatedAPIKey struct {
+	Key string `json:"key"`
+	APIKeyInfo
+}
+
+// CreateAPIKeyRequest creates an API key
+type CreateAPIKeyRequest struct {
+	Name         string     `json:"name,omitempty"` // identifies the key in tokens and logs; defaults to its ID
+	Label        string     `json:"label,omitempty" binding:"max=200"`
+	Roles        []string   `json:"roles" binding:"required,min=1"`
+	Jails        []string   `json:"jails,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	AllowedCIDRs []string   `json:"allowed_cidrs,omitempty"`
+}
+
+// UpdateAPIKeyRequest changes an API key; omitted fields are left as they
+// are
+type UpdateAPIKeyRequest struct {
+	Label        *string    `json:"label,omitempty" binding:"omitempty,max=200"`
+	Roles        *[]string  `json:"roles,omitempty" binding:"omitempty,min=1"`
+	Jails        *[]string  `json:"jails,omitempty"`
+	AllowedCIDRs *[]string  `json:"allowed_cidrs,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	NeverExpires bool       `json:"never_expires,omitempty"` // removes the expiry
+}
+
+// LockoutInfo describes a user or API key with recent failed logins
+type LockoutInfo struct {
+	Principal     string     `json:"principal"`
+	Failures      int        `json:"failures"`
+	Locked        bool       `json:"locked"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LastIP        string     `json:"last_ip,omitempty"`
+}
+
+// UserInfo describes a user without its password
+type UserInfo struct {
+	Username  string     `json:"username"`
+	Roles     []string   `json:"roles"`
+	Jails     []string   `json:"jails,omitempty"`
+	Source    string     `json:"source"` // "config" or "api"
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	TOTPEnabled       bool `json:"totp_enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left,omitempty"`
+}
+
+// TOTPEnrollment is a new TOTP secret and recovery codes for a user, shown
+// only once
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"` // otpauth:// URI for authenticator apps
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// CreateUserRequest creates a user
+type CreateUserRequest struct {
+	Username string   `json:"username" binding:"required"`
+	Password string   `json:"password" binding:"required,min=8"`
+	Roles    []string `json:"roles" binding:"required,min=1"`
+	Jails    []string `json:"jails,omitempty"`
+}
+
+// UpdateUserRequest changes a user; omitted fields are left as they are
+type UpdateUserRequest struct {
+	Password *string   `json:"password,omitempty" binding:"omitempty,min=8"`
+	Roles    *[]string `json:"roles,omitempty" binding:"omitempty,min=1"`
+	Jails    *[]string `json:"jails,omitempty"`
 }
 
 // JailInfo represents information about a jail
 type JailInfo struct {
-	Name      string                 `json:"name"`
-	Status    map[string]interface{} `json:"status,omitempty"`
-	BannedIPs []string               `json:"banned_ips,omitempty"`
-	Stats     map[string]interface{} `json:"stats,omitempty"`
+	Name      string               `json:"name"`
+	Status    *fail2ban.JailStatus `json:"status,omitempty"`
+	BannedIPs []string             `json:"banned_ips,omitempty"`
 }
 
-// BanRequest represents a request to ban an IP
+// BanRequest represents a request to ban an IP address or CIDR network
 type BanRequest struct {
-	IP string `json:"ip" binding:"required"`
+	IP       string `json:"ip" binding:"required"`
+	Duration string `json:"duration,omitempty"` // e.g. "2h", "7d" or "permanent"; defaults to the jail's bantime
+
+	// Recorded with the ban and shown in the jail's banned list
+	Reason string   `json:"reason,omitempty" binding:"max=500"`
+	Ticket string   `json:"ticket,omitempty" binding:"max=100"`
+	Tags   []string `json:"tags,omitempty" binding:"max=20,dive,min=1,max=50"`
 }
 
-// UnbanRequest represents a request to unban an IP
+// UnbanRequest represents a request to unban an IP address or CIDR network
 type UnbanRequest struct {
 	IP string `json:"ip" binding:"required"`
 }
 
+// BannedIPsResponse lists the banned IPs of a jail
+type BannedIPsResponse struct {
+	Jail      string     `json:"jail"`
+	BannedIPs []string   `json:"banned_ips"`
+	Bans      []BannedIP `json:"bans"`
+}
+
+// BannedIP describes one banned IP. Times are omitted when unknown.
+type BannedIP struct {
+	IP        string     `json:"ip"`
+	BannedAt  *time.Time `json:"banned_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Permanent bool       `json:"permanent,omitempty"`
+
+	// Source is "api" for bans made through this API, which carry the
+	// details below, and "fail2ban" for bans by a filter or fail2ban-client
+	Source   string   `json:"source"`
+	BannedBy string   `json:"banned_by,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	Ticket   string   `json:"ticket,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// BulkIPRequest represents a request to ban or unban many IP addresses or
+// CIDR networks at once
+type BulkIPRequest struct {
+	IPs    []string `json:"ips" binding:"required,min=1"`
+	DryRun bool     `json:"dry_run,omitempty"`
+
+	// Recorded with each ban of a bulk ban; ignored when unbanning
+	Reason string   `json:"reason,omitempty" binding:"max=500"`
+	Ticket string   `json:"ticket,omitempty" binding:"max=100"`
+	Tags   []string `json:"tags,omitempty" binding:"max=20,dive,min=1,max=50"`
+}
+
+// BulkIPResult reports the outcome for one item of a bulk request
+type BulkIPResult struct {
+	IP      string `json:"ip"`
+	Target  string `json:"target,omitempty"` // exact address or network applied
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkIPResponse represents the outcome of a bulk ban or unban
+type BulkIPResponse struct {
+	Jail      string         `json:"jail"`
+	DryRun    bool           `json:"dry_run"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []BulkIPResult `json:"results"`
+}
+
+// IPLookupResponse reports the jails that ban or ignore an IP
+type IPLookupResponse struct {
+	IP        string        `json:"ip"`
+	Banned    bool          `json:"banned"`
+	Bans      []IPBan       `json:"bans"`
+	IgnoredBy []IgnoreMatch `json:"ignored_by"`
+	History   []BanRecord   `json:"history"` // bans made through the API, newest first
+}
+
+// BanRecord is the record of a current or past ban made through the API
+type BanRecord struct {
+	Jail       string     `json:"jail"`
+	Target     string     `json:"target"` // banned address or network
+	BannedBy   string     `json:"banned_by,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Ticket     string     `json:"ticket,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	BannedAt   time.Time  `json:"banned_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	UnbannedBy string     `json:"unbanned_by,omitempty"`
+}
+
+// IPBan describes a ban affecting a looked-up IP. Times are only known on
+// fail2ban 0.11 and later.
+type IPBan struct {
+	Jail             string     `json:"jail"`
+	Target           string     `json:"target"` // banned address or network
+	BannedAt         *time.Time `json:"banned_at,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	RemainingSeconds *int64     `json:"remaining_seconds,omitempty"`
+	Permanent        bool       `json:"permanent,omitempty"`
+}
+
+// IgnoreMatch names a jail whose ignore list covers a looked-up IP
+type IgnoreMatch struct {
+	Jail  string `json:"jail"`
+	Entry string `json:"entry"`
+}
+
+// UnbanReport lists the bans released by an unban-everywhere or unban-all
+// request
+type UnbanReport struct {
+	IP       string         `json:"ip,omitempty"`
+	Released []ReleasedBans `json:"released"`
+	Total    int            `json:"total"`
+	Failed   int            `json:"failed,omitempty"`
+}
+
+// ReleasedBans lists the addresses or networks released from one jail
+type ReleasedBans struct {
+	Jail string   `json:"jail"`
+	IPs  []string `json:"ips"`
+}
+
+// IgnoreIPRequest represents a request to add or remove an ignored IP or
+// CIDR network
+type IgnoreIPRequest struct {
+	IP string `json:"ip" binding:"required"`
+}
+
+// JailSettingsRequest represents a change to a jail's runtime parameters.
+// Durations are fail2ban time spans such as "600", "10m" or "1d"; a bantime of
+// "-1" or "permanent" bans forever.
+type JailSettingsRequest struct {
+	BanTime    *string `json:"bantime,omitempty"`
+	FindTime   *string `json:"findtime,omitempty"`
+	MaxRetry   *int    `json:"maxretry,omitempty"`
+	MaxMatches *int    `json:"maxmatches,omitempty"`
+	UseDNS     *string `json:"usedns,omitempty"`
+}
+
+// AuditResponse lists audit records, newest first
+type AuditResponse struct {
+	Records []audit.Record `json:"records"`
+	Count   int            `json:"count"`
+}
+
 // StatusResponse represents the status of fail2ban
 type StatusResponse struct {
-	Status    map[string]interface{} `json:"status"`
-	Timestamp int64                  `json:"timestamp"`
+	Status    *fail2ban.Status `json:"status"`
+	Timestamp int64            `json:"timestamp"`
 }
 
-// StatsResponse represents statistics
+// StatsResponse represents overall statistics
 type StatsResponse struct {
-	Stats     map[string]interface{} `json:"stats"`
+	Stats     *fail2ban.OverallStats `json:"stats"`
 	Timestamp int64                  `json:"timestamp"`
 }
+
+// JailStatsResponse represents statistics for a single jail
+type JailStatsResponse struct {
+	Jail      string               `json:"jail"`
+	Stats     *fail2ban.JailStatus `json:"stats"`
+	Timestamp int64                `json:"timestamp"`
+}